@@ -1,26 +1,61 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+	"github.com/vikasavn/virtual_disk_go/internal/virtualdisk"
 )
 
 type FileInfo struct {
-	Path string `json:"path"`
-	Size int64  `json:"size"`
+	Path       string     `json:"path"`
+	Size       int64      `json:"size"`
+	StoredSize int64      `json:"stored_size"` // size in storage, after compression
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
 }
 
 type StatsInfo struct {
-	TotalSize int64 `json:"totalSize"`
-	UsedSpace int64 `json:"usedSpace"`
-	FreeSpace int64 `json:"freeSpace"`
-	FileCount int   `json:"fileCount"`
+	TotalSize   int64 `json:"totalSize"`
+	UsedSpace   int64 `json:"usedSpace"`   // space taken in storage
+	LogicalSize int64 `json:"logicalSize"` // total size of the files
+	SavedSpace  int64 `json:"savedSpace"`  // space saved by compression
+	FreeSpace   int64 `json:"freeSpace"`
+	FileCount   int   `json:"fileCount"`
+}
+
+// BatchOp is one operation of a POST /api/batch request
+type BatchOp struct {
+	Op      string `json:"op"` // write, delete or rename
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	Data    []byte `json:"data"`     // content to write, base64 encoded
+	NewType string `json:"new_type"` // storage type of new_path, type if empty
+	NewPath string `json:"new_path"`
+	// LockToken is the token of an exclusive lease on a file the batch
+	// changes; it applies to the whole batch
+	LockToken string `json:"lock_token"`
+}
+
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
 }
 
 type Response struct {
@@ -29,6 +64,175 @@ type Response struct {
 	Error   string      `json:"error,omitempty"`
 }
 
+// parseStorageType maps the "type" query parameter onto a virtual disk storage type.
+// "disk" is accepted as an alias for persistent storage since the web UI uses it.
+func parseStorageType(c *gin.Context) (virtualdisk.StorageType, error) {
+	return parseStorageTypeParam(c, "type")
+}
+
+// parseStorageTypeParam maps a storage type query parameter onto a virtual disk storage type
+func parseStorageTypeParam(c *gin.Context, param string) (virtualdisk.StorageType, error) {
+	return parseStorageTypeName(c.Query(param))
+}
+
+// parseStorageTypeName maps a storage type name onto a virtual disk storage type
+func parseStorageTypeName(name string) (virtualdisk.StorageType, error) {
+	switch name {
+	case "", "disk", string(virtualdisk.StoragePersistent):
+		return virtualdisk.StoragePersistent, nil
+	case string(virtualdisk.StorageTemp):
+		return virtualdisk.StorageTemp, nil
+	case string(virtualdisk.StorageMemory):
+		return virtualdisk.StorageMemory, nil
+	case string(virtualdisk.StorageMount):
+		return virtualdisk.StorageMount, nil
+	default:
+		return "", fmt.Errorf("unknown storage type: %s", name)
+	}
+}
+
+// mountSource resolves a local directory a client asks to mount, which must be
+// under root. Relative paths are taken from root; without a root, local
+// directories cannot be mounted over HTTP.
+func mountSource(root, path string) (string, error) {
+	if root == "" {
+		return "", fmt.Errorf("failed to mount %s: local mounts are disabled: %w", path, fs.ErrPermission)
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve mount root: %w", err)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+
+	// Symlinks are resolved so they can't lead out of the root
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to mount %s: %w", path, err)
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("failed to mount %s: outside the mount root: %w", path, fs.ErrPermission)
+	}
+	return resolved, nil
+}
+
+// virtualPath builds the virtual disk path for a path relative to a storage type
+func virtualPath(storageType virtualdisk.StorageType, path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+	return virtualdisk.PathPrefix(storageType) + path
+}
+
+// listStorage returns all files of the given storage type with paths relative to it
+func listStorage(vd *virtualdisk.VirtualDisk, storageType virtualdisk.StorageType) ([]FileInfo, error) {
+	prefix := virtualdisk.PathPrefix(storageType)
+	items, err := vd.ListFilesAndDirs(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileInfo, 0, len(items))
+	for _, item := range items {
+		if item.IsDir || vd.StorageType(item.Path) != storageType {
+			continue
+		}
+		storedSize := item.Size
+		if item.Compression != "" {
+			storedSize = item.StoredSize
+		}
+		files = append(files, FileInfo{
+			Path:       strings.TrimPrefix(item.Path, prefix),
+			Size:       item.Size,
+			StoredSize: storedSize,
+			ExpiresAt:  item.ExpiresAt,
+		})
+	}
+	return files, nil
+}
+
+// listSnapshot lists the files in a snapshot
+func listSnapshot(fsys fs.FS) ([]FileInfo, error) {
+	files := make([]FileInfo, 0)
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{
+			Path:       path,
+			Size:       info.Size(),
+			StoredSize: info.Size(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// parseWriteOptions reads the "ttl" (a duration such as "24h"),
+// "expires_at" (RFC 3339) and "lock_token" query parameters
+func parseWriteOptions(c *gin.Context) (virtualdisk.WriteOptions, error) {
+	var opts virtualdisk.WriteOptions
+	if ttl := c.Query("ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid ttl: %s", ttl)
+		}
+		opts.TTL = d
+	}
+	if expiresAt := c.Query("expires_at"); expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return opts, fmt.Errorf("invalid expires_at: %s", expiresAt)
+		}
+		opts.ExpiresAt = t
+	}
+	opts.LockToken = c.Query("lock_token")
+	return opts, nil
+}
+
+// errorStatus maps an error from the virtual disk onto an HTTP status,
+// falling back to status for errors it does not recognise
+func errorStatus(err error, status int) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, virtualdisk.ErrAttrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrExist), errors.Is(err, virtualdisk.ErrDirNotEmpty):
+		return http.StatusConflict
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, virtualdisk.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, virtualdisk.ErrNoVersionHistory):
+		return http.StatusBadRequest
+	case errors.Is(err, virtualdisk.ErrLocked), errors.Is(err, virtualdisk.ErrLeaseNotFound):
+		return http.StatusLocked
+	}
+	return status
+}
+
+// relativeLease returns a lease with its path relative to its storage type
+func relativeLease(vd *virtualdisk.VirtualDisk, lease virtualdisk.Lease) virtualdisk.Lease {
+	lease.Path = strings.TrimPrefix(lease.Path, virtualdisk.PathPrefix(vd.StorageType(lease.Path)))
+	return lease
+}
+
+// writeStream copies r into a file on the virtual disk
+func writeStream(vd *virtualdisk.VirtualDisk, path string, r io.Reader, opts virtualdisk.WriteOptions) error {
+	w, err := vd.CreateWith(path, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
 func main() {
 	// Set up data directory
 	dataDir := os.Getenv("DATA_PARTITION")
@@ -37,12 +241,117 @@ func main() {
 	}
 	log.Infof("Using data directory: %s", dataDir)
 
-	// Create storage directories if they don't exist
-	for _, dir := range []string{"disk", "temp", "memory", "mmap"} {
-		if err := os.MkdirAll(filepath.Join(dataDir, dir), 0755); err != nil {
-			log.Fatalf("Failed to create directory: %v", err)
+	// Set up the virtual disk; persistent files live under dataDir/disk
+	vdConfig := virtualdisk.Config{
+		DataPartition: filepath.Join(dataDir, "disk"),
+		BufferSize:    64 * 1024 * 1024,
+		EnableTemp:    true,
+		EnableMemory:  true,
+		CacheSize:     128 * 1024 * 1024,
+		TempTTL:       time.Hour,
+		EnableJournal: true,
+	}
+	if os.Getenv("TRASH") != "false" {
+		vdConfig.EnableTrash = true
+		vdConfig.TrashRetention = 7 * 24 * time.Hour
+		if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+			trashRetention, err := time.ParseDuration(retention)
+			if err != nil {
+				log.Fatalf("Invalid TRASH_RETENTION: %v", err)
+			}
+			vdConfig.TrashRetention = trashRetention
+		}
+	}
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		vdConfig.UseS3 = true
+		vdConfig.S3Config = &virtualdisk.S3Config{
+			Endpoint:   os.Getenv("S3_ENDPOINT"),
+			Region:     os.Getenv("S3_REGION"),
+			BucketName: bucket,
+			Prefix:     os.Getenv("S3_PREFIX"),
+		}
+	}
+	if policyFile := os.Getenv("TIERING_POLICIES"); policyFile != "" {
+		data, err := os.ReadFile(policyFile)
+		if err != nil {
+			log.Fatalf("Failed to read tiering policies: %v", err)
+		}
+		vdConfig.TieringPolicies, err = virtualdisk.ParseTieringPolicies(data)
+		if err != nil {
+			log.Fatalf("Failed to load tiering policies: %v", err)
+		}
+	}
+
+	if rulesFile := os.Getenv("COMPRESSION_RULES"); rulesFile != "" {
+		data, err := os.ReadFile(rulesFile)
+		if err != nil {
+			log.Fatalf("Failed to read compression rules: %v", err)
+		}
+		vdConfig.CompressionRules, err = virtualdisk.ParseCompressionRules(data)
+		if err != nil {
+			log.Fatalf("Failed to load compression rules: %v", err)
+		}
+	}
+	if os.Getenv("DEDUP") == "true" {
+		vdConfig.Dedup = true
+		vdConfig.ContentDefinedChunking = os.Getenv("DEDUP_CHUNKING") == "content"
+		if size := os.Getenv("DEDUP_CHUNK_SIZE"); size != "" {
+			chunkSize, err := strconv.Atoi(size)
+			if err != nil {
+				log.Fatalf("Invalid DEDUP_CHUNK_SIZE: %v", err)
+			}
+			vdConfig.ChunkSize = chunkSize
+		}
+	}
+	vdConfig.EncryptionKeyFile = os.Getenv("ENCRYPTION_KEY_FILE")
+	if os.Getenv("CHECKSUMS") == "true" {
+		vdConfig.Checksums = true
+		if interval := os.Getenv("SCRUB_INTERVAL"); interval != "" {
+			scrubInterval, err := time.ParseDuration(interval)
+			if err != nil {
+				log.Fatalf("Invalid SCRUB_INTERVAL: %v", err)
+			}
+			vdConfig.ScrubInterval = scrubInterval
+		}
+	}
+
+	if versions := os.Getenv("VERSIONS"); versions != "" {
+		count, err := strconv.Atoi(versions)
+		if err != nil {
+			log.Fatalf("Invalid VERSIONS: %v", err)
+		}
+		vdConfig.Versions = count
+		if age := os.Getenv("VERSION_MAX_AGE"); age != "" {
+			maxAge, err := time.ParseDuration(age)
+			if err != nil {
+				log.Fatalf("Invalid VERSION_MAX_AGE: %v", err)
+			}
+			vdConfig.VersionMaxAge = maxAge
+		}
+	}
+
+	if quotaFile := os.Getenv("QUOTAS"); quotaFile != "" {
+		data, err := os.ReadFile(quotaFile)
+		if err != nil {
+			log.Fatalf("Failed to read quotas: %v", err)
 		}
+		vdConfig.Quotas, err = virtualdisk.ParseQuotas(data)
+		if err != nil {
+			log.Fatalf("Failed to load quotas: %v", err)
+		}
+	}
+
+	// Local directories can only be mounted over HTTP from under MOUNT_ROOT
+	mountRoot := os.Getenv("MOUNT_ROOT")
+
+	vd, err := virtualdisk.NewVirtualDisk(vdConfig)
+	if err != nil {
+		log.Fatalf("Failed to create virtual disk: %v", err)
 	}
+	vd.Subscribe(events.EventQuotaWarning, func(event events.Event) error {
+		log.Warnf("Storage quota soft limit exceeded: %v", event.Metadata)
+		return nil
+	})
 
 	// Set up router
 	router := gin.Default()
@@ -57,44 +366,31 @@ func main() {
 	api := router.Group("/api")
 	{
 		api.GET("/stats", func(c *gin.Context) {
-			storageType := c.Query("type")
-			if storageType == "" {
-				storageType = "disk"
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
 			}
 
-			storageDir := filepath.Join(dataDir, storageType)
-			var stats StatsInfo
-
-			// Get storage statistics
-			var totalSize, usedSpace int64
-			var fileCount int
-			err := filepath.Walk(storageDir, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.IsDir() {
-					totalSize += info.Size()
-					fileCount++
-				}
-				return nil
-			})
-
+			usage, err := vd.Usage(storageType)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, Response{
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
 					Success: false,
 					Error:   err.Error(),
 				})
 				return
 			}
 
-			usedSpace = totalSize
-			freeSpace := int64(1024 * 1024 * 1024) // 1GB limit for demonstration
-
-			stats = StatsInfo{
-				TotalSize: freeSpace,
-				UsedSpace: usedSpace,
-				FreeSpace: freeSpace - usedSpace,
-				FileCount: fileCount,
+			stats := StatsInfo{
+				TotalSize:   usage.Capacity,
+				UsedSpace:   usage.StoredBytes,
+				LogicalSize: usage.Bytes,
+				SavedSpace:  usage.Bytes - usage.StoredBytes,
+				FreeSpace:   usage.Available,
+				FileCount:   int(usage.Files),
 			}
 
 			c.JSON(http.StatusOK, Response{
@@ -103,34 +399,26 @@ func main() {
 			})
 		})
 
+		api.GET("/quotas", func(c *gin.Context) {
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    vd.Quotas(),
+			})
+		})
+
 		api.GET("/list", func(c *gin.Context) {
-			storageType := c.Query("type")
-			if storageType == "" {
-				storageType = "disk"
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
 			}
 
-			storageDir := filepath.Join(dataDir, storageType)
-			var files []FileInfo
-
-			err := filepath.Walk(storageDir, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.IsDir() {
-					relPath, err := filepath.Rel(storageDir, path)
-					if err != nil {
-						return err
-					}
-					files = append(files, FileInfo{
-						Path: relPath,
-						Size: info.Size(),
-					})
-				}
-				return nil
-			})
-
+			files, err := listStorage(vd, storageType)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, Response{
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
 					Success: false,
 					Error:   err.Error(),
 				})
@@ -143,10 +431,14 @@ func main() {
 			})
 		})
 
-		api.POST("/files", func(c *gin.Context) {
-			storageType := c.Query("type")
-			if storageType == "" {
-				storageType = "disk"
+		api.GET("/files", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
 			}
 
 			filePath := c.Query("path")
@@ -158,7 +450,33 @@ func main() {
 				return
 			}
 
-			file, err := c.FormFile("file")
+			reader, err := vd.Open(virtualPath(storageType, filePath))
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			defer reader.Close()
+
+			// Sniff the content type from the first bytes when the extension is unknown
+			body := bufio.NewReader(reader)
+			contentType := mime.TypeByExtension(filepath.Ext(filePath))
+			if contentType == "" {
+				head, _ := body.Peek(512)
+				contentType = http.DetectContentType(head)
+			}
+
+			c.Header("Content-Type", contentType)
+			c.Status(http.StatusOK)
+			if _, err := io.Copy(c.Writer, body); err != nil {
+				log.Errorf("Failed to stream %s: %v", filePath, err)
+			}
+		})
+
+		api.POST("/files", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
 			if err != nil {
 				c.JSON(http.StatusBadRequest, Response{
 					Success: false,
@@ -167,32 +485,84 @@ func main() {
 				return
 			}
 
-			targetPath := filepath.Join(dataDir, storageType, filePath)
-			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				c.JSON(http.StatusInternalServerError, Response{
+			filePath := c.Query("path")
+			if filePath == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path is required",
+				})
+				return
+			}
+
+			opts, err := parseWriteOptions(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
 					Success: false,
 					Error:   err.Error(),
 				})
 				return
 			}
 
-			if err := c.SaveUploadedFile(file, targetPath); err != nil {
-				c.JSON(http.StatusInternalServerError, Response{
+			// Stream the multipart "file" field straight into the virtual disk
+			form, err := c.Request.MultipartReader()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
 					Success: false,
 					Error:   err.Error(),
 				})
 				return
 			}
 
+			uploaded := false
+			for {
+				part, err := form.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					c.JSON(http.StatusBadRequest, Response{
+						Success: false,
+						Error:   err.Error(),
+					})
+					return
+				}
+				if part.FormName() != "file" {
+					part.Close()
+					continue
+				}
+
+				if err := writeStream(vd, virtualPath(storageType, filePath), part, opts); err != nil {
+					c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+						Success: false,
+						Error:   err.Error(),
+					})
+					return
+				}
+				uploaded = true
+				break
+			}
+
+			if !uploaded {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "file is required",
+				})
+				return
+			}
+
 			c.JSON(http.StatusOK, Response{
 				Success: true,
 			})
 		})
 
 		api.DELETE("/files", func(c *gin.Context) {
-			storageType := c.Query("type")
-			if storageType == "" {
-				storageType = "disk"
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
 			}
 
 			filePath := c.Query("path")
@@ -204,9 +574,9 @@ func main() {
 				return
 			}
 
-			targetPath := filepath.Join(dataDir, storageType, filePath)
-			if err := os.Remove(targetPath); err != nil {
-				c.JSON(http.StatusInternalServerError, Response{
+			opts := virtualdisk.WriteOptions{LockToken: c.Query("lock_token")}
+			if err := vd.DeleteFileWith(virtualPath(storageType, filePath), opts); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
 					Success: false,
 					Error:   err.Error(),
 				})
@@ -218,85 +588,1036 @@ func main() {
 			})
 		})
 
-		api.GET("/explore", func(c *gin.Context) {
-			path := c.Query("path")
-			if path == "" {
-				path = "/"
+		api.POST("/dirs", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
 			}
 
-			// Check if path exists and is a directory
-			info, err := os.Stat(path)
-			if err != nil || !info.IsDir() {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success": false,
-					"error":   "Invalid directory path",
+			dirPath := c.Query("path")
+			if dirPath == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path is required",
 				})
 				return
 			}
 
-			// Read directory contents
-			entries, err := os.ReadDir(path)
+			if err := vd.CreateDirectory(virtualPath(storageType, dirPath)); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.DELETE("/dirs", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"success": false,
-					"error":   "Failed to read directory",
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
 				})
 				return
 			}
 
-			// Convert entries to response format
-			items := make([]gin.H, 0)
-			for _, entry := range entries {
-				info, err := entry.Info()
-				if err != nil {
-					continue
-				}
+			dirPath := c.Query("path")
+			if dirPath == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path is required",
+				})
+				return
+			}
 
-				items = append(items, gin.H{
-					"name":      entry.Name(),
-					"path":      filepath.Join(path, entry.Name()),
-					"isDir":     entry.IsDir(),
-					"size":      info.Size(),
-					"modified":  info.ModTime(),
-					"isHidden":  strings.HasPrefix(entry.Name(), "."),
+			err = vd.RemoveDirectory(virtualPath(storageType, dirPath), c.Query("recursive") == "true")
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
 				})
+				return
 			}
 
-			c.JSON(http.StatusOK, gin.H{
-				"success": true,
-				"data": gin.H{
-					"path":     path,
-					"items":    items,
-					"parent":   filepath.Dir(path),
-				},
+			c.JSON(http.StatusOK, Response{
+				Success: true,
 			})
 		})
 
-		api.POST("/mount", func(c *gin.Context) {
-			path := c.Query("path")
-			if path == "" {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success": false,
-					"error":   "Path is required",
+		api.GET("/stat", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
 				})
 				return
 			}
 
-			// Verify directory exists
-			info, err := os.Stat(path)
-			if err != nil || !info.IsDir() {
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success": false,
-					"error":   "Invalid directory path",
+			stat, err := vd.Stat(virtualPath(storageType, c.Query("path")))
+			if err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
 				})
 				return
 			}
 
-			// Create virtual disk for this path if it doesn't exist
-			// Note: This is a placeholder - implement actual mounting logic based on your needs
-			c.JSON(http.StatusOK, gin.H{
-				"success": true,
-				"message": "Directory " + path + " mounted successfully",
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    stat,
+			})
+		})
+
+		api.GET("/attrs", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			attrs, err := vd.ListAttrs(virtualPath(storageType, c.Query("path")))
+			if err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    attrs,
+			})
+		})
+
+		api.POST("/expiry", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			opts, err := parseWriteOptions(c)
+			if err == nil && opts.ExpiresAt.IsZero() && opts.TTL == 0 {
+				err = fmt.Errorf("ttl or expires_at is required")
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			expiresAt := opts.ExpiresAt
+			if expiresAt.IsZero() {
+				expiresAt = time.Now().Add(opts.TTL)
+			}
+
+			if err := vd.SetExpiry(virtualPath(storageType, c.Query("path")), expiresAt); err != nil {
+				c.JSON(errorStatus(err, http.StatusBadRequest), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    gin.H{"expires_at": expiresAt},
+			})
+		})
+
+		api.DELETE("/expiry", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			if err := vd.SetExpiry(virtualPath(storageType, c.Query("path")), time.Time{}); err != nil {
+				c.JSON(errorStatus(err, http.StatusBadRequest), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.GET("/locks", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			path := strings.TrimSuffix(virtualdisk.PathPrefix(storageType), "/")
+			if c.Query("path") != "" {
+				path = virtualPath(storageType, c.Query("path"))
+			}
+			leases := make([]virtualdisk.Lease, 0)
+			for _, lease := range vd.Leases(path) {
+				if vd.StorageType(lease.Path) != storageType {
+					continue
+				}
+				lease.Token = "" // Only the holder gets to know it
+				leases = append(leases, relativeLease(vd, lease))
+			}
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    leases,
+			})
+		})
+
+		api.POST("/locks", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			filePath := c.Query("path")
+			if filePath == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path is required",
+				})
+				return
+			}
+
+			mode := virtualdisk.LockMode(c.DefaultQuery("mode", string(virtualdisk.LockExclusive)))
+			ttl, err := time.ParseDuration(c.DefaultQuery("ttl", "30s"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   fmt.Sprintf("invalid ttl: %s", c.Query("ttl")),
+				})
+				return
+			}
+
+			lease, err := vd.Lock(virtualPath(storageType, filePath), mode, ttl)
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusBadRequest), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    relativeLease(vd, lease),
+			})
+		})
+
+		api.POST("/locks/renew", func(c *gin.Context) {
+			ttl, err := time.ParseDuration(c.DefaultQuery("ttl", "30s"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   fmt.Sprintf("invalid ttl: %s", c.Query("ttl")),
+				})
+				return
+			}
+
+			lease, err := vd.RenewLock(c.Query("token"), ttl)
+			if err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, virtualdisk.ErrLeaseNotFound) {
+					status = http.StatusNotFound
+				}
+				c.JSON(status, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    relativeLease(vd, lease),
+			})
+		})
+
+		api.DELETE("/locks", func(c *gin.Context) {
+			if err := vd.Unlock(c.Query("token")); err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.POST("/attrs", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			err = vd.SetAttr(virtualPath(storageType, c.Query("path")), c.Query("name"), c.Query("value"))
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusBadRequest), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.DELETE("/attrs", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			err = vd.RemoveAttr(virtualPath(storageType, c.Query("path")), c.Query("name"))
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.POST("/rename", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			// The destination stays in the same storage unless new_type says otherwise
+			newStorageType := storageType
+			if c.Query("new_type") != "" {
+				newStorageType, err = parseStorageTypeParam(c, "new_type")
+				if err != nil {
+					c.JSON(http.StatusBadRequest, Response{
+						Success: false,
+						Error:   err.Error(),
+					})
+					return
+				}
+			}
+
+			oldPath := c.Query("path")
+			newPath := c.Query("new_path")
+			if oldPath == "" || newPath == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path and new_path are required",
+				})
+				return
+			}
+
+			opts := virtualdisk.WriteOptions{LockToken: c.Query("lock_token")}
+			err = vd.RenameWith(virtualPath(storageType, oldPath), virtualPath(newStorageType, newPath), opts)
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.POST("/copy", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			// The copy stays in the same storage unless new_type says otherwise
+			newStorageType := storageType
+			if c.Query("new_type") != "" {
+				newStorageType, err = parseStorageTypeParam(c, "new_type")
+				if err != nil {
+					c.JSON(http.StatusBadRequest, Response{
+						Success: false,
+						Error:   err.Error(),
+					})
+					return
+				}
+			}
+
+			srcPath := c.Query("path")
+			dstPath := c.Query("new_path")
+			if srcPath == "" || dstPath == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path and new_path are required",
+				})
+				return
+			}
+
+			src := virtualPath(storageType, srcPath)
+			dst := virtualPath(newStorageType, dstPath)
+			opts := virtualdisk.WriteOptions{LockToken: c.Query("lock_token")}
+			if c.Query("recursive") == "true" {
+				err = vd.CopyDirWith(src, dst, opts)
+			} else {
+				err = vd.CopyWith(src, dst, opts)
+			}
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.POST("/batch", func(c *gin.Context) {
+			var req BatchRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   fmt.Sprintf("invalid batch: %v", err),
+				})
+				return
+			}
+
+			// Stage every operation, then apply them all or none
+			tx := vd.Begin()
+			for i, op := range req.Ops {
+				err := func() error {
+					storageType, err := parseStorageTypeName(op.Type)
+					if err != nil {
+						return err
+					}
+					if op.Path == "" {
+						return fmt.Errorf("path is required")
+					}
+					path := virtualPath(storageType, op.Path)
+					if op.LockToken != "" {
+						if err := tx.UseLease(op.LockToken); err != nil {
+							return err
+						}
+					}
+
+					switch op.Op {
+					case "write":
+						return tx.WriteFile(path, op.Data)
+					case "delete":
+						return tx.DeleteFile(path)
+					case "rename":
+						newStorageType := storageType
+						if op.NewType != "" {
+							if newStorageType, err = parseStorageTypeName(op.NewType); err != nil {
+								return err
+							}
+						}
+						if op.NewPath == "" {
+							return fmt.Errorf("new_path is required")
+						}
+						return tx.Rename(path, virtualPath(newStorageType, op.NewPath))
+					default:
+						return fmt.Errorf("unknown operation: %s", op.Op)
+					}
+				}()
+				if err != nil {
+					tx.Rollback()
+					c.JSON(http.StatusBadRequest, Response{
+						Success: false,
+						Error:   fmt.Sprintf("operation %d: %v", i, err),
+					})
+					return
+				}
+			}
+
+			if err := tx.Commit(); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.GET("/explore", func(c *gin.Context) {
+			path := c.Query("path")
+			if path == "" {
+				path = "/"
+			}
+
+			// Check if path exists and is a directory
+			info, err := os.Stat(path)
+			if err != nil || !info.IsDir() {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"success": false,
+					"error":   "Invalid directory path",
+				})
+				return
+			}
+
+			// Read directory contents
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"success": false,
+					"error":   "Failed to read directory",
+				})
+				return
+			}
+
+			// Convert entries to response format
+			items := make([]gin.H, 0)
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil {
+					continue
+				}
+
+				items = append(items, gin.H{
+					"name":     entry.Name(),
+					"path":     filepath.Join(path, entry.Name()),
+					"isDir":    entry.IsDir(),
+					"size":     info.Size(),
+					"modified": info.ModTime(),
+					"isHidden": strings.HasPrefix(entry.Name(), "."),
+				})
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"success": true,
+				"data": gin.H{
+					"path":   path,
+					"items":  items,
+					"parent": filepath.Dir(path),
+				},
+			})
+		})
+
+		api.POST("/mount", func(c *gin.Context) {
+			spec := virtualdisk.MountSpec{
+				Type:     c.DefaultQuery("type", virtualdisk.MountLocal),
+				Path:     c.Query("path"),
+				Bucket:   c.Query("bucket"),
+				Prefix:   c.Query("key_prefix"),
+				Endpoint: c.Query("endpoint"),
+				Region:   c.Query("region"),
+			}
+			if spec.Type == virtualdisk.MountLocal && spec.Path == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path is required",
+				})
+				return
+			}
+
+			// Mount local directories under their own name unless told otherwise
+			prefix := c.Query("prefix")
+			if prefix == "" && spec.Type == virtualdisk.MountLocal {
+				prefix = filepath.Base(filepath.Clean(spec.Path))
+			}
+			if spec.Type == virtualdisk.MountLocal {
+				source, err := mountSource(mountRoot, spec.Path)
+				if err != nil {
+					c.JSON(errorStatus(err, http.StatusBadRequest), Response{
+						Success: false,
+						Error:   err.Error(),
+					})
+					return
+				}
+				spec.Path = source
+			}
+			if prefix == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "prefix is required",
+				})
+				return
+			}
+
+			if err := vd.Mount(prefix, spec); err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    vd.Mounts(),
+			})
+		})
+
+		api.GET("/tier", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			tier, err := vd.Tier(virtualPath(storageType, c.Query("path")))
+			if err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    tier,
+			})
+		})
+
+		api.POST("/tier", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			tier := virtualdisk.Tier(c.Query("tier"))
+			if err := vd.MoveToTier(virtualPath(storageType, c.Query("path")), tier); err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    tier,
+			})
+		})
+
+		api.GET("/dedup", func(c *gin.Context) {
+			stats, err := vd.DedupStats()
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    stats,
+			})
+		})
+
+		api.POST("/dedup/collect", func(c *gin.Context) {
+			removed, freed, err := vd.CollectChunks()
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data: gin.H{
+					"removed_chunks": removed,
+					"freed_bytes":    freed,
+				},
+			})
+		})
+
+		api.POST("/keys/rotate", func(c *gin.Context) {
+			rewritten, err := vd.RotateKeys()
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    gin.H{"rewritten": rewritten},
+			})
+		})
+
+		api.POST("/scrub", func(c *gin.Context) {
+			report, err := vd.Scrub()
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    report,
+			})
+		})
+
+		api.GET("/trash", func(c *gin.Context) {
+			entries, err := vd.ListTrash()
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    entries,
+			})
+		})
+
+		api.POST("/trash/restore", func(c *gin.Context) {
+			opts := virtualdisk.WriteOptions{LockToken: c.Query("lock_token")}
+			if err := vd.RestoreWith(c.Query("id"), opts); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.DELETE("/trash", func(c *gin.Context) {
+			if err := vd.Purge(c.Query("id")); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.POST("/trash/empty", func(c *gin.Context) {
+			purged, err := vd.EmptyTrash()
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    gin.H{"purged": purged},
+			})
+		})
+
+		api.GET("/versions", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			filePath := c.Query("path")
+			if filePath == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "path is required",
+				})
+				return
+			}
+
+			versions, err := vd.ListVersions(virtualPath(storageType, filePath))
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    versions,
+			})
+		})
+
+		api.GET("/versions/file", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			filePath := c.Query("path")
+			data, err := vd.ReadVersion(virtualPath(storageType, filePath), c.Query("id"))
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			contentType := mime.TypeByExtension(filepath.Ext(filePath))
+			if contentType == "" {
+				contentType = http.DetectContentType(data)
+			}
+			c.Data(http.StatusOK, contentType, data)
+		})
+
+		api.POST("/versions/restore", func(c *gin.Context) {
+			storageType, err := parseStorageType(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			opts := virtualdisk.WriteOptions{LockToken: c.Query("lock_token")}
+			if err := vd.RestoreVersionWith(virtualPath(storageType, c.Query("path")), c.Query("id"), opts); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.GET("/snapshots", func(c *gin.Context) {
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    vd.ListSnapshots(),
+			})
+		})
+
+		api.POST("/snapshots", func(c *gin.Context) {
+			name := c.Query("name")
+			if name == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "name is required",
+				})
+				return
+			}
+
+			info, err := vd.Snapshot(name)
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    info,
+			})
+		})
+
+		api.DELETE("/snapshots", func(c *gin.Context) {
+			if err := vd.DeleteSnapshot(c.Query("name")); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.POST("/snapshots/restore", func(c *gin.Context) {
+			if err := vd.RestoreSnapshot(c.Query("name")); err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+			})
+		})
+
+		api.GET("/snapshots/list", func(c *gin.Context) {
+			fsys, err := vd.OpenSnapshot(c.Query("name"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			files, err := listSnapshot(fsys)
+			if err != nil {
+				c.JSON(errorStatus(err, http.StatusInternalServerError), Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    files,
+			})
+		})
+
+		api.GET("/snapshots/files", func(c *gin.Context) {
+			fsys, err := vd.OpenSnapshot(c.Query("name"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			filePath := c.Query("path")
+			file, err := fsys.Open(filePath)
+			if err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+			defer file.Close()
+
+			contentType := mime.TypeByExtension(filepath.Ext(filePath))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			c.Header("Content-Type", contentType)
+			c.Status(http.StatusOK)
+			if _, err := io.Copy(c.Writer, file); err != nil {
+				log.Errorf("Failed to stream %s from snapshot: %v", filePath, err)
+			}
+		})
+
+		api.GET("/mounts", func(c *gin.Context) {
+			c.JSON(http.StatusOK, Response{
+				Success: true,
+				Data:    vd.Mounts(),
+			})
+		})
+
+		api.DELETE("/mounts", func(c *gin.Context) {
+			prefix := c.Query("prefix")
+			if prefix == "" {
+				c.JSON(http.StatusBadRequest, Response{
+					Success: false,
+					Error:   "prefix is required",
+				})
+				return
+			}
+
+			if err := vd.Unmount(prefix); err != nil {
+				c.JSON(http.StatusNotFound, Response{
+					Success: false,
+					Error:   err.Error(),
+				})
+				return
+			}
+
+			c.JSON(http.StatusOK, Response{
+				Success: true,
 			})
 		})
 	}
@@ -315,8 +1636,31 @@ func main() {
 		port = "3002"
 	}
 
-	log.Infof("Starting server on port %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: router,
+	}
+
+	// Shut down gracefully so buffered writes are flushed by vd.Close
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Infof("Starting server on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("Failed to shut down server: %v", err)
+	}
+	if err := vd.Close(); err != nil {
+		log.Errorf("Failed to close virtual disk: %v", err)
 	}
 }
@@ -0,0 +1,92 @@
+package blockstore
+
+import "math/bits"
+
+// Chunker splits file content into chunks
+type Chunker interface {
+	// MaxSize is the largest chunk Cut returns
+	MaxSize() int
+	// Cut returns the length of the first chunk of data. data holds at least
+	// MaxSize bytes unless it is the end of the file.
+	Cut(data []byte) int
+}
+
+// fixedChunker cuts chunks of the same size
+type fixedChunker struct {
+	size int
+}
+
+// NewFixedChunker returns a chunker that cuts chunks of size bytes
+func NewFixedChunker(size int) Chunker {
+	return &fixedChunker{size: size}
+}
+
+func (c *fixedChunker) MaxSize() int {
+	return c.size
+}
+
+func (c *fixedChunker) Cut(data []byte) int {
+	if len(data) < c.size {
+		return len(data)
+	}
+	return c.size
+}
+
+// cdcChunker cuts chunks where a rolling gear hash of the content matches a
+// mask, so an insertion only changes the chunks around it. Chunks are between
+// a quarter of and four times the average size.
+type cdcChunker struct {
+	min, max int
+	mask     uint64
+}
+
+// NewContentDefinedChunker returns a chunker that cuts chunks of avgSize
+// bytes on average at content-defined boundaries
+func NewContentDefinedChunker(avgSize int) Chunker {
+	// The mask has as many bits as needed for a boundary every avgSize bytes
+	maskBits := bits.Len(uint(avgSize)) - 1
+	return &cdcChunker{
+		min:  avgSize / 4,
+		max:  avgSize * 4,
+		mask: (1<<maskBits - 1) << (64 - maskBits),
+	}
+}
+
+func (c *cdcChunker) MaxSize() int {
+	return c.max
+}
+
+func (c *cdcChunker) Cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+	end := len(data)
+	if end > c.max {
+		end = c.max
+	}
+
+	var hash uint64
+	for i := c.min; i < end; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// gear maps each byte to a random value for the rolling hash. It is generated
+// from a fixed seed, since changing it would move every chunk boundary.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
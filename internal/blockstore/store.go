@@ -0,0 +1,238 @@
+package blockstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrCorrupt is returned for chunks whose content no longer matches their hash
+var ErrCorrupt = errors.New("corrupt chunk")
+
+// Store keeps chunks on disk once each, named by the hex SHA-256 of their
+// content, and counts the references to them. Reference counts live in
+// memory; the owner rebuilds them with Collect when it opens the store.
+type Store struct {
+	dir  string
+	refs map[string]int
+	mu   sync.Mutex
+}
+
+// Stats describes the chunks in a store
+type Stats struct {
+	Chunks int   `json:"chunks"`
+	Bytes  int64 `json:"bytes"` // stored size of all chunks
+	Refs   int   `json:"refs"`  // references from files to chunks
+}
+
+// Open opens or creates a chunk store in dir
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	return &Store{
+		dir:  dir,
+		refs: make(map[string]int),
+	}, nil
+}
+
+// Hash returns the name of the chunk holding data
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// chunkPath spreads chunks over subdirectories named after their first byte
+func (s *Store) chunkPath(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Put stores data unless an identical chunk exists, takes a reference to it
+// and returns its hash
+func (s *Store) Put(data []byte) (string, error) {
+	hash := Hash(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Corrupt chunks are removed when read, so a chunk may be missing even
+	// while files reference it; writing the same data again restores it
+	if _, err := os.Stat(s.chunkPath(hash)); err != nil {
+		if err := s.write(hash, data); err != nil {
+			return "", err
+		}
+	}
+	s.refs[hash]++
+	return hash, nil
+}
+
+// write stores a chunk through a staging file, so a chunk is either
+// complete or missing. s.mu must be held.
+func (s *Store) write(hash string, data []byte) error {
+	path := s.chunkPath(hash)
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create chunk directory: %w", err)
+		}
+		if err := syncDir(s.dir); err != nil {
+			return fmt.Errorf("failed to create chunk directory: %w", err)
+		}
+	}
+
+	staging, err := os.CreateTemp(filepath.Dir(path), "."+hash+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create chunk: %w", err)
+	}
+	_, err = staging.Write(data)
+	if err == nil {
+		err = staging.Sync()
+	}
+	if closeErr := staging.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(staging.Name(), path)
+	}
+	if err != nil {
+		os.Remove(staging.Name())
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	// Sync the directory so the chunk survives a crash along with the
+	// manifests that reference it
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	return nil
+}
+
+// Get reads a chunk and verifies it against its hash. Corrupt chunks are
+// removed so the next Put of the same data stores them again.
+func (s *Store) Get(hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("invalid chunk hash: %q", hash)
+	}
+	data, err := os.ReadFile(s.chunkPath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk: %w", err)
+	}
+	if Hash(data) != hash {
+		s.mu.Lock()
+		os.Remove(s.chunkPath(hash))
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrCorrupt, hash)
+	}
+	return data, nil
+}
+
+// Ref takes another reference to an existing chunk
+func (s *Store) Ref(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs[hash] == 0 {
+		if _, err := os.Stat(s.chunkPath(hash)); err != nil {
+			return fmt.Errorf("failed to reference chunk: %w", err)
+		}
+	}
+	s.refs[hash]++
+	return nil
+}
+
+// Release drops a reference to a chunk and deletes the chunk once nothing
+// references it
+func (s *Store) Release(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs[hash] > 1 {
+		s.refs[hash]--
+		return nil
+	}
+	delete(s.refs, hash)
+	if err := os.Remove(s.chunkPath(hash)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete chunk: %w", err)
+	}
+	return nil
+}
+
+// Collect replaces the reference counts with refs, counted from every file
+// that uses the store, and deletes the chunks nothing references, such as
+// those left behind by a crash. It returns the number and size of the
+// deleted chunks.
+func (s *Store) Collect(refs map[string]int) (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refs = refs
+
+	var removed int
+	var freed int64
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if refs[d.Name()] > 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, fmt.Errorf("failed to collect chunks: %w", err)
+	}
+	return removed, freed, nil
+}
+
+// Stats returns the number and size of the stored chunks
+func (s *Store) Stats() (Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats Stats
+	for _, n := range s.refs {
+		stats.Refs += n
+	}
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stats.Chunks++
+		stats.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to read chunk stats: %w", err)
+	}
+	return stats, nil
+}
+
+// syncDir syncs a directory, so that files created or renamed in it survive
+// a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"container/list"
+	"strings"
 	"sync"
 	"time"
 )
@@ -82,9 +83,8 @@ func (c *Cache) Put(key string, value []byte, size int64) {
 		c.size += size
 	}
 
-	// Evict items if cache is full
-	for c.size > c.capacity {
-		c.evictOldest()
+	// Evict items if cache is full, as far as unreferenced ones allow
+	for c.size > c.capacity && c.evictOldest() {
 	}
 }
 
@@ -102,19 +102,47 @@ func (c *Cache) Release(key string) {
 	}
 }
 
-// evictOldest removes the least recently used item from the cache
-func (c *Cache) evictOldest() {
+// Remove drops an item from the cache without notifying the eviction callback
+func (c *Cache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.items[key]; exists {
+		entry := element.Value.(*Entry)
+		c.lru.Remove(element)
+		delete(c.items, key)
+		c.size -= entry.Size
+	}
+}
+
+// RemovePrefix drops all items whose key starts with prefix
+func (c *Cache) RemovePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			entry := element.Value.(*Entry)
+			c.lru.Remove(element)
+			delete(c.items, key)
+			c.size -= entry.Size
+		}
+	}
+}
+
+// evictOldest removes the least recently used item that is not referenced
+// from the cache and reports whether there was one
+func (c *Cache) evictOldest() bool {
 	element := c.lru.Back()
+	// Skip items that are still referenced
+	for element != nil && element.Value.(*Entry).Reference > 0 {
+		element = element.Prev()
+	}
 	if element == nil {
-		return
+		return false
 	}
 
 	entry := element.Value.(*Entry)
-	if entry.Reference > 0 {
-		// Skip items that are still referenced
-		return
-	}
-
 	c.lru.Remove(element)
 	delete(c.items, entry.Key)
 	c.size -= entry.Size
@@ -122,6 +150,7 @@ func (c *Cache) evictOldest() {
 	if c.evictNotify != nil {
 		c.evictNotify(entry.Key, entry.Value)
 	}
+	return true
 }
 
 // Clear removes all items from the cache
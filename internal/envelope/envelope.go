@@ -0,0 +1,273 @@
+// Package envelope encrypts files with AES-GCM using envelope keys: every
+// file has its own random data key, stored in the file header wrapped by a
+// master key from a Keyring. Content is sealed in fixed-size segments so it
+// can be encrypted and decrypted as a stream; each segment nonce carries its
+// index and whether it is the last one, so reordered, dropped or truncated
+// segments fail to decrypt.
+package envelope
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic starts every encrypted file
+const Magic = "VDE\x01"
+
+// SegmentSize is the amount of plaintext sealed in each segment
+const SegmentSize = 64 * 1024
+
+const (
+	tagSize    = 16
+	prefixSize = 7 // random part of the segment nonces
+)
+
+// Header is the start of an encrypted file
+type Header struct {
+	KeyID   string // master key wrapping the data key
+	wrapped []byte
+	prefix  [prefixSize]byte
+}
+
+// Bytes encodes the header:
+// magic | key ID length | key ID | wrapped key length | wrapped key | nonce prefix
+func (h *Header) Bytes() []byte {
+	buf := make([]byte, 0, h.Size())
+	buf = append(buf, Magic...)
+	buf = append(buf, byte(len(h.KeyID)))
+	buf = append(buf, h.KeyID...)
+	buf = append(buf, byte(len(h.wrapped)))
+	buf = append(buf, h.wrapped...)
+	return append(buf, h.prefix[:]...)
+}
+
+// Size returns the encoded size of the header
+func (h *Header) Size() int {
+	return len(Magic) + 1 + len(h.KeyID) + 1 + len(h.wrapped) + prefixSize
+}
+
+// Rewrap returns a header with the same data key wrapped by the current
+// master key. The content after the header stays valid.
+func (h *Header) Rewrap(keys *Keyring) (*Header, error) {
+	dataKey, err := keys.unwrap(h.KeyID, h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	id, wrapped, err := keys.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Header{KeyID: id, wrapped: wrapped, prefix: h.prefix}, nil
+}
+
+// PlainSize returns the size of the plaintext of an encrypted file of storedSize bytes
+func (h *Header) PlainSize(storedSize int64) int64 {
+	body := storedSize - int64(h.Size())
+	segments := (body + SegmentSize + tagSize - 1) / (SegmentSize + tagSize)
+	if segments == 0 {
+		return 0
+	}
+	return body - segments*tagSize
+}
+
+// ReadHeader reads the header of an encrypted file. It returns nil without
+// consuming anything if r does not start with an encrypted file.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	magic, err := r.Peek(len(Magic))
+	if err != nil || string(magic) != Magic {
+		return nil, nil
+	}
+	r.Discard(len(Magic))
+
+	h := &Header{}
+	keyID, err := readField(r)
+	if err != nil {
+		return nil, err
+	}
+	h.KeyID = string(keyID)
+	if h.wrapped, err = readField(r); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, h.prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	return h, nil
+}
+
+// readField reads a byte string prefixed with its length
+func readField(r *bufio.Reader) ([]byte, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	return field, nil
+}
+
+// nonce returns the nonce of a segment
+func nonce(prefix [prefixSize]byte, index uint32, last bool) []byte {
+	n := make([]byte, 0, prefixSize+5)
+	n = append(n, prefix[:]...)
+	n = binary.BigEndian.AppendUint32(n, index)
+	if last {
+		return append(n, 1)
+	}
+	return append(n, 0)
+}
+
+// Writer encrypts a stream. Close must be called to seal the last segment.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix [prefixSize]byte
+	index  uint32
+	buf    []byte
+	closed bool
+}
+
+// NewWriter writes the header of a new encrypted file to w, with a fresh
+// data key wrapped by the current master key
+func NewWriter(w io.Writer, keys *Keyring) (*Writer, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{}
+	if h.KeyID, h.wrapped, err = keys.wrap(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(h.prefix[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if _, err := w.Write(h.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		prefix: h.prefix,
+		buf:    make([]byte, 0, SegmentSize+tagSize),
+	}, nil
+}
+
+// Write encrypts p. A segment is only sealed once more data follows it,
+// since the last segment is sealed differently.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed envelope writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == SegmentSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):SegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// seal encrypts and writes the buffered segment
+func (w *Writer) seal(last bool) error {
+	sealed := w.aead.Seal(w.buf[:0], nonce(w.prefix, w.index, last), w.buf, nil)
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close seals the last segment. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+// Reader decrypts a stream
+type Reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  [prefixSize]byte
+	index   uint32
+	segment []byte // decrypted data not read yet
+	buf     []byte
+	done    bool
+}
+
+// NewReader decrypts the content following a header read with ReadHeader
+func NewReader(r *bufio.Reader, h *Header, keys *Keyring) (*Reader, error) {
+	dataKey, err := keys.unwrap(h.KeyID, h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:      r,
+		aead:   aead,
+		prefix: h.prefix,
+		buf:    make([]byte, SegmentSize+tagSize),
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.segment) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.segment)
+	r.segment = r.segment[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next segment
+func (r *Reader) open() error {
+	n, err := io.ReadFull(r.r, r.buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		r.done = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last one if nothing follows it
+		if _, err := r.r.Peek(1); err == io.EOF {
+			r.done = true
+		}
+	}
+
+	segment, err := r.aead.Open(r.buf[:0], nonce(r.prefix, r.index, r.done), r.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt segment %d: %w", r.index, err)
+	}
+	r.index++
+	r.segment = segment
+	return nil
+}
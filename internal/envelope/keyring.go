@@ -0,0 +1,132 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ErrUnknownKey is returned for data keys wrapped by a master key that is
+// not in the keyring
+var ErrUnknownKey = errors.New("unknown master key")
+
+// Keyring holds the master keys that wrap data keys. New data keys are
+// wrapped with the current key; older keys stay available to unwrap data
+// keys that have not been rewrapped yet.
+type Keyring struct {
+	path    string
+	current string
+	keys    map[string]cipher.AEAD
+	mu      sync.RWMutex
+}
+
+// keyFile is the format of a key file: base64-encoded 256-bit keys by ID,
+// and the ID of the key that wraps new data keys
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads master keys from a key file
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload rereads the key file, for example after a new current key was added
+func (k *Keyring) Reload() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse key file: %w", err)
+	}
+
+	keys := make(map[string]cipher.AEAD, len(file.Keys))
+	for id, encoded := range file.Keys {
+		if len(id) == 0 || len(id) > 255 {
+			return fmt.Errorf("invalid key ID: %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("failed to decode key %q: %w", id, err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("key %q must be 32 bytes, not %d", id, len(key))
+		}
+		if keys[id], err = newAEAD(key); err != nil {
+			return err
+		}
+	}
+	if _, ok := keys[file.Current]; !ok {
+		return fmt.Errorf("current key %q is not in the key file", file.Current)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.current = file.Current
+	k.keys = keys
+	return nil
+}
+
+// Current returns the ID of the key that wraps new data keys
+func (k *Keyring) Current() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current
+}
+
+// wrap encrypts a data key with the current master key
+func (k *Keyring) wrap(dataKey []byte) (string, []byte, error) {
+	k.mu.RLock()
+	id, aead := k.current, k.keys[k.current]
+	k.mu.RUnlock()
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return id, aead.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+// unwrap decrypts a data key wrapped by the master key with the given ID
+func (k *Keyring) unwrap(id string, wrapped []byte) ([]byte, error) {
+	k.mu.RLock()
+	aead, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped data key")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// newAEAD returns AES-GCM with a 256-bit key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -9,10 +9,15 @@ import (
 type EventType string
 
 const (
-	EventFileCreated  EventType = "file_created"
-	EventFileModified EventType = "file_modified"
-	EventFileDeleted  EventType = "file_deleted"
-	EventFileAccessed EventType = "file_accessed"
+	EventFileCreated   EventType = "file_created"
+	EventFileModified  EventType = "file_modified"
+	EventFileDeleted   EventType = "file_deleted"
+	EventFileAccessed  EventType = "file_accessed"
+	EventFileTiered    EventType = "file_tiered"
+	EventFileRenamed   EventType = "file_renamed"
+	EventFileCorrupted EventType = "file_corrupted"
+	EventFileExpired   EventType = "file_expired"
+	EventQuotaWarning  EventType = "quota_warning"
 )
 
 // Event represents a file system event
@@ -50,13 +55,15 @@ func (eb *EventBus) Subscribe(eventType EventType, handler Handler) {
 	eb.subscribers[eventType] = append(eb.subscribers[eventType], handler)
 }
 
-// Publish sends an event to all subscribers
+// Publish sends an event to all subscribers. Handlers may publish events of
+// their own.
 func (eb *EventBus) Publish(event Event) []error {
 	eb.mu.RLock()
-	defer eb.mu.RUnlock()
+	handlers := eb.subscribers[event.Type]
+	eb.mu.RUnlock()
 
 	var errors []error
-	for _, handler := range eb.subscribers[event.Type] {
+	for _, handler := range handlers {
 		if err := handler(event); err != nil {
 			errors = append(errors, err)
 		}
@@ -0,0 +1,214 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Op identifies the operation recorded in the journal
+type Op byte
+
+const (
+	OpWrite      Op = 1 // Path was written with Data
+	OpDelete     Op = 2 // Path was deleted
+	OpMkdir      Op = 3 // Path was created as a directory
+	OpCheckpoint Op = 4 // Earlier records for Path are already reflected in storage
+	OpRmdir      Op = 5 // Path was removed as an empty directory
+	OpCommit     Op = 6 // The records before it since the last commit belong together
+	OpPurge      Op = 7 // Path was deleted without keeping a copy in the trash
+)
+
+// headerSize is the size of the crc32 and length prefix of each record
+const headerSize = 8
+
+// MaxPathLen is the longest path a record can hold
+const MaxPathLen = math.MaxUint16
+
+// ErrPathTooLong is returned when a record's path is longer than MaxPathLen
+var ErrPathTooLong = errors.New("path too long for the journal")
+
+// Record is a single journal entry
+type Record struct {
+	Op   Op
+	Path string
+	Data []byte
+}
+
+// Journal is an append-only, checksummed write-ahead log
+type Journal struct {
+	file *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+// Open opens or creates the journal file at path
+func Open(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat journal: %w", err)
+	}
+
+	// Make sure a newly created journal is still there after a crash
+	if fi.Size() == 0 {
+		dir, err := os.Open(filepath.Dir(path))
+		if err == nil {
+			err = dir.Sync()
+			dir.Close()
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to sync journal directory: %w", err)
+		}
+	}
+
+	return &Journal{
+		file: file,
+		size: fi.Size(),
+	}, nil
+}
+
+// Append writes records to the end of the journal and syncs them to disk
+func (j *Journal) Append(records ...Record) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var buf []byte
+	for _, rec := range records {
+		if len(rec.Path) > MaxPathLen {
+			return fmt.Errorf("failed to append to journal: %w", ErrPathTooLong)
+		}
+		buf = appendRecord(buf, rec)
+	}
+
+	if _, err := j.file.WriteAt(buf, j.size); err != nil {
+		return fmt.Errorf("failed to append to journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.size += int64(len(buf))
+	return nil
+}
+
+// Replay calls fn for every intact record in order. A torn or corrupt record
+// marks the end of the journal; it and anything after it is discarded.
+func (j *Journal) Replay(fn func(Record) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	reader := bufio.NewReader(io.NewSectionReader(j.file, 0, j.size))
+	var offset int64
+	for {
+		rec, n, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Drop the torn tail so new records follow the last good one
+			if err := j.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate journal: %w", err)
+			}
+			j.size = offset
+			break
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// Truncate discards all records once they are reflected in storage
+func (j *Journal) Truncate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.size == 0 {
+		return nil
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.size = 0
+	return nil
+}
+
+// Size returns the current size of the journal in bytes
+func (j *Journal) Size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.size
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+// appendRecord encodes rec as crc32 | length | op | path length | path | data
+func appendRecord(buf []byte, rec Record) []byte {
+	body := make([]byte, 0, 3+len(rec.Path)+len(rec.Data))
+	body = append(body, byte(rec.Op))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(rec.Path)))
+	body = append(body, rec.Path...)
+	body = append(body, rec.Data...)
+
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(body))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	return append(buf, body...)
+}
+
+// readRecord decodes the next record and returns its encoded size
+func readRecord(r io.Reader) (Record, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return Record{}, 0, io.EOF
+		}
+		return Record{}, 0, fmt.Errorf("torn journal header: %w", err)
+	}
+
+	sum := binary.BigEndian.Uint32(header[0:4])
+	length := binary.BigEndian.Uint32(header[4:8])
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Record{}, 0, fmt.Errorf("torn journal record: %w", err)
+	}
+	if crc32.ChecksumIEEE(body) != sum || len(body) < 3 {
+		return Record{}, 0, errors.New("corrupt journal record")
+	}
+
+	pathLen := int(binary.BigEndian.Uint16(body[1:3]))
+	if 3+pathLen > len(body) {
+		return Record{}, 0, errors.New("corrupt journal record")
+	}
+
+	return Record{
+		Op:   Op(body[0]),
+		Path: string(body[3 : 3+pathLen]),
+		Data: body[3+pathLen:],
+	}, int64(headerSize + len(body)), nil
+}
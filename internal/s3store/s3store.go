@@ -3,15 +3,38 @@ package s3store
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// ObjectInfo describes an S3 object relative to the store prefix
+type ObjectInfo struct {
+	Path     string
+	Size     int64
+	Modified time.Time
+	Metadata map[string]string // user-defined metadata; only filled in by Stat
+}
+
+// ObjectVersion describes a version of an S3 object
+type ObjectVersion struct {
+	Path         string
+	VersionID    string
+	Size         int64
+	Modified     time.Time
+	IsLatest     bool
+	DeleteMarker bool // the object was deleted at this version
+}
+
 // S3Store represents an S3-compatible storage backend
 type S3Store struct {
 	client     *s3.Client
@@ -67,13 +90,64 @@ func (s *S3Store) ReadFile(path string) ([]byte, error) {
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from S3: %w", err)
+		return nil, fmt.Errorf("failed to read from S3: %w", notFound(path, err))
 	}
 	defer output.Body.Close()
 
 	return io.ReadAll(output.Body)
 }
 
+// WriteStream uploads size bytes read from r to an S3 object without buffering them in memory
+func (s *S3Store) WriteStream(path string, r io.Reader, size int64) error {
+	key := s.getObjectKey(path)
+	_, err := s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucketName),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write to S3: %w", err)
+	}
+	return nil
+}
+
+// ReadStream opens an S3 object for streaming; the caller must close the returned reader
+func (s *S3Store) ReadStream(path string) (io.ReadCloser, error) {
+	key := s.getObjectKey(path)
+	output, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from S3: %w", notFound(path, err))
+	}
+	return output.Body, nil
+}
+
+// Bucket returns the name of the bucket the store uses
+func (s *S3Store) Bucket() string {
+	return s.bucketName
+}
+
+// CopyTo copies an object to path in dst without downloading it. Both
+// stores must use the same bucket.
+func (s *S3Store) CopyTo(srcPath string, dst *S3Store, dstPath string) error {
+	if s.bucketName != dst.bucketName {
+		return fmt.Errorf("cannot copy between buckets %s and %s", s.bucketName, dst.bucketName)
+	}
+	source := (&url.URL{Path: s.bucketName + "/" + s.getObjectKey(srcPath)}).EscapedPath()
+	_, err := s.client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     aws.String(dst.bucketName),
+		Key:        aws.String(dst.getObjectKey(dstPath)),
+		CopySource: aws.String(source),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy S3 object: %w", notFound(srcPath, err))
+	}
+	return nil
+}
+
 // DeleteFile deletes an S3 object
 func (s *S3Store) DeleteFile(path string) error {
 	key := s.getObjectKey(path)
@@ -87,6 +161,191 @@ func (s *S3Store) DeleteFile(path string) error {
 	return nil
 }
 
+// Stat returns information about a single S3 object
+func (s *S3Store) Stat(path string) (ObjectInfo, error) {
+	key := s.getObjectKey(path)
+	output, err := s.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat S3 object: %w", notFound(path, err))
+	}
+
+	info := ObjectInfo{Path: path}
+	if output.ContentLength != nil {
+		info.Size = *output.ContentLength
+	}
+	if output.LastModified != nil {
+		info.Modified = *output.LastModified
+	}
+	info.Metadata = output.Metadata
+	return info, nil
+}
+
+// SetMetadata replaces the user-defined metadata of an object. S3 cannot
+// edit metadata in place, so the object is copied onto itself.
+func (s *S3Store) SetMetadata(path string, metadata map[string]string) error {
+	key := s.getObjectKey(path)
+	source := (&url.URL{Path: s.bucketName + "/" + key}).EscapedPath()
+	_, err := s.client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucketName),
+		Key:               aws.String(key),
+		CopySource:        aws.String(source),
+		Metadata:          metadata,
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set S3 object metadata: %w", notFound(path, err))
+	}
+	return nil
+}
+
+// VersioningEnabled reports whether the bucket keeps previous versions of objects
+func (s *S3Store) VersioningEnabled() (bool, error) {
+	output, err := s.client.GetBucketVersioning(context.TODO(), &s3.GetBucketVersioningInput{
+		Bucket: aws.String(s.bucketName),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get S3 bucket versioning: %w", err)
+	}
+	return output.Status == types.BucketVersioningStatusEnabled, nil
+}
+
+// ListVersions lists every version of the objects with the given prefix,
+// including their current versions and delete markers
+func (s *S3Store) ListVersions(prefix string) ([]ObjectVersion, error) {
+	fullPrefix := s.getObjectKey(prefix)
+	paginator := s3.NewListObjectVersionsPaginator(s.client, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(fullPrefix),
+	})
+
+	var versions []ObjectVersion
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 object versions: %w", err)
+		}
+
+		for _, v := range page.Versions {
+			key := aws.ToString(v.Key)
+			if !strings.HasPrefix(key, s.prefix) {
+				continue
+			}
+			versions = append(versions, ObjectVersion{
+				Path:      strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/"),
+				VersionID: aws.ToString(v.VersionId),
+				Size:      aws.ToInt64(v.Size),
+				Modified:  aws.ToTime(v.LastModified),
+				IsLatest:  aws.ToBool(v.IsLatest),
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			key := aws.ToString(m.Key)
+			if !strings.HasPrefix(key, s.prefix) {
+				continue
+			}
+			versions = append(versions, ObjectVersion{
+				Path:         strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/"),
+				VersionID:    aws.ToString(m.VersionId),
+				Modified:     aws.ToTime(m.LastModified),
+				IsLatest:     aws.ToBool(m.IsLatest),
+				DeleteMarker: true,
+			})
+		}
+	}
+
+	return versions, nil
+}
+
+// ReadVersion opens a version of an object for streaming; the caller must close the returned reader
+func (s *S3Store) ReadVersion(path, versionID string) (io.ReadCloser, error) {
+	key := s.getObjectKey(path)
+	output, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket:    aws.String(s.bucketName),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from S3: %w", notFound(path, err))
+	}
+	return output.Body, nil
+}
+
+// StatVersion returns information about a version of an object
+func (s *S3Store) StatVersion(path, versionID string) (ObjectInfo, error) {
+	key := s.getObjectKey(path)
+	output, err := s.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket:    aws.String(s.bucketName),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat S3 object: %w", notFound(path, err))
+	}
+
+	info := ObjectInfo{Path: path}
+	if output.ContentLength != nil {
+		info.Size = *output.ContentLength
+	}
+	if output.LastModified != nil {
+		info.Modified = *output.LastModified
+	}
+	info.Metadata = output.Metadata
+	return info, nil
+}
+
+// DeleteVersion permanently deletes a version of an object
+func (s *S3Store) DeleteVersion(path, versionID string) error {
+	key := s.getObjectKey(path)
+	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket:    aws.String(s.bucketName),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete from S3: %w", err)
+	}
+	return nil
+}
+
+// ListObjects lists objects in S3 with the given prefix along with their size and modification time
+func (s *S3Store) ListObjects(prefix string) ([]ObjectInfo, error) {
+	fullPrefix := s.getObjectKey(prefix)
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(fullPrefix),
+	})
+
+	var objects []ObjectInfo
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			if !strings.HasPrefix(key, s.prefix) {
+				continue
+			}
+			info := ObjectInfo{
+				Path: strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/"),
+			}
+			if obj.Size != nil {
+				info.Size = *obj.Size
+			}
+			if obj.LastModified != nil {
+				info.Modified = *obj.LastModified
+			}
+			objects = append(objects, info)
+		}
+	}
+
+	return objects, nil
+}
+
 // ListFiles lists objects in S3 with the given prefix
 func (s *S3Store) ListFiles(prefix string) ([]string, error) {
 	fullPrefix := s.getObjectKey(prefix)
@@ -121,3 +380,13 @@ func (s *S3Store) getObjectKey(path string) string {
 	}
 	return fmt.Sprintf("%s/%s", strings.TrimSuffix(s.prefix, "/"), strings.TrimPrefix(path, "/"))
 }
+
+// notFound maps missing-object errors onto fs.ErrNotExist
+func notFound(path string, err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return err
+}
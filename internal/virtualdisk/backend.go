@@ -0,0 +1,126 @@
+package virtualdisk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Backend stores files for a part of the virtual disk namespace. Paths passed
+// to a backend are relative to the prefix it is mounted at and use forward
+// slashes. Missing files are reported with errors wrapping fs.ErrNotExist.
+type Backend interface {
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte) error
+	// Open streams a file; the caller must close the reader
+	Open(path string) (io.ReadCloser, error)
+	// Create streams a new file that becomes visible when the writer is closed
+	Create(path string) (FileWriter, error)
+	// Delete removes a file; deleting a missing file is not an error
+	Delete(path string) error
+	Mkdir(path string) error
+	Stat(path string) (FileInfo, error)
+	// List returns all files and directories whose path starts with prefix
+	List(prefix string) ([]FileInfo, error)
+}
+
+// FileOpener is implemented by backends that support random-access handles.
+// Backends without it are edited through an in-memory copy that is written
+// back when the handle is closed.
+type FileOpener interface {
+	OpenFile(path string, flag int) (BackendFile, error)
+}
+
+// BackendFile is a random-access handle returned by a FileOpener
+type BackendFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Close() error
+}
+
+// Uploader is implemented by backends that can store a stream of known size
+// without staging it first
+type Uploader interface {
+	Upload(path string, r io.Reader, size int64) error
+}
+
+// Renamer is implemented by backends that can move a file or directory to a
+// new path in one step. Backends without it are renamed by copying.
+type Renamer interface {
+	Rename(oldPath, newPath string) error
+}
+
+// Copier is implemented by backends that can copy a file without streaming
+// it through the virtual disk
+type Copier interface {
+	Copy(srcPath, dstPath string) error
+}
+
+// Attributer is implemented by backends that store user-defined attributes
+// with their files. Attrs also reports when the attributes last changed, or
+// the zero time if the backend does not track it.
+type Attributer interface {
+	Attrs(path string) (map[string]string, time.Time, error)
+	// SetAttrs replaces all attributes of an existing file
+	SetAttrs(path string, attrs map[string]string) error
+}
+
+// isNotExist reports whether err means the file does not exist
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || os.IsNotExist(err)
+}
+
+// copyTo stores size bytes from r in backend at path
+func copyTo(backend Backend, path string, r io.Reader, size int64) error {
+	if uploader, ok := backend.(Uploader); ok {
+		return uploader.Upload(path, r, size)
+	}
+
+	w, err := backend.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	return w.Close()
+}
+
+// attrsOf returns the attributes of a file, or none if the backend does not store them
+func attrsOf(backend Backend, path string) (map[string]string, time.Time, error) {
+	attributer, ok := backend.(Attributer)
+	if !ok {
+		return map[string]string{}, time.Time{}, nil
+	}
+	return attributer.Attrs(path)
+}
+
+// setAttrs replaces the attributes of a file in a backend that stores them
+func setAttrs(backend Backend, path string, attrs map[string]string) error {
+	attributer, ok := backend.(Attributer)
+	if !ok {
+		return fmt.Errorf("storage does not support attributes")
+	}
+	return attributer.SetAttrs(path, attrs)
+}
+
+// copyAttrs copies the attributes of a file to a file in another backend
+func copyAttrs(src Backend, srcPath string, dst Backend, dstPath string) error {
+	attributer, ok := dst.(Attributer)
+	if !ok {
+		return nil
+	}
+	attrs, _, err := attrsOf(src, srcPath)
+	if err != nil || len(attrs) == 0 {
+		return err
+	}
+	return attributer.SetAttrs(dstPath, attrs)
+}
@@ -0,0 +1,94 @@
+package virtualdisk
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowBackend delays every write and delete to the backend it wraps, as an
+// S3 upload would
+type slowBackend struct {
+	Backend
+	latency time.Duration
+}
+
+func (b slowBackend) WriteFile(path string, data []byte) error {
+	time.Sleep(b.latency)
+	return b.Backend.WriteFile(path, data)
+}
+
+func (b slowBackend) Delete(path string) error {
+	time.Sleep(b.latency)
+	return b.Backend.Delete(path)
+}
+
+// BenchmarkMixedLoad measures persistent files under mixed parallel load:
+// 70% reads, 20% writes and 10% listings of random files, with every write
+// mirrored to a backend that takes 5ms and previous versions kept. Slow
+// writes should only hold up operations on the same files.
+//
+//	go test -run '^$' -bench MixedLoad ./internal/virtualdisk
+func BenchmarkMixedLoad(b *testing.B) {
+	b.Run("write-through", func(b *testing.B) {
+		benchmarkMixedLoad(b, Config{})
+	})
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkMixedLoad(b, Config{BufferSize: 64 << 20, FlushInterval: time.Second, EnableJournal: true})
+	})
+}
+
+func benchmarkMixedLoad(b *testing.B, config Config) {
+	const files = 256
+	const size = 4096
+
+	config.DataPartition = b.TempDir()
+	config.CacheSize = 64 << 20
+	config.Versions = 3
+	config.mirror = slowBackend{NewMemoryBackend(), 5 * time.Millisecond}
+	vd, err := NewVirtualDisk(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer vd.Close()
+
+	data := make([]byte, size)
+	rand.Read(data)
+	pathOf := func(i int) string {
+		return fmt.Sprintf("bench/%02d/file%d", i%16, i)
+	}
+	for i := 0; i < files; i++ {
+		if err := vd.WriteFile(pathOf(i), data); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var seed int64
+	b.SetBytes(size)
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			i := rng.Intn(files)
+			var err error
+			switch n := rng.Intn(100); {
+			case n < 70:
+				_, err = vd.ReadFile(pathOf(i))
+			case n < 90:
+				err = vd.WriteFile(pathOf(i), data)
+			default:
+				_, err = vd.ListFiles(fmt.Sprintf("bench/%02d/", i%16))
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+
+	// Flushing on close is not part of the load
+	b.StopTimer()
+}
@@ -0,0 +1,199 @@
+package virtualdisk
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultFlushInterval is the maximum age of a buffered write when Config.FlushInterval is unset
+const defaultFlushInterval = 5 * time.Second
+
+// writeBackEnabled reports whether persistent writes are staged in the buffer
+func (vd *VirtualDisk) writeBackEnabled() bool {
+	return vd.bufferSize > 0
+}
+
+// bufferWrite stages a persistent write in the buffer, coalescing it with any
+// pending write to the same path
+func (vd *VirtualDisk) bufferWrite(path string, data []byte) {
+	vd.mu.Lock()
+	defer vd.mu.Unlock()
+
+	vd.dropBufferedLocked(path)
+	vd.buffer[path] = &BufferEntry{
+		Data:     data,
+		Modified: time.Now(),
+		Type:     StoragePersistent,
+		Dirty:    true,
+	}
+	vd.bufferedBytes += int64(len(data))
+
+	// Wake the flusher once the buffer or the journal is over its budget
+	if vd.bufferedBytes > vd.bufferSize || (vd.journal != nil && vd.journal.Size() > journalMaxSize) {
+		select {
+		case vd.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dropBuffered discards any pending buffered write for path
+func (vd *VirtualDisk) dropBuffered(path string) {
+	vd.mu.Lock()
+	defer vd.mu.Unlock()
+
+	vd.dropBufferedLocked(path)
+}
+
+// dropBufferedLocked is dropBuffered with vd.mu held
+func (vd *VirtualDisk) dropBufferedLocked(path string) {
+	entry, ok := vd.buffer[path]
+	if !ok {
+		return
+	}
+	if entry.Dirty {
+		vd.bufferedBytes -= int64(len(entry.Data))
+	}
+	delete(vd.buffer, path)
+}
+
+// buffered returns the buffered write for path, if there is one
+func (vd *VirtualDisk) buffered(path string) (*BufferEntry, bool) {
+	vd.mu.RLock()
+	defer vd.mu.RUnlock()
+
+	entry, ok := vd.buffer[path]
+	return entry, ok
+}
+
+// bufferedWithin returns the buffered writes to path or anywhere below it;
+// see within
+func (vd *VirtualDisk) bufferedWithin(path string) map[string]*BufferEntry {
+	vd.mu.RLock()
+	defer vd.mu.RUnlock()
+
+	entries := make(map[string]*BufferEntry)
+	for bufferedPath, entry := range vd.buffer {
+		if within(bufferedPath, path) {
+			entries[bufferedPath] = entry
+		}
+	}
+	return entries
+}
+
+// writeBack writes a pending buffered write for path through to storage and
+// reports whether there was one. path must be locked exclusively.
+func (vd *VirtualDisk) writeBack(path string) (bool, error) {
+	entry, ok := vd.buffered(path)
+	if !ok || !entry.Dirty {
+		return false, nil
+	}
+	if err := vd.writeThrough(path, entry.Data); err != nil {
+		return false, err
+	}
+	vd.dropBuffered(path)
+
+	// The file may take up less space in storage than in the buffer
+	if err := vd.refreshUsage(path); err != nil {
+		fmt.Printf("failed to update usage: %v\n", err)
+	}
+	return true, nil
+}
+
+// flushPath writes back a pending buffered write for path and checkpoints it
+// in the journal. path must be locked exclusively.
+func (vd *VirtualDisk) flushPath(path string) error {
+	flushed, err := vd.writeBack(path)
+	if err != nil || !flushed {
+		return err
+	}
+	return vd.logCheckpoint(path)
+}
+
+// flushBuffered writes through all dirty entries at least maxAge old,
+// locking each path while it is written back. Entries that fail stay
+// buffered and are retried on the next flush. No paths may be locked.
+func (vd *VirtualDisk) flushBuffered(maxAge time.Duration) error {
+	return vd.flushEntries(maxAge, true)
+}
+
+// flushAll writes through all dirty entries. The whole disk must be locked
+// exclusively.
+func (vd *VirtualDisk) flushAll() error {
+	return vd.flushEntries(0, false)
+}
+
+// flushEntries writes through dirty entries at least maxAge old, locking
+// their paths if lock is set
+func (vd *VirtualDisk) flushEntries(maxAge time.Duration, lock bool) error {
+	var paths []string
+	now := time.Now()
+	for path, entry := range vd.bufferedWithin("") {
+		if entry.Dirty && now.Sub(entry.Modified) >= maxAge {
+			paths = append(paths, path)
+		}
+	}
+
+	var firstErr error
+	var flushed []string
+	for _, path := range paths {
+		var err error
+		if lock {
+			unlock := vd.locks.lock(fileLock(path, true))
+			_, err = vd.writeBack(path)
+			unlock()
+		} else {
+			_, err = vd.writeBack(path)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to flush %s: %w", path, err)
+			}
+			continue
+		}
+		flushed = append(flushed, path)
+	}
+
+	if err := vd.settleJournal(flushed); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// writeThrough writes data to the backend serving path; persistent files are
+// also written to S3 when it is configured
+func (vd *VirtualDisk) writeThrough(path string, data []byte) error {
+	backend, relPath := vd.resolve(path)
+	return backend.WriteFile(relPath, data)
+}
+
+// removeThrough deletes a file from the backend serving path
+func (vd *VirtualDisk) removeThrough(path string) error {
+	backend, relPath := vd.resolve(path)
+	return backend.Delete(relPath)
+}
+
+// runFlusher writes buffered data back when it ages out or the buffer fills up
+func (vd *VirtualDisk) runFlusher() {
+	defer vd.wg.Done()
+
+	ticker := time.NewTicker(vd.flushInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		var maxAge time.Duration
+		select {
+		case <-vd.done:
+			return
+		case <-vd.flushCh:
+			maxAge = 0
+		case <-ticker.C:
+			maxAge = vd.flushInterval
+		}
+
+		if err := vd.flushBuffered(maxAge); err != nil {
+			// Log error but keep the data buffered for the next attempt
+			fmt.Printf("failed to flush buffer: %v\n", err)
+		}
+	}
+}
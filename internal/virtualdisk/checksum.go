@@ -0,0 +1,278 @@
+package virtualdisk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrChecksumMismatch is returned when a file read back from storage does
+// not match the checksum recorded when it was written
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumMagic starts every file stored with a checksum. It is followed by
+// the SHA-256 of the rest of the file.
+const checksumMagic = "VDS\x01"
+
+// checksumHeaderSize is the size of the header in front of checksummed files
+const checksumHeaderSize = len(checksumMagic) + sha256.Size
+
+// ChecksumBackend records a SHA-256 checksum in front of every file written
+// to a base backend and verifies it when the file is read back. Files stored
+// before checksums were enabled are read as they are.
+type ChecksumBackend struct {
+	base Backend
+}
+
+// NewChecksumBackend creates a backend checksumming files in base
+func NewChecksumBackend(base Backend) *ChecksumBackend {
+	return &ChecksumBackend{base: base}
+}
+
+// readChecksum reads the checksum header at the start of r, if there is one
+func readChecksum(r *bufio.Reader) ([]byte, error) {
+	magic, err := r.Peek(len(checksumMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read checksum header: %w", err)
+	}
+	if string(magic) != checksumMagic {
+		return nil, nil
+	}
+	header := make([]byte, checksumHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read checksum header: %w", err)
+	}
+	return header[len(checksumMagic):], nil
+}
+
+// ReadFile reads a whole file and verifies its checksum
+func (b *ChecksumBackend) ReadFile(path string) ([]byte, error) {
+	reader, err := b.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// WriteFile writes a whole file behind its checksum
+func (b *ChecksumBackend) WriteFile(path string, data []byte) error {
+	sum := sha256.Sum256(data)
+	stored := make([]byte, 0, checksumHeaderSize+len(data))
+	stored = append(stored, checksumMagic...)
+	stored = append(stored, sum[:]...)
+	return b.base.WriteFile(path, append(stored, data...))
+}
+
+// Open streams a file; the checksum is verified when the end is reached
+func (b *ChecksumBackend) Open(path string) (io.ReadCloser, error) {
+	file, err := b.base.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	sum, err := readChecksum(buffered)
+	if errors.Is(err, ErrChecksumMismatch) {
+		// The base backend found damage of its own; report it once the file is
+		// read, so the file can still be listed
+		file.Close()
+		return &verifyReader{err: err}, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return &verifyReader{
+		reader: buffered,
+		file:   file,
+		path:   path,
+		sum:    sum,
+		hash:   sha256.New(),
+	}, nil
+}
+
+// Create stages a file in a temporary file, since the checksum goes in
+// front of the data
+func (b *ChecksumBackend) Create(path string) (FileWriter, error) {
+	staging, err := os.CreateTemp("", "virtualdisk_checksum_*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging file: %w", err)
+	}
+	return &checksumWriter{
+		backend: b,
+		path:    path,
+		staging: staging,
+		hash:    sha256.New(),
+	}, nil
+}
+
+// Delete removes a file
+func (b *ChecksumBackend) Delete(path string) error {
+	return b.base.Delete(path)
+}
+
+// Rename moves a file or directory along with its checksum
+func (b *ChecksumBackend) Rename(oldPath, newPath string) error {
+	return renameWithin(b.base, oldPath, newPath)
+}
+
+// Copy copies the stored data along with its checksum
+func (b *ChecksumBackend) Copy(srcPath, dstPath string) error {
+	return copyBetween(b.base, srcPath, b.base, dstPath)
+}
+
+// Attrs returns the attributes stored by the base backend
+func (b *ChecksumBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	return attrsOf(b.base, path)
+}
+
+// SetAttrs stores attributes in the base backend
+func (b *ChecksumBackend) SetAttrs(path string, attrs map[string]string) error {
+	return setAttrs(b.base, path, attrs)
+}
+
+// Mkdir creates a directory
+func (b *ChecksumBackend) Mkdir(path string) error {
+	return b.base.Mkdir(path)
+}
+
+// Stat returns information about a file without its checksum header
+func (b *ChecksumBackend) Stat(path string) (FileInfo, error) {
+	info, err := b.base.Stat(path)
+	if err != nil || info.IsDir {
+		return info, err
+	}
+	return b.withDataSize(info)
+}
+
+// List lists files without their checksum headers
+func (b *ChecksumBackend) List(prefix string) ([]FileInfo, error) {
+	infos, err := b.base.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		if infos[i], err = b.withDataSize(info); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// withDataSize leaves the checksum header out of the size of a file
+func (b *ChecksumBackend) withDataSize(info FileInfo) (FileInfo, error) {
+	file, err := b.base.Open(info.Path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer file.Close()
+
+	sum, err := readChecksum(bufio.NewReaderSize(file, 64))
+	if errors.Is(err, ErrChecksumMismatch) {
+		return info, nil // Reported when the file is read
+	}
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", info.Path, err)
+	}
+	if sum != nil {
+		info.Size -= int64(checksumHeaderSize)
+	}
+	return info, nil
+}
+
+// verifyReader hashes a file as it is read and checks the result at the end
+type verifyReader struct {
+	reader io.Reader
+	file   io.Closer
+	path   string
+	sum    []byte // nil for files stored without a checksum
+	hash   hash.Hash
+	err    error // damage found before the content was reached
+}
+
+func (r *verifyReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.reader.Read(p)
+	if r.sum == nil {
+		return n, err
+	}
+	r.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.sum) {
+		return n, fmt.Errorf("%w: %s", ErrChecksumMismatch, r.path)
+	}
+	return n, err
+}
+
+func (r *verifyReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// checksumWriter hashes a file while staging it, then stores it behind its checksum
+type checksumWriter struct {
+	backend *ChecksumBackend
+	path    string
+	staging *os.File
+	hash    hash.Hash
+	size    int64
+	closed  bool
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("write to closed file: %s", w.path)
+	}
+	n, err := w.staging.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write staging file: %w", err)
+	}
+	return n, nil
+}
+
+// Close stores the checksum and the staged data in the base backend
+func (w *checksumWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer os.Remove(w.staging.Name())
+	defer w.staging.Close()
+
+	if _, err := w.staging.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read staging file: %w", err)
+	}
+	header := append([]byte(checksumMagic), w.hash.Sum(nil)...)
+	r := io.MultiReader(bytes.NewReader(header), w.staging)
+	return copyTo(w.backend.base, w.path, r, int64(len(header))+w.size)
+}
+
+// Abort discards the file
+func (w *checksumWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.staging.Close()
+	return os.Remove(w.staging.Name())
+}
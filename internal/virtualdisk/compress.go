@@ -0,0 +1,575 @@
+package virtualdisk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	pathpkg "path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/envelope"
+)
+
+// compressMagic starts every compressed file. It is followed by the length
+// and name of the codec, the uncompressed size and the compressed data.
+// Files without it are stored as they are, unless they start with the magic
+// themselves: those get a header naming the "none" codec.
+const compressMagic = "VDZ\x01"
+
+// sniffLen is how much of a file is looked at to detect its content type
+const sniffLen = 512
+
+// Codec compresses and decompresses file content
+type Codec interface {
+	// Name identifies the codec in compression rules and stored files
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// codecs holds the registered codecs by name
+var (
+	codecs   = map[string]Codec{"gzip": gzipCodec{}}
+	codecsMu sync.RWMutex
+)
+
+// RegisterCodec makes a codec available to compression rules. Files stored
+// with a codec can only be read while it is registered.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+// lookupCodec returns a registered codec
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	if name == "none" {
+		return rawCodec{}, nil
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec: %q", name)
+	}
+	return codec, nil
+}
+
+// gzipCodec compresses with gzip from the standard library
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// rawCodec stores data as it is. It only marks files that would otherwise be
+// mistaken for compressed files.
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "none"
+}
+
+func (rawCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (rawCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+// nopWriteCloser adds a Close that does nothing to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// CompressionRule selects the codec for files matching a path pattern and
+// content type. Rules are evaluated in order and the first match wins.
+type CompressionRule struct {
+	// Pattern selects files like TieringPolicy.Pattern; empty matches every file
+	Pattern string `json:"pattern"`
+	// ContentType is a media type such as "application/json", or a glob such
+	// as "text/*"; empty matches every content type
+	ContentType string `json:"content_type"`
+	// Codec is the name of a registered codec, or "none" to store files as they are
+	Codec string `json:"codec"`
+}
+
+// ParseCompressionRules parses a JSON list of compression rules
+func ParseCompressionRules(data []byte) ([]CompressionRule, error) {
+	var rules []CompressionRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse compression rules: %w", err)
+	}
+	return rules, nil
+}
+
+// validateCompressionRules checks that every rule names a registered codec
+func validateCompressionRules(rules []CompressionRule) error {
+	for i, rule := range rules {
+		if rule.Codec == "none" {
+			continue
+		}
+		if _, err := lookupCodec(rule.Codec); err != nil {
+			return fmt.Errorf("compression rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to a file
+func (r CompressionRule) matches(path, contentType string) bool {
+	if !matchPattern(r.Pattern, path) {
+		return false
+	}
+	if r.ContentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	ok, _ := pathpkg.Match(r.ContentType, mediaType)
+	return ok
+}
+
+// CompressBackend compresses files on their way into a base backend and
+// decompresses them on the way out. Compressed files start with a header
+// recording the codec and the uncompressed size, so files stored before
+// compression was enabled, or excluded by the rules, are read as they are.
+type CompressBackend struct {
+	base    Backend
+	rules   []CompressionRule
+	staging string            // directory of staging files; the system temp directory if empty
+	keys    *envelope.Keyring // encrypts staging files if set
+}
+
+// NewCompressBackend creates a backend compressing files in base according to rules
+func NewCompressBackend(base Backend, rules []CompressionRule) *CompressBackend {
+	return &CompressBackend{
+		base:  base,
+		rules: rules,
+	}
+}
+
+// codecFor returns the codec for a file, or nil if it is stored as it is
+func (b *CompressBackend) codecFor(path string, head []byte) Codec {
+	contentType := detectContentType(path, head)
+	for _, rule := range b.rules {
+		if !rule.matches(path, contentType) {
+			continue
+		}
+		if rule.Codec == "none" {
+			return nil
+		}
+		codec, err := lookupCodec(rule.Codec)
+		if err != nil {
+			return nil // Rules are validated up front
+		}
+		return codec
+	}
+	return nil
+}
+
+// compressHeader describes a compressed file
+type compressHeader struct {
+	codec Codec
+	size  int64 // uncompressed size
+}
+
+// readHeader reads the compression header at the start of r, if there is one
+func readHeader(r *bufio.Reader) (*compressHeader, error) {
+	magic, err := r.Peek(len(compressMagic))
+	if err != nil || string(magic) != compressMagic {
+		return nil, nil
+	}
+	r.Discard(len(compressMagic))
+
+	nameLen, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compression header: %w", err)
+	}
+	rest := make([]byte, int(nameLen)+8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("failed to read compression header: %w", err)
+	}
+	codec, err := lookupCodec(string(rest[:nameLen]))
+	if err != nil {
+		return nil, err
+	}
+	return &compressHeader{
+		codec: codec,
+		size:  int64(binary.BigEndian.Uint64(rest[nameLen:])),
+	}, nil
+}
+
+// appendHeader encodes a compression header
+func appendHeader(buf []byte, codec Codec, size int64) []byte {
+	buf = append(buf, compressMagic...)
+	buf = append(buf, byte(len(codec.Name())))
+	buf = append(buf, codec.Name()...)
+	return binary.BigEndian.AppendUint64(buf, uint64(size))
+}
+
+// ReadFile reads and decompresses a whole file
+func (b *CompressBackend) ReadFile(path string) ([]byte, error) {
+	reader, err := b.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// WriteFile compresses a whole file if the rules call for it
+func (b *CompressBackend) WriteFile(path string, data []byte) error {
+	w, err := b.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Open streams a file, decompressing it if it is compressed
+func (b *CompressBackend) Open(path string) (io.ReadCloser, error) {
+	file, err := b.base.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	header, err := readHeader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if header == nil {
+		return &decompressReader{Reader: buffered, file: file}, nil
+	}
+
+	decoder, err := header.codec.NewReader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	return &decompressReader{Reader: decoder, decoder: decoder, file: file}, nil
+}
+
+// Create picks a codec once it has seen enough of the file to know its
+// content type. Compressed files are staged in a temporary file, encrypted if
+// keys are set, since the header records the uncompressed size.
+func (b *CompressBackend) Create(path string) (FileWriter, error) {
+	return &compressWriter{backend: b, path: path}, nil
+}
+
+// Delete removes a file
+func (b *CompressBackend) Delete(path string) error {
+	return b.base.Delete(path)
+}
+
+// Rename moves a file or directory; the data is not recompressed
+func (b *CompressBackend) Rename(oldPath, newPath string) error {
+	return renameWithin(b.base, oldPath, newPath)
+}
+
+// Copy copies the stored data; the copy is compressed like the original
+func (b *CompressBackend) Copy(srcPath, dstPath string) error {
+	return copyBetween(b.base, srcPath, b.base, dstPath)
+}
+
+// Attrs returns the attributes stored by the base backend
+func (b *CompressBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	return attrsOf(b.base, path)
+}
+
+// SetAttrs stores attributes in the base backend
+func (b *CompressBackend) SetAttrs(path string, attrs map[string]string) error {
+	return setAttrs(b.base, path, attrs)
+}
+
+// Mkdir creates a directory
+func (b *CompressBackend) Mkdir(path string) error {
+	return b.base.Mkdir(path)
+}
+
+// Stat returns information about a file with its uncompressed size
+func (b *CompressBackend) Stat(path string) (FileInfo, error) {
+	info, err := b.base.Stat(path)
+	if err != nil || info.IsDir {
+		return info, err
+	}
+	return b.withSizes(info)
+}
+
+// List lists files with their uncompressed sizes
+func (b *CompressBackend) List(prefix string) ([]FileInfo, error) {
+	infos, err := b.base.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		if infos[i], err = b.withSizes(info); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	return infos, nil
+}
+
+// withSizes fills in the stored size and codec of a file and replaces its
+// size with the uncompressed size
+func (b *CompressBackend) withSizes(info FileInfo) (FileInfo, error) {
+	info.StoredSize = info.Size
+
+	file, err := b.base.Open(info.Path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer file.Close()
+
+	header, err := readHeader(bufio.NewReaderSize(file, 64))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", info.Path, err)
+	}
+	if header != nil {
+		info.Size = header.size
+		if _, raw := header.codec.(rawCodec); !raw {
+			info.Compression = header.codec.Name()
+		}
+	}
+	return info, nil
+}
+
+// decompressReader closes the decoder and the stored file
+type decompressReader struct {
+	io.Reader
+	decoder io.Closer
+	file    io.Closer
+}
+
+func (r *decompressReader) Close() error {
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
+	return r.file.Close()
+}
+
+// compressWriter holds back the start of a file until it knows the codec,
+// then either streams the file to the base backend as it is or compresses it
+// into a staging file
+type compressWriter struct {
+	backend *CompressBackend
+	path    string
+	head    []byte
+
+	// Once the codec is known, files stored as they are go to plain and
+	// compressed files through encoder to staging
+	codec      Codec
+	plain      FileWriter
+	staging    *os.File
+	sealer     io.WriteCloser // encrypts what goes to staging, if keys are set
+	encoder    io.WriteCloser
+	size       int64        // uncompressed bytes written to encoder
+	compressed *countWriter // counts compressed bytes written by encoder
+	closed     bool
+}
+
+// countWriter counts the bytes written through it
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("write to closed file: %s", w.path)
+	}
+	if w.plain == nil && w.staging == nil {
+		w.head = append(w.head, p...)
+		if len(w.head) < sniffLen {
+			return len(p), nil
+		}
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.write(p)
+}
+
+// start picks the codec and writes the data held back so far
+func (w *compressWriter) start() error {
+	head := w.head
+	w.head = nil
+
+	w.codec = w.backend.codecFor(w.path, head)
+	if w.codec == nil && bytes.HasPrefix(head, []byte(compressMagic)) {
+		w.codec = rawCodec{}
+	}
+	if w.codec == nil {
+		plain, err := w.backend.base.Create(w.path)
+		if err != nil {
+			return err
+		}
+		w.plain = plain
+	} else {
+		staging, err := os.CreateTemp(w.backend.staging, "compress_*")
+		if err != nil {
+			return fmt.Errorf("failed to create staging file: %w", err)
+		}
+		w.staging = staging
+		var sink io.Writer = staging
+		if w.backend.keys != nil {
+			if w.sealer, err = envelope.NewWriter(staging, w.backend.keys); err != nil {
+				w.discardStaging()
+				return fmt.Errorf("failed to encrypt staging file: %w", err)
+			}
+			sink = w.sealer
+		}
+		w.compressed = &countWriter{w: sink}
+		if w.encoder, err = w.codec.NewWriter(w.compressed); err != nil {
+			w.discardStaging()
+			return fmt.Errorf("failed to compress %s: %w", w.path, err)
+		}
+	}
+
+	_, err := w.write(head)
+	return err
+}
+
+// write passes data on once the codec is known
+func (w *compressWriter) write(p []byte) (int, error) {
+	if w.plain != nil {
+		return w.plain.Write(p)
+	}
+	n, err := w.encoder.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to compress %s: %w", w.path, err)
+	}
+	return n, nil
+}
+
+// Close stores the file in the base backend
+func (w *compressWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	if w.plain == nil && w.staging == nil {
+		if err := w.start(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	w.closed = true
+
+	if w.plain != nil {
+		return w.plain.Close()
+	}
+	defer w.discardStaging()
+
+	if err := w.encoder.Close(); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", w.path, err)
+	}
+	if w.sealer != nil {
+		if err := w.sealer.Close(); err != nil {
+			return fmt.Errorf("failed to encrypt staging file: %w", err)
+		}
+	}
+	staged, err := w.readStaging()
+	if err != nil {
+		return err
+	}
+
+	// The header goes in front now that the uncompressed size is known
+	header := appendHeader(nil, w.codec, w.size)
+	r := io.MultiReader(bytes.NewReader(header), staged)
+	return copyTo(w.backend.base, w.path, r, int64(len(header))+w.compressed.n)
+}
+
+// readStaging reads back the compressed data from the start of the staging file
+func (w *compressWriter) readStaging() (io.Reader, error) {
+	if _, err := w.staging.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read staging file: %w", err)
+	}
+	if w.sealer == nil {
+		return w.staging, nil
+	}
+
+	buffered := bufio.NewReader(w.staging)
+	header, err := envelope.ReadHeader(buffered)
+	if err == nil && header == nil {
+		err = fmt.Errorf("missing encryption header")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staging file: %w", err)
+	}
+	decrypter, err := envelope.NewReader(buffered, header, w.backend.keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt staging file: %w", err)
+	}
+	return decrypter, nil
+}
+
+// discardStaging closes and removes the staging file
+func (w *compressWriter) discardStaging() {
+	w.staging.Close()
+	os.Remove(w.staging.Name())
+	w.staging = nil
+}
+
+// Abort discards the file
+func (w *compressWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.head = nil
+	if w.plain != nil {
+		return w.plain.Abort()
+	}
+	if w.staging != nil {
+		w.discardStaging()
+	}
+	return nil
+}
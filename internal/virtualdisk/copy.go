@@ -0,0 +1,188 @@
+package virtualdisk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// Copy copies a file to a new path. The data never leaves the storage side:
+// backends copy in place where they can (reflinks or copy_file_range on
+// local disks, CopyObject in S3) and stream between backends otherwise.
+func (vd *VirtualDisk) Copy(srcPath, dstPath string) error {
+	return vd.copyPaths(srcPath, dstPath, false, WriteOptions{})
+}
+
+// CopyWith copies a file to a new path with options. Leases held on the
+// file replaced apply to it.
+func (vd *VirtualDisk) CopyWith(srcPath, dstPath string, opts WriteOptions) error {
+	return vd.copyPaths(srcPath, dstPath, false, opts)
+}
+
+// CopyDir recursively copies a directory to a new path
+func (vd *VirtualDisk) CopyDir(srcPath, dstPath string) error {
+	return vd.copyPaths(srcPath, dstPath, true, WriteOptions{})
+}
+
+// CopyDirWith recursively copies a directory to a new path with options.
+// Leases held on the files replaced apply to it.
+func (vd *VirtualDisk) CopyDirWith(srcPath, dstPath string, opts WriteOptions) error {
+	return vd.copyPaths(srcPath, dstPath, true, opts)
+}
+
+// copyPaths copies a file, or a directory tree if recursive is set
+func (vd *VirtualDisk) copyPaths(srcPath, dstPath string, recursive bool, opts WriteOptions) error {
+	if srcPath == dstPath {
+		return fmt.Errorf("cannot copy %s onto itself", srcPath)
+	}
+	if recursive && (srcPath == "" || strings.HasPrefix(dstPath, srcPath+"/")) {
+		return fmt.Errorf("cannot copy %s into itself", srcPath)
+	}
+
+	// The source is written back below, so it is locked exclusively too
+	unlock := vd.locks.lock(treeLock(srcPath, true), treeLock(dstPath, true))
+	defer unlock()
+
+	// Only the copy changes files; the source is read
+	if err := vd.checkLeases([]string{opts.LockToken}, dstPath); err != nil {
+		return err
+	}
+
+	// Write back buffered data so the copy sees it and nothing buffered overwrites the copy
+	for _, path := range []string{srcPath, dstPath} {
+		if err := vd.flushTree(path); err != nil {
+			return err
+		}
+	}
+
+	srcBackend, srcRel := vd.resolve(srcPath)
+	dstBackend, dstRel := vd.resolve(dstPath)
+
+	isDir, err := statTree(srcBackend, srcRel)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if isDir != recursive {
+		if isDir {
+			return fmt.Errorf("%s is a directory", srcPath)
+		}
+		return fmt.Errorf("%s is not a directory", srcPath)
+	}
+	reservation, err := vd.reserveQuotaCopy(srcPath, dstPath, false)
+	if err != nil {
+		return err
+	}
+	defer vd.releaseQuota(reservation)
+
+	infos, err := copyTree(srcBackend, srcRel, dstBackend, dstRel)
+	if err != nil {
+		return err
+	}
+
+	// Work out which virtual files were created
+	copied := make(map[string]int64)
+	if isDir {
+		for _, info := range infos {
+			if !info.IsDir {
+				copied[dstPath+strings.TrimPrefix(info.Path, srcRel)] = info.Size
+			}
+		}
+	} else if info, err := dstBackend.Stat(dstRel); err == nil {
+		copied[dstPath] = info.Size
+	}
+
+	var checkpoints []string
+	if vd.getStorageType(dstPath) == StoragePersistent {
+		for path := range copied {
+			checkpoints = append(checkpoints, path)
+		}
+	}
+	if err := vd.logCheckpoint(checkpoints...); err != nil {
+		return err
+	}
+
+	for path, size := range copied {
+		if vd.cache != nil {
+			vd.cache.Remove(path)
+		}
+		vd.eventBus.Publish(events.Event{
+			Type:      events.EventFileCreated,
+			Path:      path,
+			Timestamp: time.Now(),
+			Metadata: map[string]interface{}{
+				"size":   size,
+				"source": srcPath + strings.TrimPrefix(path, dstPath),
+			},
+		})
+	}
+
+	return nil
+}
+
+// copyTree copies a file or directory between backends and returns the
+// entries below a copied directory, parents first
+func copyTree(src Backend, srcPath string, dst Backend, dstPath string) ([]FileInfo, error) {
+	isDir, err := statTree(src, srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy file: %w", err)
+	}
+	if !isDir {
+		return nil, copyBetween(src, srcPath, dst, dstPath)
+	}
+
+	infos, err := src.List(srcPath + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %w", err)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+
+	if err := dst.Mkdir(dstPath); err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		target := dstPath + strings.TrimPrefix(info.Path, srcPath)
+		if info.IsDir {
+			err = dst.Mkdir(target)
+		} else {
+			err = copyBetween(src, info.Path, dst, target)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// copyBetween copies a single file, letting the storage do the work when
+// both sides are in the same backend or the same S3 bucket
+func copyBetween(src Backend, srcPath string, dst Backend, dstPath string) error {
+	if copier, ok := src.(Copier); ok && src == dst {
+		return copier.Copy(srcPath, dstPath)
+	}
+	if srcS3, ok := src.(*S3Backend); ok {
+		if dstS3, ok := dst.(*S3Backend); ok && srcS3.store.Bucket() == dstS3.store.Bucket() {
+			return srcS3.store.CopyTo(srcPath, dstS3.store, dstPath)
+		}
+	}
+	return copyFile(src, srcPath, dst, dstPath)
+}
+
+// copyFile streams a single file between backends
+func copyFile(src Backend, srcPath string, dst Backend, dstPath string) error {
+	info, err := src.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	reader, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := copyTo(dst, dstPath, reader, info.Size); err != nil {
+		return err
+	}
+	return copyAttrs(src, srcPath, dst, dstPath)
+}
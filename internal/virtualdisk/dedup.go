@@ -0,0 +1,540 @@
+package virtualdisk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/blockstore"
+)
+
+// defaultChunkSize is the chunk size used when Config.ChunkSize is not set
+const defaultChunkSize = 1024 * 1024
+
+// manifestMagic starts every manifest, followed by the ID of the store and a
+// newline. Files without both were stored before deduplication was enabled
+// and are read as they are. The ID is random and kept outside the files, so a
+// plain file cannot pass for a manifest by starting with the magic.
+const manifestMagic = "VDMANIFEST2\n"
+
+// manifest lists the chunks a file is made of
+type manifest struct {
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+// chunkRef is one chunk of a file
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// DedupStats describes how much space deduplication saves
+type DedupStats struct {
+	Files        int   `json:"files"`
+	LogicalBytes int64 `json:"logical_bytes"` // total size of all files
+	blockstore.Stats
+}
+
+// DedupBackend stores files in a local directory as manifests of chunks kept
+// once each in a content-addressed chunk store. Directories, attributes and
+// renames are handled by the local backend holding the manifests.
+type DedupBackend struct {
+	files   *LocalBackend
+	chunks  *blockstore.Store
+	chunker blockstore.Chunker
+	mu      sync.Mutex                // serializes changes to manifests and reference counts
+	writers map[*dedupWriter]struct{} // open writers holding chunk references; guarded by mu
+	header  string                    // starts every manifest of this store
+}
+
+// NewDedupBackend creates a backend storing manifests in files and chunks in
+// chunks, and collects chunks that no manifest references. id identifies the
+// store in its manifests and must stay the same for as long as it is used.
+func NewDedupBackend(files *LocalBackend, chunks *blockstore.Store, chunker blockstore.Chunker, id string) (*DedupBackend, error) {
+	b := &DedupBackend{
+		files:   files,
+		chunks:  chunks,
+		chunker: chunker,
+		writers: make(map[*dedupWriter]struct{}),
+		header:  manifestMagic + id + "\n",
+	}
+	if _, _, err := b.Collect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// openDedup sets up the deduplicating store for persistent files on disk
+func (vd *VirtualDisk) openDedup(chunkSize int, contentDefined bool) error {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	chunker := blockstore.NewFixedChunker(chunkSize)
+	if contentDefined {
+		chunker = blockstore.NewContentDefinedChunker(chunkSize)
+	}
+
+	chunks, err := blockstore.Open(vd.metaPath("chunks"))
+	if err != nil {
+		return err
+	}
+	id, err := loadStoreID(vd.metaPath("dedup.id"))
+	if err != nil {
+		return err
+	}
+	vd.dedup, err = NewDedupBackend(NewLocalBackend(vd.dataPartition), chunks, chunker, id)
+	if err != nil {
+		return fmt.Errorf("failed to open deduplicated store: %w", err)
+	}
+	return nil
+}
+
+// loadStoreID returns the ID of the deduplicated store kept at path, creating
+// it the first time
+func loadStoreID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) != 32 {
+			return "", fmt.Errorf("invalid deduplicated store ID in %s", path)
+		}
+		return string(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read deduplicated store ID: %w", err)
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate deduplicated store ID: %w", err)
+	}
+	id := hex.EncodeToString(b[:])
+	if err := writeFileAtomic(path, []byte(id)); err != nil {
+		return "", fmt.Errorf("failed to store deduplicated store ID: %w", err)
+	}
+	return id, nil
+}
+
+// CollectChunks deletes deduplicated chunks that no file references, such as
+// those left behind by a crash. It returns the number and size of the deleted chunks.
+func (vd *VirtualDisk) CollectChunks() (int, int64, error) {
+	if vd.dedup == nil {
+		return 0, 0, fmt.Errorf("deduplication is not enabled")
+	}
+	return vd.dedup.Collect()
+}
+
+// DedupStats reports how much space deduplication saves
+func (vd *VirtualDisk) DedupStats() (DedupStats, error) {
+	if vd.dedup == nil {
+		return DedupStats{}, fmt.Errorf("deduplication is not enabled")
+	}
+	return vd.dedup.Stats()
+}
+
+// readManifest returns the manifest stored at path, or nil if the file
+// predates deduplication
+func (b *DedupBackend) readManifest(path string) (*manifest, error) {
+	reader, err := b.files.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	header := make([]byte, len(b.header))
+	if _, err := io.ReadFull(reader, header); err != nil || string(header) != b.header {
+		return nil, nil
+	}
+	var m manifest
+	if err := json.NewDecoder(reader).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// existingManifest returns the manifest of a file that is about to be
+// replaced, or nil if there is none
+func (b *DedupBackend) existingManifest(path string) (*manifest, error) {
+	info, err := b.files.Stat(path)
+	if err != nil || info.IsDir {
+		return nil, nil
+	}
+	return b.readManifest(path)
+}
+
+// release drops the references a manifest holds
+func (b *DedupBackend) release(m *manifest) error {
+	if m == nil {
+		return nil
+	}
+	for _, chunk := range m.Chunks {
+		if err := b.chunks.Release(chunk.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile reassembles a file from its chunks
+func (b *DedupBackend) ReadFile(path string) ([]byte, error) {
+	reader, err := b.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// WriteFile chunks data and stores the manifest
+func (b *DedupBackend) WriteFile(path string, data []byte) error {
+	w, err := b.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Open streams a file chunk by chunk
+func (b *DedupBackend) Open(path string) (io.ReadCloser, error) {
+	m, err := b.readManifest(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if m == nil {
+		return b.files.Open(path)
+	}
+	return &chunkReader{chunks: b.chunks, refs: m.Chunks}, nil
+}
+
+// Create chunks a file as it is written; the manifest replaces the previous
+// version of the file on close
+func (b *DedupBackend) Create(path string) (FileWriter, error) {
+	return &dedupWriter{backend: b, path: path}, nil
+}
+
+// Delete removes a file and releases its chunks, or removes an empty directory
+func (b *DedupBackend) Delete(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	old, err := b.existingManifest(path)
+	if err != nil {
+		return err
+	}
+	if err := b.files.Delete(path); err != nil {
+		return err
+	}
+	return b.release(old)
+}
+
+// Rename moves a manifest or a directory of manifests; the chunks stay put
+func (b *DedupBackend) Rename(oldPath, newPath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	old, err := b.existingManifest(newPath)
+	if err != nil {
+		return err
+	}
+	if err := b.files.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	return b.release(old)
+}
+
+// Copy copies a manifest and takes another reference to each of its chunks,
+// so copies take no extra space for their content
+func (b *DedupBackend) Copy(srcPath, dstPath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, err := b.readManifest(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	old, err := b.existingManifest(dstPath)
+	if err != nil {
+		return err
+	}
+
+	if m != nil {
+		for i, chunk := range m.Chunks {
+			if err := b.chunks.Ref(chunk.Hash); err != nil {
+				b.release(&manifest{Chunks: m.Chunks[:i]})
+				return err
+			}
+		}
+	}
+	if err := b.files.Copy(srcPath, dstPath); err != nil {
+		if m != nil {
+			b.release(m)
+		}
+		return err
+	}
+	return b.release(old)
+}
+
+// Attrs returns the attributes stored with the manifest
+func (b *DedupBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	return b.files.Attrs(path)
+}
+
+// SetAttrs stores attributes with the manifest
+func (b *DedupBackend) SetAttrs(path string, attrs map[string]string) error {
+	return b.files.SetAttrs(path, attrs)
+}
+
+// Mkdir creates a directory
+func (b *DedupBackend) Mkdir(path string) error {
+	return b.files.Mkdir(path)
+}
+
+// Stat returns information about a file, with the size of its content
+func (b *DedupBackend) Stat(path string) (FileInfo, error) {
+	info, err := b.files.Stat(path)
+	if err != nil || info.IsDir {
+		return info, err
+	}
+	return b.withContentSize(info)
+}
+
+// List lists files with the size of their content
+func (b *DedupBackend) List(prefix string) ([]FileInfo, error) {
+	infos, err := b.files.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		if infos[i], err = b.withContentSize(info); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// withContentSize replaces the size of a manifest with the size of the file it describes
+func (b *DedupBackend) withContentSize(info FileInfo) (FileInfo, error) {
+	m, err := b.readManifest(info.Path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if m != nil {
+		info.Size = m.Size
+	}
+	return info, nil
+}
+
+// Collect recounts the chunk references of every manifest and open writer and
+// deletes the chunks nothing references. It returns the number and size of the
+// deleted chunks.
+func (b *DedupBackend) Collect() (int, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	refs, _, err := b.countRefs()
+	if err != nil {
+		return 0, 0, err
+	}
+	// Chunks of files still being written are referenced by no manifest yet
+	for w := range b.writers {
+		for _, chunk := range w.manifest.Chunks {
+			refs[chunk.Hash]++
+		}
+	}
+	return b.chunks.Collect(refs)
+}
+
+// Stats returns how many files and chunks are stored and their sizes
+func (b *DedupBackend) Stats() (DedupStats, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var stats DedupStats
+	_, manifests, err := b.countRefs()
+	if err != nil {
+		return stats, err
+	}
+	for _, m := range manifests {
+		stats.Files++
+		stats.LogicalBytes += m.Size
+	}
+	stats.Stats, err = b.chunks.Stats()
+	return stats, err
+}
+
+// countRefs reads every manifest and counts the references to each chunk. b.mu must be held.
+func (b *DedupBackend) countRefs() (map[string]int, []*manifest, error) {
+	infos, err := b.files.List("")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refs := make(map[string]int)
+	var manifests []*manifest
+	for _, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		m, err := b.readManifest(info.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m == nil {
+			continue
+		}
+		for _, chunk := range m.Chunks {
+			refs[chunk.Hash]++
+		}
+		manifests = append(manifests, m)
+	}
+	return refs, manifests, nil
+}
+
+// dedupWriter chunks data as it is written
+type dedupWriter struct {
+	backend  *DedupBackend
+	path     string
+	pending  []byte
+	manifest manifest
+	closed   bool
+}
+
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("write to closed file: %s", w.path)
+	}
+	w.pending = append(w.pending, p...)
+	for len(w.pending) >= w.backend.chunker.MaxSize() {
+		if err := w.cut(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// cut stores the next chunk of the pending data
+func (w *dedupWriter) cut() error {
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.chunker.Cut(w.pending)
+	hash, err := b.chunks.Put(w.pending[:n])
+	if err != nil {
+		return err
+	}
+	b.writers[w] = struct{}{}
+	w.manifest.Chunks = append(w.manifest.Chunks, chunkRef{Hash: hash, Size: n})
+	w.manifest.Size += int64(n)
+	w.pending = append(w.pending[:0], w.pending[n:]...)
+	return nil
+}
+
+// Close stores the remaining data and replaces the file with the manifest
+func (w *dedupWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	for len(w.pending) > 0 {
+		if err := w.cut(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	w.closed = true
+
+	var buf bytes.Buffer
+	buf.WriteString(w.backend.header)
+	if err := json.NewEncoder(&buf).Encode(&w.manifest); err != nil {
+		w.forget()
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.writers, w)
+	old, err := b.existingManifest(w.path)
+	if err == nil {
+		err = copyTo(b.files, w.path, &buf, int64(buf.Len()))
+	}
+	if err != nil {
+		b.release(&w.manifest)
+		return err
+	}
+	return b.release(old)
+}
+
+// Abort releases the chunks stored so far
+func (w *dedupWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.pending = nil
+	return w.forget()
+}
+
+// forget releases the chunks stored so far and stops counting them as referenced
+func (w *dedupWriter) forget() error {
+	b := w.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.writers, w)
+	return b.release(&w.manifest)
+}
+
+// chunkReader streams a file from its chunks
+type chunkReader struct {
+	chunks  *blockstore.Store
+	refs    []chunkRef
+	current []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.refs) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.chunks.Get(r.refs[0].Hash)
+		if errors.Is(err, blockstore.ErrCorrupt) || isNotExist(err) {
+			// The file exists, so a chunk it references is damaged or lost
+			return 0, fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.current = data
+		r.refs = r.refs[1:]
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.refs = nil
+	r.current = nil
+	return nil
+}
@@ -0,0 +1,137 @@
+package virtualdisk
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+	"github.com/vikasavn/virtual_disk_go/internal/journal"
+)
+
+// ErrDirNotEmpty is returned when removing a directory that still has entries
+var ErrDirNotEmpty = errors.New("directory not empty")
+
+// RemoveDirectory removes a directory. Without recursive the directory must
+// be empty; with it, everything below the directory is removed first, and
+// persistent files are moved into the trash if it is enabled. It fails with
+// ErrLocked while leases are held on files below the directory.
+func (vd *VirtualDisk) RemoveDirectory(path string, recursive bool) error {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." || path == "/" {
+		return fmt.Errorf("cannot remove the root directory")
+	}
+
+	unlock := vd.locks.lock(treeLock(path, true))
+	defer unlock()
+	if err := vd.checkLeases(nil, path); err != nil {
+		return err
+	}
+	if vd.isMountAncestor(path) {
+		return fmt.Errorf("cannot remove %s: it contains a mount point", path)
+	}
+
+	backend, relPath := vd.resolve(path)
+	if relPath == "" {
+		return fmt.Errorf("cannot remove %s: it is a mount point", path)
+	}
+
+	isDir, err := statTree(backend, relPath)
+	if err != nil && !(isNotExist(err) && vd.hasBufferedBelow(path)) {
+		return fmt.Errorf("failed to remove directory: %w", err)
+	}
+	if err == nil && !isDir {
+		return fmt.Errorf("failed to remove directory: %s is not a directory", path)
+	}
+
+	// The trash needs the latest content of the files
+	storageType := vd.getStorageType(path)
+	if storageType == StoragePersistent && vd.trash != nil {
+		if err := vd.flushTree(path); err != nil {
+			return err
+		}
+	}
+
+	// Collect everything below the directory, including files not written back yet
+	entries := make(map[string]bool) // path to whether it is a directory
+	infos, err := backend.List(relPath + "/")
+	if err != nil {
+		return fmt.Errorf("failed to list directory: %w", err)
+	}
+	for _, info := range infos {
+		entries[info.Path] = info.IsDir
+	}
+	for bufferedPath := range vd.bufferedWithin(path) {
+		if rest, ok := strings.CutPrefix(bufferedPath, path+"/"); ok {
+			entries[relPath+"/"+rest] = false
+		}
+	}
+	if len(entries) > 0 && !recursive {
+		return fmt.Errorf("failed to remove %s: %w", path, ErrDirNotEmpty)
+	}
+
+	// Deepest entries first, so every directory is empty when it is removed
+	paths := make([]string, 0, len(entries))
+	for entryPath := range entries {
+		paths = append(paths, entryPath)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	if storageType == StoragePersistent {
+		records := make([]journal.Record, 0, len(paths)+1)
+		for _, entryPath := range paths {
+			op := journal.OpDelete
+			if entries[entryPath] {
+				op = journal.OpRmdir
+			}
+			records = append(records, journal.Record{Op: op, Path: path + strings.TrimPrefix(entryPath, relPath)})
+		}
+		records = append(records, journal.Record{Op: journal.OpRmdir, Path: path})
+		vd.journalMu.RLock()
+		defer vd.journalMu.RUnlock()
+		if err := vd.logOp(records...); err != nil {
+			return err
+		}
+	}
+
+	trashed := 0
+	for _, entryPath := range paths {
+		virtualPath := path + strings.TrimPrefix(entryPath, relPath)
+		vd.dropBuffered(virtualPath)
+		if entries[entryPath] {
+			err = backend.Delete(entryPath)
+		} else {
+			var entry *TrashEntry
+			if entry, err = vd.trashFile(virtualPath); entry != nil {
+				trashed++
+			}
+		}
+		if err != nil && !isNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", entryPath, err)
+		}
+	}
+	if err := backend.Delete(relPath); err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to remove directory: %w", err)
+	}
+
+	if vd.cache != nil {
+		vd.cache.RemovePrefix(path + "/")
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileDeleted,
+		Path:      path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"is_dir":    true,
+			"recursive": recursive,
+			"entries":   len(paths),
+			"trashed":   trashed,
+		},
+	})
+
+	return nil
+}
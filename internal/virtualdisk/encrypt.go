@@ -0,0 +1,314 @@
+package virtualdisk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/envelope"
+)
+
+// EncryptBackend encrypts files on their way into a base backend and
+// decrypts them as they are read. Every file has its own data key, wrapped by
+// the current master key of the keyring. Files stored before encryption was
+// enabled are read as they are until keys are rotated.
+type EncryptBackend struct {
+	base Backend
+	keys *envelope.Keyring
+}
+
+// NewEncryptBackend creates a backend encrypting files in base with keys from keys
+func NewEncryptBackend(base Backend, keys *envelope.Keyring) *EncryptBackend {
+	return &EncryptBackend{
+		base: base,
+		keys: keys,
+	}
+}
+
+// RotateKeys rereads the encryption key file and wraps the data key of every
+// file at rest with the current master key, without re-encrypting content.
+// Files stored before encryption was enabled are encrypted. Once it returns,
+// master keys that are no longer current can be removed from the key file.
+// It returns the number of files rewritten.
+func (vd *VirtualDisk) RotateKeys() (int, error) {
+	if vd.keys == nil {
+		return 0, fmt.Errorf("encryption is not enabled")
+	}
+	if err := vd.keys.Reload(); err != nil {
+		return 0, err
+	}
+	// Buffered writes are journaled under the key that was current; writing
+	// them back lets their records be dropped
+	if err := vd.Flush(); err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, b := range vd.encrypted {
+		infos, err := b.base.List("")
+		if err != nil {
+			return rewritten, fmt.Errorf("failed to list files: %w", err)
+		}
+		for _, info := range infos {
+			if info.IsDir {
+				continue
+			}
+			// Lock per file so other operations are not held up for the
+			// whole rotation. Not every encrypted backend holds virtual
+			// paths, so the whole disk is locked while a file is rewrapped.
+			unlock := vd.locks.lock(treeLock("", true))
+			ok, err := b.Rewrap(info.Path)
+			unlock()
+			if err != nil && !isNotExist(err) {
+				return rewritten, err
+			}
+			if ok {
+				rewritten++
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+// ReadFile reads and decrypts a whole file
+func (b *EncryptBackend) ReadFile(path string) ([]byte, error) {
+	reader, err := b.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// WriteFile encrypts a whole file
+func (b *EncryptBackend) WriteFile(path string, data []byte) error {
+	w, err := b.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Open streams a file, decrypting it segment by segment
+func (b *EncryptBackend) Open(path string) (io.ReadCloser, error) {
+	file, err := b.base.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	header, err := envelope.ReadHeader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if header == nil {
+		return &decryptReader{Reader: buffered, file: file}, nil
+	}
+
+	decrypter, err := envelope.NewReader(buffered, header, b.keys)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return &decryptReader{Reader: decrypter, file: file}, nil
+}
+
+// Create streams an encrypted file into the base backend
+func (b *EncryptBackend) Create(path string) (FileWriter, error) {
+	w, err := b.base.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	encrypter, err := envelope.NewWriter(w, b.keys)
+	if err != nil {
+		w.Abort()
+		return nil, fmt.Errorf("failed to encrypt %s: %w", path, err)
+	}
+	return &encryptWriter{FileWriter: w, encrypter: encrypter}, nil
+}
+
+// Delete removes a file
+func (b *EncryptBackend) Delete(path string) error {
+	return b.base.Delete(path)
+}
+
+// Rename moves a file or directory without re-encrypting it
+func (b *EncryptBackend) Rename(oldPath, newPath string) error {
+	return renameWithin(b.base, oldPath, newPath)
+}
+
+// Copy copies the encrypted data; the copy shares the data key of the original
+func (b *EncryptBackend) Copy(srcPath, dstPath string) error {
+	return copyBetween(b.base, srcPath, b.base, dstPath)
+}
+
+// Attrs returns the attributes stored by the base backend. Attributes are
+// metadata and are not encrypted.
+func (b *EncryptBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	return attrsOf(b.base, path)
+}
+
+// SetAttrs stores attributes in the base backend
+func (b *EncryptBackend) SetAttrs(path string, attrs map[string]string) error {
+	return setAttrs(b.base, path, attrs)
+}
+
+// Mkdir creates a directory
+func (b *EncryptBackend) Mkdir(path string) error {
+	return b.base.Mkdir(path)
+}
+
+// Stat returns information about a file with its plaintext size
+func (b *EncryptBackend) Stat(path string) (FileInfo, error) {
+	info, err := b.base.Stat(path)
+	if err != nil || info.IsDir {
+		return info, err
+	}
+	return b.withPlainSize(info)
+}
+
+// List lists files with their plaintext sizes
+func (b *EncryptBackend) List(prefix string) ([]FileInfo, error) {
+	infos, err := b.base.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		if infos[i], err = b.withPlainSize(info); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// withPlainSize replaces the stored size of a file with its plaintext size
+func (b *EncryptBackend) withPlainSize(info FileInfo) (FileInfo, error) {
+	header, err := b.header(info.Path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if header != nil {
+		info.Size = header.PlainSize(info.Size)
+	}
+	return info, nil
+}
+
+// header reads the encryption header of a file, or returns nil if it is not encrypted
+func (b *EncryptBackend) header(path string) (*envelope.Header, error) {
+	file, err := b.base.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header, err := envelope.ReadHeader(bufio.NewReaderSize(file, 512))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return header, nil
+}
+
+// Rewrap wraps the data key of a file with the current master key. Only the
+// header changes; the content is copied as it is. Files that are not
+// encrypted yet are encrypted. It reports whether the file was rewritten.
+func (b *EncryptBackend) Rewrap(path string) (bool, error) {
+	file, err := b.base.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	header, err := envelope.ReadHeader(buffered)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if header != nil && header.KeyID == b.keys.Current() {
+		return false, nil
+	}
+
+	info, err := b.base.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	attrs, _, err := attrsOf(b.base, path)
+	if err != nil {
+		return false, err
+	}
+
+	if header == nil {
+		w, err := b.Create(path)
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.Copy(w, buffered); err != nil {
+			w.Abort()
+			return false, fmt.Errorf("failed to encrypt %s: %w", path, err)
+		}
+		if err := w.Close(); err != nil {
+			return false, err
+		}
+	} else {
+		rewrapped, err := header.Rewrap(b.keys)
+		if err != nil {
+			return false, fmt.Errorf("failed to rewrap %s: %w", path, err)
+		}
+		size := info.Size - int64(header.Size()) + int64(rewrapped.Size())
+		r := io.MultiReader(bytes.NewReader(rewrapped.Bytes()), buffered)
+		if err := copyTo(b.base, path, r, size); err != nil {
+			return false, err
+		}
+	}
+
+	// Rewriting a file may drop attributes kept with it, as in S3 metadata
+	if len(attrs) > 0 {
+		if err := setAttrs(b.base, path, attrs); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// decryptReader closes the stored file once the decrypted stream is done with
+type decryptReader struct {
+	io.Reader
+	file io.Closer
+}
+
+func (r *decryptReader) Close() error {
+	return r.file.Close()
+}
+
+// encryptWriter encrypts data on its way to a base backend writer
+type encryptWriter struct {
+	FileWriter
+	encrypter *envelope.Writer
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	return w.encrypter.Write(p)
+}
+
+// Close seals the last segment and commits the file
+func (w *encryptWriter) Close() error {
+	if err := w.encrypter.Close(); err != nil {
+		w.FileWriter.Abort()
+		return fmt.Errorf("failed to encrypt file: %w", err)
+	}
+	return w.FileWriter.Close()
+}
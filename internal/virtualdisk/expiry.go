@@ -0,0 +1,529 @@
+package virtualdisk
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+	"github.com/vikasavn/virtual_disk_go/internal/journal"
+)
+
+// expiryRetryInterval is how long to wait before trying again to delete an
+// expired file that could not be deleted
+const expiryRetryInterval = time.Minute
+
+// WriteOptions are optional settings for a file being written. Operations
+// that change files without writing them, such as deletes and renames, take
+// them for LockToken only.
+type WriteOptions struct {
+	// ExpiresAt deletes the file at this time
+	ExpiresAt time.Time
+	// TTL deletes the file this long after it is written; ExpiresAt takes
+	// precedence
+	TTL time.Duration
+	// LockToken is the token of the exclusive lease held on the file, which
+	// is required to change it while it is locked; see VirtualDisk.Lock
+	LockToken string
+}
+
+// expiry returns when the options say the file should be deleted, or the
+// zero time if they don't
+func (o WriteOptions) expiry() time.Time {
+	if !o.ExpiresAt.IsZero() {
+		return o.ExpiresAt
+	}
+	if o.TTL > 0 {
+		return time.Now().Add(o.TTL)
+	}
+	return time.Time{}
+}
+
+// expiryEntry is a file due to be deleted at a point in time
+type expiryEntry struct {
+	path  string
+	at    time.Time
+	auto  bool // set from Config.TempTTL and pushed back whenever the file changes
+	index int  // position in the heap
+}
+
+// expiryHeap orders entries by expiry time, earliest first
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// expiryCompactRecords is how many changes the expiry log holds at least
+// before it is folded into the snapshot
+const expiryCompactRecords = 1024
+
+// expiryIndex keeps the files that expire in a heap ordered by expiry time,
+// so the next one due is found without scanning. The expiry times of files
+// for which saved returns true survive restarts: changes to them are
+// appended to a log, which is folded into a snapshot file once it has grown
+// to the size of the index.
+type expiryIndex struct {
+	entries map[string]*expiryEntry
+	heap    expiryHeap
+	file    string           // snapshot of the saved expiry times
+	log     *journal.Journal // changes to the saved expiry times since the snapshot
+	logged  int              // records in the log
+	saved   func(path string) bool
+	wake    chan struct{}
+	mu      sync.Mutex
+}
+
+// openExpiryIndex loads the expiry times saved in file and the changes to
+// them in logFile
+func openExpiryIndex(file, logFile string, saved func(path string) bool) (*expiryIndex, error) {
+	x := &expiryIndex{
+		entries: make(map[string]*expiryEntry),
+		file:    file,
+		saved:   saved,
+		wake:    make(chan struct{}, 1),
+	}
+
+	times := make(map[string]time.Time)
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read expiry index: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &times); err != nil {
+			return nil, fmt.Errorf("failed to parse expiry index: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create expiry index directory: %w", err)
+	}
+	x.log, err = journal.Open(logFile)
+	if err != nil {
+		return nil, err
+	}
+	err = x.log.Replay(func(rec journal.Record) error {
+		x.logged++
+		if rec.Op == journal.OpDelete {
+			delete(times, rec.Path)
+			return nil
+		}
+		var at time.Time
+		if err := at.UnmarshalBinary(rec.Data); err != nil {
+			return fmt.Errorf("failed to parse expiry index: %w", err)
+		}
+		times[rec.Path] = at
+		return nil
+	})
+	if err != nil {
+		x.log.Close()
+		return nil, err
+	}
+
+	for path, at := range times {
+		entry := &expiryEntry{path: path, at: at}
+		x.entries[path] = entry
+		heap.Push(&x.heap, entry)
+	}
+	if x.logged > 0 {
+		if err := x.compact(); err != nil {
+			x.log.Close()
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// close closes the log
+func (x *expiryIndex) close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.log.Close()
+}
+
+// isSaved reports whether the expiry time of an entry survives restarts
+func (x *expiryIndex) isSaved(entry *expiryEntry) bool {
+	return !entry.auto && x.saved(entry.path)
+}
+
+// compact writes the saved expiry times to the snapshot and empties the log.
+// x.mu must be held.
+func (x *expiryIndex) compact() error {
+	times := make(map[string]time.Time)
+	for _, entry := range x.entries {
+		if x.isSaved(entry) {
+			times[entry.path] = entry.at
+		}
+	}
+	data, err := json.Marshal(times)
+	if err != nil {
+		return fmt.Errorf("failed to encode expiry index: %w", err)
+	}
+	if err := writeFileAtomic(x.file, data); err != nil {
+		return fmt.Errorf("failed to write expiry index: %w", err)
+	}
+	if err := x.log.Truncate(); err != nil {
+		return err
+	}
+	x.logged = 0
+	return nil
+}
+
+// record appends changes to saved expiry times to the log, compacting it
+// once it has grown to the size of the index. x.mu must be held.
+func (x *expiryIndex) record(records []journal.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := x.log.Append(records...); err != nil {
+		return fmt.Errorf("failed to write expiry index: %w", err)
+	}
+	x.logged += len(records)
+	if x.logged >= expiryCompactRecords && x.logged >= len(x.entries) {
+		return x.compact()
+	}
+	return nil
+}
+
+// savedRecord returns the log record for the expiry time of an entry
+func savedRecord(entry *expiryEntry) journal.Record {
+	data, _ := entry.at.MarshalBinary()
+	return journal.Record{Op: journal.OpWrite, Path: entry.path, Data: data}
+}
+
+// set schedules a file to expire at a point in time
+func (x *expiryIndex) set(path string, at time.Time, auto bool) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	wasSaved := false
+	entry, ok := x.entries[path]
+	if ok {
+		wasSaved = x.isSaved(entry)
+		entry.at = at
+		entry.auto = auto
+		heap.Fix(&x.heap, entry.index)
+	} else {
+		entry = &expiryEntry{path: path, at: at, auto: auto}
+		x.entries[path] = entry
+		heap.Push(&x.heap, entry)
+	}
+
+	// Let the expiry loop know if this is now the next file due
+	if x.heap[0].path == path {
+		select {
+		case x.wake <- struct{}{}:
+		default:
+		}
+	}
+	switch {
+	case x.isSaved(entry):
+		return x.record([]journal.Record{savedRecord(entry)})
+	case wasSaved:
+		return x.record([]journal.Record{{Op: journal.OpDelete, Path: path}})
+	}
+	return nil
+}
+
+// get returns the expiry of a file
+func (x *expiryIndex) get(path string) (expiryEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	entry, ok := x.entries[path]
+	if !ok {
+		return expiryEntry{}, false
+	}
+	return *entry, true
+}
+
+// next returns the file due to expire first
+func (x *expiryIndex) next() (expiryEntry, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.heap) == 0 {
+		return expiryEntry{}, false
+	}
+	return *x.heap[0], true
+}
+
+// below returns the entries at path, and with isDir those of every file
+// below it; only directories need a scan of the index. x.mu must be held.
+func (x *expiryIndex) below(path string, isDir bool) []*expiryEntry {
+	if !isDir {
+		if entry, ok := x.entries[path]; ok {
+			return []*expiryEntry{entry}
+		}
+		return nil
+	}
+	var entries []*expiryEntry
+	for entryPath, entry := range x.entries {
+		if within(entryPath, path) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// forget unschedules a file, or with isDir every file below a directory
+func (x *expiryIndex) forget(path string, isDir bool) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var records []journal.Record
+	for _, entry := range x.below(path, isDir) {
+		heap.Remove(&x.heap, entry.index)
+		delete(x.entries, entry.path)
+		if x.isSaved(entry) {
+			records = append(records, journal.Record{Op: journal.OpDelete, Path: entry.path})
+		}
+	}
+	return x.record(records)
+}
+
+// move carries the expiry of a file, or with isDir of every file below a
+// directory, over to a new path
+func (x *expiryIndex) move(oldPath, newPath string, isDir bool) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var records []journal.Record
+	for _, entry := range x.below(oldPath, isDir) {
+		if x.isSaved(entry) {
+			records = append(records, journal.Record{Op: journal.OpDelete, Path: entry.path})
+		}
+		delete(x.entries, entry.path)
+		entry.path = newPath + strings.TrimPrefix(entry.path, oldPath)
+		if old, ok := x.entries[entry.path]; ok {
+			heap.Remove(&x.heap, old.index)
+			if x.isSaved(old) && !x.isSaved(entry) {
+				records = append(records, journal.Record{Op: journal.OpDelete, Path: old.path})
+			}
+		}
+		x.entries[entry.path] = entry
+		if x.isSaved(entry) {
+			records = append(records, savedRecord(entry))
+		}
+	}
+	return x.record(records)
+}
+
+// expiresAt returns when a file expires, or nil if it doesn't
+func (vd *VirtualDisk) expiresAt(path string) *time.Time {
+	entry, ok := vd.expiry.get(path)
+	if !ok {
+		return nil
+	}
+	return &entry.at
+}
+
+// setExpiry schedules a file to expire, or applies the temp TTL if at is
+// zero. The file must be locked exclusively.
+func (vd *VirtualDisk) setExpiry(path string, at time.Time) error {
+	if at.IsZero() {
+		if err := vd.expiry.forget(path, false); err != nil {
+			return err
+		}
+		return vd.applyTempTTL(path, false)
+	}
+	return vd.expiry.set(path, at, false)
+}
+
+// applyTempTTL schedules temp files at or below path to expire once they
+// have not been written for Config.TempTTL. Expiry times set explicitly are
+// kept. The paths must be locked exclusively.
+func (vd *VirtualDisk) applyTempTTL(path string, isDir bool) error {
+	if vd.tempTTL <= 0 || vd.getStorageType(path) != StorageTemp {
+		return nil
+	}
+
+	paths := []string{path}
+	if isDir {
+		items, err := vd.listItems(path + "/")
+		if err != nil {
+			return fmt.Errorf("failed to list directory: %w", err)
+		}
+		paths = paths[:0]
+		for itemPath, info := range items {
+			if !info.IsDir {
+				paths = append(paths, itemPath)
+			}
+		}
+	}
+
+	at := time.Now().Add(vd.tempTTL)
+	for _, p := range paths {
+		if entry, ok := vd.expiry.get(p); ok && !entry.auto {
+			continue
+		}
+		if err := vd.expiry.set(p, at, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackExpiry keeps expiry times with their files as they change. Like every
+// event handler it runs with the paths of the event locked.
+func (vd *VirtualDisk) trackExpiry(event events.Event) error {
+	switch event.Type {
+	case events.EventFileDeleted:
+		isDir, _ := event.Metadata["is_dir"].(bool)
+		return vd.expiry.forget(event.Path, isDir)
+	case events.EventFileRenamed:
+		// The moved files replace whatever was at the new path
+		oldPath, _ := event.Metadata["old_path"].(string)
+		isDir, _ := event.Metadata["is_dir"].(bool)
+		if err := vd.expiry.forget(event.Path, isDir); err != nil {
+			return err
+		}
+		if err := vd.expiry.move(oldPath, event.Path, isDir); err != nil {
+			return err
+		}
+		return vd.applyTempTTL(event.Path, isDir)
+	}
+	return vd.applyTempTTL(event.Path, false)
+}
+
+// runExpiry deletes files as they expire
+func (vd *VirtualDisk) runExpiry() {
+	defer vd.wg.Done()
+
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if entry, ok := vd.expiry.next(); ok {
+			wait := time.Until(entry.at)
+			if wait <= 0 {
+				unlock := vd.locks.lock(fileLock(entry.path, true))
+				err := vd.expireFile(entry.path)
+				unlock()
+				if err == nil {
+					continue
+				}
+				fmt.Printf("failed to expire %s: %v\n", entry.path, err)
+				if err := vd.expiry.set(entry.path, time.Now().Add(expiryRetryInterval), entry.auto); err != nil {
+					fmt.Printf("failed to expire %s: %v\n", entry.path, err)
+				}
+				continue
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-vd.done:
+		case <-vd.expiry.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-vd.done:
+			return
+		default:
+		}
+	}
+}
+
+// expireFile deletes a file whose expiry time has passed. Persistent files
+// are not moved into the trash. The file must be locked exclusively.
+func (vd *VirtualDisk) expireFile(path string) error {
+	entry, ok := vd.expiry.get(path)
+	if !ok || entry.at.After(time.Now()) {
+		return nil // Changed while waiting for the lock
+	}
+
+	if vd.getStorageType(path) == StoragePersistent {
+		vd.journalMu.RLock()
+		defer vd.journalMu.RUnlock()
+		if err := vd.logOp(journal.Record{Op: journal.OpPurge, Path: path}); err != nil {
+			return err
+		}
+	}
+	vd.dropBuffered(path)
+	if vd.cache != nil {
+		vd.cache.Remove(path)
+	}
+	if err := vd.removeThrough(path); err != nil && !isNotExist(err) {
+		return err
+	}
+	if err := vd.expiry.forget(path, false); err != nil {
+		return err
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileExpired,
+		Path:      path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"expires_at": entry.at,
+		},
+	})
+	return nil
+}
+
+// SetExpiry schedules a file to be deleted at a point in time. A zero time
+// removes the expiry; temp files then expire after Config.TempTTL again.
+func (vd *VirtualDisk) SetExpiry(path string, at time.Time) error {
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	if _, ok := vd.buffered(path); !ok {
+		backend, relPath := vd.resolve(path)
+		info, err := backend.Stat(relPath)
+		if err != nil {
+			return fmt.Errorf("failed to set expiry: %w", err)
+		}
+		if info.IsDir {
+			return fmt.Errorf("failed to set expiry: %s is a directory", path)
+		}
+	}
+
+	if err := vd.setExpiry(path, at); err != nil {
+		return err
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileModified,
+		Path:      path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"expires_at": vd.expiresAt(path),
+		},
+	})
+	return nil
+}
+
+// Expiry returns when a file is due to be deleted, if it expires at all
+func (vd *VirtualDisk) Expiry(path string) (time.Time, bool) {
+	entry, ok := vd.expiry.get(path)
+	return entry.at, ok
+}
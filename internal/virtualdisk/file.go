@@ -0,0 +1,328 @@
+package virtualdisk
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// File is a random-access handle to a file in the virtual disk. It works the
+// same way for every backend: backends that support random access are edited
+// in place, others through an in-memory copy written back on close. Persistent
+// files modified through a handle are mirrored to S3 when the handle is closed.
+type File struct {
+	vd          *VirtualDisk
+	path        string
+	storageType StorageType
+	flag        int
+	lockToken   string // token of the exclusive lease held on the file, if any
+	file        BackendFile
+	reservation *quotaReservation // quota usage held until the handle is closed
+	dirty       bool
+	closed      bool
+	mu          sync.Mutex
+}
+
+// OpenFile opens a file in the virtual disk using the os.O_* flags
+func (vd *VirtualDisk) OpenFile(path string, flag int) (*File, error) {
+	return vd.OpenFileWith(path, flag, WriteOptions{})
+}
+
+// OpenFileWith opens a file in the virtual disk using the os.O_* flags with
+// options. Leases held on the file are checked when a handle that can change
+// it is opened and again before each change made through it.
+func (vd *VirtualDisk) OpenFileWith(path string, flag int, opts WriteOptions) (*File, error) {
+	storageType := vd.getStorageType(path)
+
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := vd.checkLease(path, opts.LockToken); err != nil {
+			return nil, err
+		}
+	}
+
+	// Write back any buffered data so the handle sees the latest contents
+	if storageType == StoragePersistent {
+		if err := vd.flushPath(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Creating a file counts against quotas on the number of files; check
+	// before opening, which creates or truncates the file
+	var reservation *quotaReservation
+	var err error
+	if flag&os.O_CREATE != 0 {
+		if reservation, err = vd.reserveQuota(nil, path, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	backend, relPath := vd.resolve(path)
+	var file BackendFile
+	if opener, ok := backend.(FileOpener); ok {
+		file, err = opener.OpenFile(relPath, flag)
+	} else {
+		file, err = openBuffered(backend, relPath, flag)
+	}
+	if err != nil {
+		vd.releaseQuota(reservation)
+		return nil, err
+	}
+
+	f := &File{
+		vd:          vd,
+		path:        path,
+		storageType: storageType,
+		flag:        flag,
+		lockToken:   opts.LockToken,
+		file:        file,
+		reservation: reservation,
+		dirty:       flag&os.O_TRUNC != 0,
+	}
+
+	if vd.cache != nil {
+		vd.cache.Remove(path)
+	}
+	return f, nil
+}
+
+// openBuffered loads a file from a backend without random access into memory;
+// the copy is written back when the handle is closed
+func openBuffered(backend Backend, path string, flag int) (BackendFile, error) {
+	data, err := backend.ReadFile(path)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, fmt.Errorf("failed to open file: %w", &fs.PathError{Op: "open", Path: path, Err: fs.ErrExist})
+	case err != nil && (!isNotExist(err) || flag&os.O_CREATE == 0):
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		data = nil
+	} else {
+		// Work on a private copy so readers of the original never see partial edits
+		data = append([]byte(nil), data...)
+	}
+
+	file := newBufferedFile(path, data, flag, func(data []byte) error {
+		return backend.WriteFile(path, data)
+	})
+	file.dirty = err != nil || flag&os.O_TRUNC != 0
+	return file, nil
+}
+
+// Name returns the virtual path of the file
+func (f *File) Name() string {
+	return f.path
+}
+
+// Read reads from the current offset
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkReadable(); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+// ReadAt reads len(p) bytes starting at offset off
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkReadable(); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+// Write writes at the current offset, or at the end of the file with O_APPEND
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unlock := f.vd.locks.lock(fileLock(f.path, true))
+	defer unlock()
+
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		offset = -1
+	}
+	if err := f.checkGrowth(offset, int64(len(p))); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.file.Write(p)
+}
+
+// WriteAt writes len(p) bytes starting at offset off, growing the file if needed
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unlock := f.vd.locks.lock(fileLock(f.path, true))
+	defer unlock()
+
+	if err := f.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := f.checkGrowth(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.file.WriteAt(p, off)
+}
+
+// Seek sets the offset for the next Read or Write
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	return f.file.Seek(offset, whence)
+}
+
+// Truncate changes the size of the file
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unlock := f.vd.locks.lock(fileLock(f.path, true))
+	defer unlock()
+
+	if err := f.checkWritable(); err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("negative size: %d", size)
+	}
+	if err := f.checkGrowth(size, 0); err != nil {
+		return err
+	}
+	f.dirty = true
+	return f.file.Truncate(size)
+}
+
+// Stat returns information about the file
+func (f *File) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	return f.file.Stat()
+}
+
+// Sync commits the file contents to stable storage
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return fs.ErrClosed
+	}
+	return f.file.Sync()
+}
+
+// Close releases the handle. Modified files are written back to their backend.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	defer f.vd.releaseQuota(f.reservation)
+
+	// Closing writes back buffered copies and the mirror copy
+	vd := f.vd
+	unlock := vd.locks.lock(fileLock(f.path, true))
+	defer unlock()
+
+	var size int64
+	if info, err := f.file.Stat(); err == nil {
+		size = info.Size()
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if !f.dirty {
+		return nil
+	}
+
+	if vd.cache != nil {
+		vd.cache.Remove(f.path)
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileModified,
+		Path:      f.path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"size": size,
+		},
+	})
+
+	return nil
+}
+
+// checkGrowth returns ErrQuotaExceeded if writing n bytes at offset, or at
+// the end of the file if offset is -1, would grow the file past a quota, and
+// otherwise reserves the new size until the handle is closed
+func (f *File) checkGrowth(offset, n int64) error {
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		offset = info.Size()
+	}
+	if offset+n <= info.Size() {
+		return nil
+	}
+	reservation, err := f.vd.reserveQuota(f.reservation, f.path, offset+n)
+	if err != nil {
+		return err
+	}
+	f.reservation = reservation
+	return nil
+}
+
+func (f *File) checkReadable() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == os.O_WRONLY {
+		return fmt.Errorf("file %s not opened for reading", f.path)
+	}
+	return nil
+}
+
+func (f *File) checkWritable() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fmt.Errorf("file %s not opened for writing", f.path)
+	}
+	// The file may have been locked since the handle was opened
+	return f.vd.checkLease(f.path, f.lockToken)
+}
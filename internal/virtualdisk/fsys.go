@@ -0,0 +1,371 @@
+package virtualdisk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS returns a read-only view of the virtual disk as an fs.FS. Paths follow
+// the fs.ValidPath rules, so "mem/a.txt" names the memory file a.txt and "."
+// is the root. Storage prefixes and mounts appear as directories, and
+// directory listings merge backends and buffered writes like ListFilesAndDirs.
+// Use fs.Sub to expose only part of the disk.
+func (vd *VirtualDisk) FS() fs.FS {
+	return &diskFS{vd: vd}
+}
+
+// diskFS is a view of the virtual disk rooted at root
+type diskFS struct {
+	vd   *VirtualDisk
+	root string
+}
+
+var (
+	_ fs.ReadDirFS  = (*diskFS)(nil)
+	_ fs.ReadFileFS = (*diskFS)(nil)
+	_ fs.StatFS     = (*diskFS)(nil)
+	_ fs.SubFS      = (*diskFS)(nil)
+)
+
+// Open opens a file or directory
+func (f *diskFS) Open(name string) (fs.File, error) {
+	path, err := f.virtualPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.vd.lookup(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if info.IsDir() {
+		list := func() ([]fs.DirEntry, error) { return f.vd.readDir(path) }
+		return &dirFile{name: name, info: info, list: list}, nil
+	}
+
+	// Serve buffered writes from the buffer rather than forcing a write-back
+	if entry, ok := f.vd.buffered(path); ok {
+		return &bufferedFile{Reader: bytes.NewReader(entry.Data), info: info}, nil
+	}
+
+	file, err := f.vd.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+	return &fsFile{File: file, info: info}, nil
+}
+
+// ReadFile reads a whole file
+func (f *diskFS) ReadFile(name string) ([]byte, error) {
+	path, err := f.virtualPath("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.vd.lookup(path); err == nil && info.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errors.New("is a directory")}
+	}
+
+	data, err := f.vd.ReadFile(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: unwrapPathError(err)}
+	}
+	// Callers may modify the result, so never hand out cached or buffered data
+	return append([]byte(nil), data...), nil
+}
+
+// Stat returns information about a file or directory
+func (f *diskFS) Stat(name string) (fs.FileInfo, error) {
+	path, err := f.virtualPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.vd.lookup(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+// ReadDir lists a directory, sorted by name
+func (f *diskFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	path, err := f.virtualPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.vd.lookup(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries, err := f.vd.readDir(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Sub returns a view of the subtree rooted at dir
+func (f *diskFS) Sub(dir string) (fs.FS, error) {
+	path, err := f.virtualPath("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &diskFS{vd: f.vd, root: path}, nil
+}
+
+// virtualPath maps an fs path onto a virtual disk path
+func (f *diskFS) virtualPath(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	switch {
+	case name == ".":
+		return f.root, nil
+	case f.root == "":
+		return name, nil
+	default:
+		return f.root + "/" + name, nil
+	}
+}
+
+// lookup describes a virtual path without hashing it the way Stat does.
+// Storage prefixes and mount points are directories even when empty.
+func (vd *VirtualDisk) lookup(path string) (*fsFileInfo, error) {
+	if path == "" || vd.isMountAncestor(path) {
+		return &fsFileInfo{FileInfo: FileInfo{Path: path, IsDir: true}}, nil
+	}
+
+	unlock := vd.locks.lock(fileLock(path, false))
+	defer unlock()
+
+	if entry, ok := vd.buffered(path); ok {
+		return &fsFileInfo{FileInfo: FileInfo{
+			Path:    path,
+			Size:    int64(len(entry.Data)),
+			ModTime: entry.Modified,
+		}}, nil
+	}
+
+	backend, relPath := vd.resolve(path)
+	if relPath == metaDirName || strings.HasPrefix(relPath, metaDirName+"/") {
+		return nil, notExist(path) // Internal state is hidden like in listings
+	}
+	info, err := backend.Stat(relPath)
+	if err == nil {
+		info.Path = path
+		return &fsFileInfo{FileInfo: info}, nil
+	}
+	if isDir, dirErr := statTree(backend, relPath); dirErr == nil && isDir {
+		return &fsFileInfo{FileInfo: FileInfo{Path: path, IsDir: true}}, nil
+	}
+	if vd.hasBufferedBelow(path) {
+		return &fsFileInfo{FileInfo: FileInfo{Path: path, IsDir: true}}, nil
+	}
+	return nil, err
+}
+
+// readDir lists the direct children of a directory. Files deeper down make
+// their top-level directory appear even in backends without directories.
+func (vd *VirtualDisk) readDir(path string) ([]fs.DirEntry, error) {
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+
+	vd.txMu.RLock()
+	items, err := vd.listItems(prefix)
+	vd.txMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string]*fsFileInfo)
+	for itemPath, info := range items {
+		rest := strings.TrimPrefix(itemPath, prefix)
+		if rest == "" {
+			continue
+		}
+		if name, _, nested := strings.Cut(rest, "/"); nested {
+			if _, ok := children[name]; !ok {
+				children[name] = &fsFileInfo{FileInfo: FileInfo{Path: prefix + name, IsDir: true}}
+			}
+			continue
+		}
+		info.Path = itemPath
+		children[rest] = &fsFileInfo{FileInfo: info}
+	}
+
+	// Storage prefixes and mount points show up as directories
+	for _, m := range vd.mountList() {
+		rest, ok := strings.CutPrefix(m.prefix, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(rest, "/")
+		if child, ok := children[name]; !ok || !child.IsDir() {
+			children[name] = &fsFileInfo{FileInfo: FileInfo{Path: prefix + name, IsDir: true}}
+		}
+	}
+
+	// Directory entries must agree with Stat, which describes real directories in full
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		if child.IsDir() && child.ModTime().IsZero() {
+			if info, err := vd.lookup(child.Path); err == nil {
+				child = info
+			}
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(child))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// isMountAncestor reports whether path is a mount point or contains one
+func (vd *VirtualDisk) isMountAncestor(path string) bool {
+	for _, m := range vd.mountList() {
+		if strings.HasPrefix(m.prefix, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBufferedBelow reports whether buffered files exist under a directory
+func (vd *VirtualDisk) hasBufferedBelow(path string) bool {
+	vd.mu.RLock()
+	defer vd.mu.RUnlock()
+
+	for bufferedPath := range vd.buffer {
+		if strings.HasPrefix(bufferedPath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unwrapPathError strips PathErrors so fs errors carry the caller's name
+func unwrapPathError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// fsFileInfo adapts FileInfo to fs.FileInfo
+type fsFileInfo struct {
+	FileInfo
+}
+
+func (fi *fsFileInfo) Name() string {
+	if fi.Path == "" {
+		return "."
+	}
+	return pathpkg.Base(fi.Path)
+}
+
+func (fi *fsFileInfo) Size() int64 { return fi.FileInfo.Size }
+
+func (fi *fsFileInfo) Mode() fs.FileMode {
+	switch {
+	case fi.FileInfo.Mode != 0:
+		return fi.FileInfo.Mode
+	case fi.FileInfo.IsDir:
+		return fs.ModeDir | 0755
+	default:
+		return 0644
+	}
+}
+
+func (fi *fsFileInfo) ModTime() time.Time {
+	if fi.FileInfo.ModTime.IsZero() && fi.Modified != "" {
+		modTime, _ := time.Parse(time.RFC3339, fi.Modified)
+		return modTime
+	}
+	return fi.FileInfo.ModTime
+}
+
+func (fi *fsFileInfo) IsDir() bool      { return fi.FileInfo.IsDir }
+func (fi *fsFileInfo) Sys() interface{} { return nil }
+
+// fsFile is an open file in a diskFS
+type fsFile struct {
+	*File
+	info fs.FileInfo
+}
+
+// Stat describes the file as it was when it was opened
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// bufferedFile is an open diskFS file that has not been written back yet
+type bufferedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *bufferedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *bufferedFile) Close() error {
+	return nil
+}
+
+// dirFile is an open directory in a diskFS
+type dirFile struct {
+	name    string
+	info    fs.FileInfo
+	list    func() ([]fs.DirEntry, error)
+	entries []fs.DirEntry // loaded on the first ReadDir
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries, or all remaining ones if n <= 0
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		entries, err := d.list()
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		d.entries = entries
+	}
+
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
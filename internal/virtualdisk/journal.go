@@ -0,0 +1,213 @@
+package virtualdisk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/vikasavn/virtual_disk_go/internal/envelope"
+	"github.com/vikasavn/virtual_disk_go/internal/journal"
+)
+
+// metaDirName is the directory under the data partition that holds internal
+// state. It is hidden from listings.
+const metaDirName = ".virtualdisk"
+
+// journalMaxSize forces a full flush and checkpoint once the journal grows past it
+const journalMaxSize = 64 * 1024 * 1024
+
+// metaPath returns a path inside the internal state directory
+func (vd *VirtualDisk) metaPath(elem ...string) string {
+	return filepath.Join(append([]string{vd.dataPartition, metaDirName}, elem...)...)
+}
+
+// openJournal opens the write-ahead journal and replays anything left over
+// from a previous run that did not shut down cleanly
+func (vd *VirtualDisk) openJournal() error {
+	if err := os.MkdirAll(vd.metaPath(), 0755); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	j, err := journal.Open(vd.metaPath("journal.log"))
+	if err != nil {
+		return err
+	}
+
+	if err := vd.replayJournal(j); err != nil {
+		j.Close()
+		return fmt.Errorf("failed to replay journal: %w", err)
+	}
+	if err := j.Truncate(); err != nil {
+		j.Close()
+		return err
+	}
+
+	vd.journal = j
+	return nil
+}
+
+// replayJournal applies journaled operations to storage. Only the last write
+// or delete of each path is applied; earlier ones are superseded by it, and a
+// checkpoint means the path on disk is already up to date.
+func (vd *VirtualDisk) replayJournal(j *journal.Journal) error {
+	var records []journal.Record
+	last := make(map[string]int)
+	err := j.Replay(func(rec journal.Record) error {
+		if rec.Op != journal.OpMkdir && rec.Op != journal.OpRmdir {
+			last[rec.Path] = len(records)
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, rec := range records {
+		switch rec.Op {
+		case journal.OpMkdir:
+			if err := vd.persistent.Mkdir(rec.Path); err != nil {
+				return err
+			}
+		case journal.OpWrite:
+			if last[rec.Path] != i {
+				continue
+			}
+			data, err := vd.openData(rec.Data)
+			if err != nil {
+				return err
+			}
+			if err := vd.persistent.WriteFile(rec.Path, data); err != nil {
+				return err
+			}
+		case journal.OpDelete:
+			if last[rec.Path] != i {
+				continue
+			}
+			if _, err := vd.trashFile(rec.Path); err != nil {
+				return err
+			}
+		case journal.OpPurge:
+			if last[rec.Path] != i {
+				continue
+			}
+			if err := vd.persistent.Delete(rec.Path); err != nil && !isNotExist(err) {
+				return err
+			}
+		case journal.OpRmdir:
+			// Best effort: the directory may have been filled again since
+			vd.persistent.Delete(rec.Path)
+		}
+	}
+	return nil
+}
+
+// logOp records operations on persistent paths before they are applied.
+// Unless they are applied with journalMu read-locked, the journal may be
+// truncated before they are.
+func (vd *VirtualDisk) logOp(records ...journal.Record) error {
+	if vd.journal == nil || len(records) == 0 {
+		return nil
+	}
+	records, err := vd.sealRecords(records)
+	if err != nil {
+		return err
+	}
+	return vd.journal.Append(records...)
+}
+
+// sealRecords encrypts the data of records if encryption is enabled, so the
+// journals hold no plaintext of files
+func (vd *VirtualDisk) sealRecords(records []journal.Record) ([]journal.Record, error) {
+	if vd.keys == nil {
+		return records, nil
+	}
+	sealed := make([]journal.Record, len(records))
+	for i, rec := range records {
+		sealed[i] = rec
+		if len(rec.Data) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		w, err := envelope.NewWriter(&buf, vd.keys)
+		if err == nil {
+			_, err = w.Write(rec.Data)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt journal record: %w", err)
+		}
+		sealed[i].Data = buf.Bytes()
+	}
+	return sealed, nil
+}
+
+// openData decrypts the data of a record sealed by sealRecords. Data logged
+// before encryption was enabled is returned as it is.
+func (vd *VirtualDisk) openData(data []byte) ([]byte, error) {
+	if vd.keys == nil {
+		return data, nil
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	header, err := envelope.ReadHeader(r)
+	if err != nil || header == nil {
+		return data, err
+	}
+	decrypter, err := envelope.NewReader(r, header, vd.keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt journal record: %w", err)
+	}
+	data, err = io.ReadAll(decrypter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt journal record: %w", err)
+	}
+	return data, nil
+}
+
+// logCheckpoint records that the given paths are up to date on disk, so
+// earlier journal records for them must not be replayed
+func (vd *VirtualDisk) logCheckpoint(paths ...string) error {
+	records := make([]journal.Record, 0, len(paths))
+	for _, path := range paths {
+		records = append(records, journal.Record{Op: journal.OpCheckpoint, Path: path})
+	}
+	return vd.logOp(records...)
+}
+
+// settleJournal truncates the journal when everything is on disk, otherwise
+// it checkpoints the flushed paths that have not been written again since.
+// Writing back syncs each file and its directory, so the flushed paths are
+// durable by the time their records are dropped.
+func (vd *VirtualDisk) settleJournal(flushed []string) error {
+	if vd.journal == nil {
+		return nil
+	}
+
+	// Hold off journaled writes so none is lost to the truncation or
+	// shadowed by a checkpoint
+	vd.journalMu.Lock()
+	defer vd.journalMu.Unlock()
+
+	vd.mu.RLock()
+	dirty := false
+	for _, entry := range vd.buffer {
+		dirty = dirty || entry.Dirty
+	}
+	var checkpoints []string
+	for _, path := range flushed {
+		if entry, ok := vd.buffer[path]; !ok || !entry.Dirty {
+			checkpoints = append(checkpoints, path)
+		}
+	}
+	vd.mu.RUnlock()
+
+	if !dirty {
+		return vd.journal.Truncate()
+	}
+	return vd.logCheckpoint(checkpoints...)
+}
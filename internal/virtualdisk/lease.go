@@ -0,0 +1,274 @@
+package virtualdisk
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLocked is returned when a lease or a write conflicts with a lease held
+// on the file
+var ErrLocked = errors.New("file is locked")
+
+// ErrLeaseNotFound is returned for a lease token that is unknown or expired
+var ErrLeaseNotFound = errors.New("lease not found or expired")
+
+// LockMode is the kind of lease held on a file
+type LockMode string
+
+// Lock modes accepted by Lock
+const (
+	LockShared    LockMode = "shared"    // Any number of holders; nobody may write
+	LockExclusive LockMode = "exclusive" // A single holder, the only one who may write
+)
+
+// Lease is an advisory lock on a file held by a client until it is released
+// or expires
+type Lease struct {
+	Token     string    `json:"token,omitempty"`
+	Path      string    `json:"path"`
+	Mode      LockMode  `json:"mode"`
+	Acquired  time.Time `json:"acquired"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// expired reports whether the lease has run out at a point in time
+func (l *Lease) expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+// leaseTable keeps the leases held on files. Expired leases are dropped when
+// they are next looked at. Leases are kept in memory only and do not survive a
+// restart.
+type leaseTable struct {
+	byToken map[string]*Lease
+	byPath  map[string][]*Lease
+	mu      sync.Mutex
+}
+
+// newLeaseTable creates a table without leases
+func newLeaseTable() *leaseTable {
+	return &leaseTable{
+		byToken: make(map[string]*Lease),
+		byPath:  make(map[string][]*Lease),
+	}
+}
+
+// active returns the leases on a path that have not expired, dropping the
+// others. t.mu must be held.
+func (t *leaseTable) active(path string, now time.Time) []*Lease {
+	leases := t.byPath[path]
+	kept := leases[:0]
+	for _, lease := range leases {
+		if lease.expired(now) {
+			delete(t.byToken, lease.Token)
+		} else {
+			kept = append(kept, lease)
+		}
+	}
+	if len(kept) == 0 {
+		delete(t.byPath, path)
+		return nil
+	}
+	t.byPath[path] = kept
+	return kept
+}
+
+// prune drops every expired lease. t.mu must be held.
+func (t *leaseTable) prune(now time.Time) {
+	for path := range t.byPath {
+		t.active(path, now)
+	}
+}
+
+// lookup returns the lease with a token if it has not expired. t.mu must be
+// held.
+func (t *leaseTable) lookup(token string, now time.Time) (*Lease, error) {
+	lease, ok := t.byToken[token]
+	if !ok || lease.expired(now) {
+		return nil, ErrLeaseNotFound
+	}
+	return lease, nil
+}
+
+// remove drops a lease. t.mu must be held.
+func (t *leaseTable) remove(lease *Lease) {
+	delete(t.byToken, lease.Token)
+	leases := t.byPath[lease.Path]
+	for i, l := range leases {
+		if l == lease {
+			leases = append(leases[:i], leases[i+1:]...)
+			break
+		}
+	}
+	if len(leases) == 0 {
+		delete(t.byPath, lease.Path)
+	} else {
+		t.byPath[lease.Path] = leases
+	}
+}
+
+// newLeaseToken returns a random token that identifies a lease
+func newLeaseToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate lease token: %w", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// Lock takes an advisory lease on a file for ttl and returns it. The file
+// does not have to exist. It fails with ErrLocked instead of waiting if
+// another client holds a conflicting lease. While leases are held on a
+// file, only the holder of an exclusive lease can write, delete, rename,
+// copy onto or restore it, by passing its token in WriteOptions.LockToken or
+// to Tx.UseLease; directories cannot be moved or removed while files below
+// them are leased. Attributes and expiry times are not covered.
+func (vd *VirtualDisk) Lock(path string, mode LockMode, ttl time.Duration) (Lease, error) {
+	if mode != LockShared && mode != LockExclusive {
+		return Lease{}, fmt.Errorf("unknown lock mode: %s", mode)
+	}
+	if ttl <= 0 {
+		return Lease{}, fmt.Errorf("lease ttl must be positive")
+	}
+	token, err := newLeaseToken()
+	if err != nil {
+		return Lease{}, err
+	}
+
+	// Wait for writes in progress so they don't finish under the new lease
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	t := vd.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+	for _, held := range t.active(path, now) {
+		if mode == LockExclusive || held.Mode == LockExclusive {
+			return Lease{}, fmt.Errorf("failed to lock %s: %w", path, ErrLocked)
+		}
+	}
+
+	lease := &Lease{
+		Token:     token,
+		Path:      path,
+		Mode:      mode,
+		Acquired:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+	t.byToken[token] = lease
+	t.byPath[path] = append(t.byPath[path], lease)
+	return *lease, nil
+}
+
+// RenewLock extends a lease to expire ttl from now
+func (vd *VirtualDisk) RenewLock(token string, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 {
+		return Lease{}, fmt.Errorf("lease ttl must be positive")
+	}
+
+	t := vd.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	lease, err := t.lookup(token, now)
+	if err != nil {
+		return Lease{}, fmt.Errorf("failed to renew lease: %w", err)
+	}
+	lease.ExpiresAt = now.Add(ttl)
+	return *lease, nil
+}
+
+// Unlock releases a lease
+func (vd *VirtualDisk) Unlock(token string) error {
+	t := vd.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lease, err := t.lookup(token, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to release lease: %w", err)
+	}
+	t.remove(lease)
+	return nil
+}
+
+// Leases returns the leases held on files at or below path, or on every
+// file if path is empty
+func (vd *VirtualDisk) Leases(path string) []Lease {
+	t := vd.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+	var leases []Lease
+	for leasePath, held := range t.byPath {
+		if path != "" && leasePath != path && !within(leasePath, path+"/") {
+			continue
+		}
+		for _, lease := range held {
+			leases = append(leases, *lease)
+		}
+	}
+	return leases
+}
+
+// checkLease returns an error if a write with token is not allowed by the
+// leases held on path; see checkLeases
+func (vd *VirtualDisk) checkLease(path, token string) error {
+	return vd.checkLeases([]string{token}, path)
+}
+
+// checkLeases returns an error if changing paths, along with everything below
+// them, is not allowed by the leases held on files with tokens: with any
+// lease held on a file, only the holder of the exclusive one may change it.
+// A token that is unknown, expired or for a file that is not changed is
+// rejected even if nothing is locked. The paths must be locked.
+func (vd *VirtualDisk) checkLeases(tokens []string, paths ...string) error {
+	t := vd.leases
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	covered := func(leasePath string) bool {
+		for _, path := range paths {
+			if within(leasePath, path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	now := time.Now()
+	allowed := make(map[string]bool)
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		lease, err := t.lookup(token, now)
+		if err == nil && !covered(lease.Path) {
+			err = ErrLeaseNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to change %s: %w", strings.Join(paths, ", "), err)
+		}
+		if lease.Mode != LockExclusive {
+			return fmt.Errorf("failed to change %s: a shared lease does not allow writing: %w", lease.Path, ErrLocked)
+		}
+		allowed[lease.Path] = true
+	}
+	for leasePath := range t.byPath {
+		if covered(leasePath) && !allowed[leasePath] && len(t.active(leasePath, now)) > 0 {
+			return fmt.Errorf("failed to change %s: %w", leasePath, ErrLocked)
+		}
+	}
+	return nil
+}
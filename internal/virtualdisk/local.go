@@ -0,0 +1,505 @@
+package virtualdisk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalBackend stores files in a directory on the local filesystem.
+// User-defined attributes are kept in a database under the internal state
+// directory, since extended attributes are not available on every filesystem.
+type LocalBackend struct {
+	root    string
+	attrs   map[string]*attrRecord // loaded on first use
+	attrsMu sync.Mutex
+}
+
+// attrRecord holds the user-defined attributes of one file
+type attrRecord struct {
+	Values  map[string]string `json:"values"`
+	Changed time.Time         `json:"changed"`
+}
+
+// NewLocalBackend creates a backend rooted at the given directory
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{root: root}
+}
+
+// Root returns the directory the backend stores files in
+func (b *LocalBackend) Root() string {
+	return b.root
+}
+
+// fullPath returns the filesystem path for a backend path
+func (b *LocalBackend) fullPath(path string) string {
+	return filepath.Join(b.root, filepath.FromSlash(path))
+}
+
+// ReadFile reads a whole file
+func (b *LocalBackend) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(b.fullPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return data, nil
+}
+
+// WriteFile writes a whole file, creating parent directories as needed. The
+// file is synced to disk before it returns.
+func (b *LocalBackend) WriteFile(path string, data []byte) error {
+	fullPath := b.fullPath(path)
+	if err := mkdirAll(filepath.Dir(fullPath)); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(fullPath))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// Open opens a file for streaming reads
+func (b *LocalBackend) Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(b.fullPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return file, nil
+}
+
+// Create streams a file through a staging file next to the target, which is
+// renamed into place on close
+func (b *LocalBackend) Create(path string) (FileWriter, error) {
+	fullPath := b.fullPath(path)
+	dir := filepath.Dir(fullPath)
+	if err := mkdirAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	staging, err := os.CreateTemp(dir, "."+filepath.Base(fullPath)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return &localWriter{
+		fullPath: fullPath,
+		file:     staging,
+	}, nil
+}
+
+// Delete removes a file or an empty directory along with its attributes
+func (b *LocalBackend) Delete(path string) error {
+	fullPath := b.fullPath(path)
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	} else if err == nil {
+		if err := syncDir(filepath.Dir(fullPath)); err != nil {
+			return fmt.Errorf("failed to delete file: %w", err)
+		}
+	}
+	return b.updateAttrs(func(attrs map[string]*attrRecord) bool {
+		if _, ok := attrs[path]; !ok {
+			return false
+		}
+		delete(attrs, path)
+		return true
+	})
+}
+
+// Rename moves a file or directory, creating the new parent directory
+func (b *LocalBackend) Rename(oldPath, newPath string) error {
+	oldFullPath := b.fullPath(oldPath)
+	newFullPath := b.fullPath(newPath)
+	if err := mkdirAll(filepath.Dir(newFullPath)); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Rename(oldFullPath, newFullPath); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	// Both directories must be synced for the move to survive a crash
+	if err := syncDir(filepath.Dir(newFullPath)); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	if filepath.Dir(oldFullPath) != filepath.Dir(newFullPath) {
+		if err := syncDir(filepath.Dir(oldFullPath)); err != nil {
+			return fmt.Errorf("failed to sync directory: %w", err)
+		}
+	}
+
+	// Attributes follow the file, or every file under the directory
+	return b.updateAttrs(func(attrs map[string]*attrRecord) bool {
+		moved := make(map[string]*attrRecord)
+		changed := false
+		for path, record := range attrs {
+			switch {
+			case path == oldPath:
+				moved[newPath] = record
+			case strings.HasPrefix(path, oldPath+"/"):
+				moved[newPath+strings.TrimPrefix(path, oldPath)] = record
+			case path == newPath || strings.HasPrefix(path, newPath+"/"):
+				// Replaced by the renamed file
+			default:
+				continue
+			}
+			delete(attrs, path)
+			changed = true
+		}
+		for path, record := range moved {
+			attrs[path] = record
+		}
+		return changed
+	})
+}
+
+// Copy copies a file inside the backend without reading it into user space
+func (b *LocalBackend) Copy(srcPath, dstPath string) error {
+	src, err := os.Open(b.fullPath(srcPath))
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+
+	w, err := b.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return copyAttrs(b, srcPath, b, dstPath)
+}
+
+// Attrs returns the user-defined attributes of a file
+func (b *LocalBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	b.attrsMu.Lock()
+	defer b.attrsMu.Unlock()
+
+	if err := b.loadAttrs(); err != nil {
+		return nil, time.Time{}, err
+	}
+	attrs := make(map[string]string)
+	record, ok := b.attrs[path]
+	if !ok {
+		return attrs, time.Time{}, nil
+	}
+	for name, value := range record.Values {
+		attrs[name] = value
+	}
+	return attrs, record.Changed, nil
+}
+
+// SetAttrs replaces the user-defined attributes of a file
+func (b *LocalBackend) SetAttrs(path string, attrs map[string]string) error {
+	if _, err := os.Stat(b.fullPath(path)); err != nil {
+		return fmt.Errorf("failed to set attributes: %w", err)
+	}
+
+	values := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		values[name] = value
+	}
+	return b.updateAttrs(func(records map[string]*attrRecord) bool {
+		if len(values) == 0 {
+			delete(records, path)
+		} else {
+			records[path] = &attrRecord{Values: values, Changed: time.Now()}
+		}
+		return true
+	})
+}
+
+// attrsPath returns the location of the attribute database
+func (b *LocalBackend) attrsPath() string {
+	return filepath.Join(b.root, metaDirName, "attrs.json")
+}
+
+// loadAttrs reads the attribute database on first use. b.attrsMu must be held.
+func (b *LocalBackend) loadAttrs() error {
+	if b.attrs != nil {
+		return nil
+	}
+
+	attrs := make(map[string]*attrRecord)
+	data, err := os.ReadFile(b.attrsPath())
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("failed to read attributes: %w", err)
+	default:
+		if err := json.Unmarshal(data, &attrs); err != nil {
+			return fmt.Errorf("failed to parse attributes: %w", err)
+		}
+	}
+	b.attrs = attrs
+	return nil
+}
+
+// updateAttrs applies fn to the attribute database and saves it if fn reports a change
+func (b *LocalBackend) updateAttrs(fn func(attrs map[string]*attrRecord) bool) error {
+	b.attrsMu.Lock()
+	defer b.attrsMu.Unlock()
+
+	if err := b.loadAttrs(); err != nil {
+		return err
+	}
+	if !fn(b.attrs) {
+		return nil
+	}
+
+	data, err := json.Marshal(b.attrs)
+	if err != nil {
+		return fmt.Errorf("failed to encode attributes: %w", err)
+	}
+
+	// Replace the database atomically so a crash never leaves it half written
+	if err := writeFileAtomic(b.attrsPath(), data); err != nil {
+		return fmt.Errorf("failed to write attributes: %w", err)
+	}
+	return nil
+}
+
+// isStagingName reports whether a file name is that of a staging file made
+// by Create or writeFileAtomic, which is not part of the backend's content
+func isStagingName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-")
+}
+
+// writeFileAtomic replaces a file with data, so a crash leaves either the old
+// or the new content. The new content is synced to disk before it returns.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := mkdirAll(dir); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs a directory, so that files created, renamed or removed in it
+// survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// mkdirAll creates a directory along with any missing parents, syncing the
+// parent of each directory it creates
+func mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := syncDir(filepath.Dir(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mkdir creates a directory and all parent directories
+func (b *LocalBackend) Mkdir(path string) error {
+	if err := mkdirAll(b.fullPath(path)); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return nil
+}
+
+// Stat returns information about a file or directory
+func (b *LocalBackend) Stat(path string) (FileInfo, error) {
+	if isStagingName(filepath.Base(path)) {
+		return FileInfo{}, fmt.Errorf("failed to stat file: %w", notExist(path))
+	}
+	info, err := os.Stat(b.fullPath(path))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return FileInfo{
+		Path:     path,
+		IsDir:    info.IsDir(),
+		Size:     info.Size(),
+		Modified: info.ModTime().Format(time.RFC3339),
+		Mode:     info.Mode(),
+		ModTime:  info.ModTime(),
+	}, nil
+}
+
+// List walks the backend directory, skipping internal state and staging
+// files of writes in progress
+func (b *LocalBackend) List(prefix string) ([]FileInfo, error) {
+	// Only the directory the prefix points into needs to be walked
+	start := b.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = b.fullPath(prefix[:i])
+	}
+
+	var items []FileInfo
+	err := filepath.Walk(start, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == start {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() && info.Name() == metaDirName {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && isStagingName(info.Name()) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+
+		// Skip the root directory
+		if relPath == "." {
+			return nil
+		}
+
+		relPath = filepath.ToSlash(relPath)
+		if strings.HasPrefix(relPath, prefix) {
+			items = append(items, FileInfo{
+				Path:     relPath,
+				IsDir:    info.IsDir(),
+				Size:     info.Size(),
+				Modified: info.ModTime().Format(time.RFC3339),
+				Mode:     info.Mode(),
+				ModTime:  info.ModTime(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list items: %w", err)
+	}
+	return items, nil
+}
+
+// OpenFile opens a random-access handle using the os.O_* flags
+func (b *LocalBackend) OpenFile(path string, flag int) (BackendFile, error) {
+	fullPath := b.fullPath(path)
+	if flag&os.O_CREATE != 0 {
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(fullPath, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return file, nil
+}
+
+// localWriter streams a file through a staging file on disk
+type localWriter struct {
+	fullPath string
+	file     *os.File
+	closed   bool
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// ReadFrom lets io.Copy hand file-to-file copies to the kernel, which uses
+// copy_file_range and shares extents on filesystems with reflink support
+func (w *localWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.file.ReadFrom(r)
+}
+
+// Close syncs the staging file and moves it into place
+func (w *localWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	staging := w.file.Name()
+	err := w.file.Chmod(0644)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(staging, w.fullPath)
+	}
+	if err != nil {
+		os.Remove(staging)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(w.fullPath)); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+// Abort removes the staging file without touching the target
+func (w *localWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
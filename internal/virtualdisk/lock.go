@@ -0,0 +1,133 @@
+package virtualdisk
+
+import (
+	"sync"
+)
+
+// pathLock is a lock on a file, or with tree set, on a directory and
+// everything below it. The empty path with tree set covers the whole disk.
+type pathLock struct {
+	path      string
+	tree      bool
+	exclusive bool
+}
+
+// fileLock returns a lock on a single path
+func fileLock(path string, exclusive bool) pathLock {
+	return pathLock{path: path, exclusive: exclusive}
+}
+
+// treeLock returns a lock on a directory and everything below it
+func treeLock(path string, exclusive bool) pathLock {
+	return pathLock{path: path, tree: true, exclusive: exclusive}
+}
+
+// overlaps reports whether two locks cover a common path
+func (l pathLock) overlaps(other pathLock) bool {
+	return l.path == other.path ||
+		l.tree && within(other.path, l.path) ||
+		other.tree && within(l.path, other.path)
+}
+
+// conflicts reports whether two locks cannot be held at the same time
+func (l pathLock) conflicts(other pathLock) bool {
+	return (l.exclusive || other.exclusive) && l.overlaps(other)
+}
+
+// lockRequest is a set of locks taken and released together
+type lockRequest struct {
+	locks []pathLock
+	seq   uint64 // order of arrival
+}
+
+// conflicts reports whether any lock of r conflicts with one of other. With
+// sharedOnly, only the shared locks of r are considered.
+func (r *lockRequest) conflicts(other *lockRequest, sharedOnly bool) bool {
+	for _, l := range r.locks {
+		if sharedOnly && l.exclusive {
+			continue
+		}
+		for _, o := range other.locks {
+			if l.conflicts(o) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exclusive reports whether r takes any exclusive lock
+func (r *lockRequest) exclusive() bool {
+	for _, l := range r.locks {
+		if l.exclusive {
+			return true
+		}
+	}
+	return false
+}
+
+// lockManager hands out shared and exclusive locks on virtual paths, so
+// operations on unrelated files proceed concurrently. Every lock an operation
+// needs is acquired at once, which rules out deadlocks between operations on
+// several paths; an operation must not lock again while it holds locks.
+// Waiting exclusive requests hold back shared locks requested after them
+// that conflict with them, so a steady stream of readers cannot starve a
+// writer.
+type lockManager struct {
+	held    map[*lockRequest]struct{}
+	waiting map[*lockRequest]struct{}
+	seq     uint64
+	mu      sync.Mutex
+	cond    *sync.Cond
+}
+
+// newLockManager creates a lock manager with nothing locked
+func newLockManager() *lockManager {
+	m := &lockManager{
+		held:    make(map[*lockRequest]struct{}),
+		waiting: make(map[*lockRequest]struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// lock blocks until all the locks can be held and returns the function that
+// releases them
+func (m *lockManager) lock(locks ...pathLock) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq++
+	req := &lockRequest{locks: locks, seq: m.seq}
+
+	for m.blocked(req) {
+		if req.exclusive() {
+			m.waiting[req] = struct{}{}
+		}
+		m.cond.Wait()
+	}
+	delete(m.waiting, req)
+	m.held[req] = struct{}{}
+
+	return func() {
+		m.mu.Lock()
+		delete(m.held, req)
+		m.mu.Unlock()
+		m.cond.Broadcast()
+	}
+}
+
+// blocked reports whether req has to wait. m.mu must be held.
+func (m *lockManager) blocked(req *lockRequest) bool {
+	for held := range m.held {
+		if req.conflicts(held, false) {
+			return true
+		}
+	}
+	for waiting := range m.waiting {
+		if waiting.seq < req.seq && req.conflicts(waiting, true) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,574 @@
+package virtualdisk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryBackend keeps files in memory only. Directories are tracked
+// explicitly and created implicitly for the parents of every file.
+type MemoryBackend struct {
+	files map[string]*memEntry
+	dirs  map[string]time.Time // directory path to creation time
+	mu    sync.RWMutex
+}
+
+// memEntry is the content of a memory file
+type memEntry struct {
+	data         []byte
+	modified     time.Time
+	attrs        map[string]string
+	attrsChanged time.Time
+	// shared is set while data may be referenced outside the backend, by the
+	// writer that stored it or a reader it was returned to; handles copy it
+	// before changing it in place
+	shared atomic.Bool
+}
+
+// own gives the entry a private copy of its data if it is shared, so it can
+// be changed in place. The lock guarding the entry must be held for writing.
+func (e *memEntry) own() {
+	if e.shared.Load() {
+		e.data = append([]byte(nil), e.data...)
+		e.shared.Store(false)
+	}
+}
+
+// NewMemoryBackend creates an empty memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		files: make(map[string]*memEntry),
+		dirs:  make(map[string]time.Time),
+	}
+}
+
+// ReadFile returns the content of a file
+func (b *MemoryBackend) ReadFile(path string) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entry, ok := b.files[path]
+	if !ok {
+		return nil, fmt.Errorf("failed to read file: %w", notExist(path))
+	}
+	entry.shared.Store(true)
+	return entry.data, nil
+}
+
+// WriteFile replaces the content of a file, keeping its attributes
+func (b *MemoryBackend) WriteFile(path string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.prepareFile(path); err != nil {
+		return err
+	}
+	entry := &memEntry{
+		data:     data,
+		modified: time.Now(),
+	}
+	entry.shared.Store(true)
+	if old, ok := b.files[path]; ok {
+		entry.attrs = old.attrs
+		entry.attrsChanged = old.attrsChanged
+	}
+	b.files[path] = entry
+	return nil
+}
+
+// Open returns a reader over the current content of a file
+func (b *MemoryBackend) Open(path string) (io.ReadCloser, error) {
+	data, err := b.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Create collects a file in memory and stores it on close
+func (b *MemoryBackend) Create(path string) (FileWriter, error) {
+	return &memoryWriter{backend: b, path: path}, nil
+}
+
+// Delete removes a file or an empty directory
+func (b *MemoryBackend) Delete(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.dirs[path]; ok {
+		if b.hasChildren(path) {
+			return fmt.Errorf("failed to delete directory: %w", ErrDirNotEmpty)
+		}
+		delete(b.dirs, path)
+		return nil
+	}
+	delete(b.files, path)
+	return nil
+}
+
+// Rename moves a file or a directory with everything under it
+func (b *MemoryBackend) Rename(oldPath, newPath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if entry, ok := b.files[oldPath]; ok {
+		if err := b.prepareFile(newPath); err != nil {
+			return err
+		}
+		delete(b.files, oldPath)
+		b.files[newPath] = entry
+		return nil
+	}
+
+	created, ok := b.dirs[oldPath]
+	if !ok {
+		return fmt.Errorf("failed to rename file: %w", notExist(oldPath))
+	}
+	if _, ok := b.files[newPath]; ok {
+		return fmt.Errorf("failed to rename directory: %s is a file", newPath)
+	}
+	if _, ok := b.dirs[newPath]; ok && b.hasChildren(newPath) {
+		return fmt.Errorf("failed to rename directory: %w", ErrDirNotEmpty)
+	}
+	if err := b.mkdirAll(parentDir(newPath)); err != nil {
+		return err
+	}
+
+	for path, entry := range b.files {
+		if rest, ok := strings.CutPrefix(path, oldPath+"/"); ok {
+			delete(b.files, path)
+			b.files[newPath+"/"+rest] = entry
+		}
+	}
+	moved := make(map[string]time.Time)
+	for path, dirCreated := range b.dirs {
+		if rest, ok := strings.CutPrefix(path, oldPath+"/"); ok {
+			delete(b.dirs, path)
+			moved[newPath+"/"+rest] = dirCreated
+		}
+	}
+	for path, dirCreated := range moved {
+		b.dirs[path] = dirCreated
+	}
+	delete(b.dirs, oldPath)
+	b.dirs[newPath] = created
+	return nil
+}
+
+// Copy copies a file
+func (b *MemoryBackend) Copy(srcPath, dstPath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.files[srcPath]
+	if !ok {
+		return fmt.Errorf("failed to copy file: %w", notExist(srcPath))
+	}
+	if err := b.prepareFile(dstPath); err != nil {
+		return err
+	}
+	// Handles edit data in place, so the copy needs its own bytes
+	b.files[dstPath] = &memEntry{
+		data:         append([]byte(nil), entry.data...),
+		modified:     time.Now(),
+		attrs:        copyAttrMap(entry.attrs),
+		attrsChanged: entry.attrsChanged,
+	}
+	return nil
+}
+
+// Attrs returns the user-defined attributes of a file
+func (b *MemoryBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entry, ok := b.files[path]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("failed to get attributes: %w", notExist(path))
+	}
+	attrs := copyAttrMap(entry.attrs)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	return attrs, entry.attrsChanged, nil
+}
+
+// SetAttrs replaces the user-defined attributes of a file
+func (b *MemoryBackend) SetAttrs(path string, attrs map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.files[path]
+	if !ok {
+		return fmt.Errorf("failed to set attributes: %w", notExist(path))
+	}
+	entry.attrs = copyAttrMap(attrs)
+	entry.attrsChanged = time.Now()
+	return nil
+}
+
+// copyAttrMap returns a copy of an attribute map, or nil if it is empty
+func copyAttrMap(attrs map[string]string) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		result[name] = value
+	}
+	return result
+}
+
+// Mkdir creates a directory and all parent directories
+func (b *MemoryBackend) Mkdir(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.mkdirAll(path)
+}
+
+// mkdirAll creates a directory and its parents. b.mu must be held.
+func (b *MemoryBackend) mkdirAll(path string) error {
+	if path == "" {
+		return nil // the root always exists
+	}
+	if err := b.mkdirAll(parentDir(path)); err != nil {
+		return err
+	}
+	if _, ok := b.files[path]; ok {
+		return fmt.Errorf("failed to create directory: %w", &fs.PathError{Op: "mkdir", Path: path, Err: fs.ErrExist})
+	}
+	if _, ok := b.dirs[path]; !ok {
+		b.dirs[path] = time.Now()
+	}
+	return nil
+}
+
+// prepareFile checks that a file can be stored at path and creates its
+// parent directories. b.mu must be held.
+func (b *MemoryBackend) prepareFile(path string) error {
+	if _, ok := b.dirs[path]; ok {
+		return fmt.Errorf("failed to write file: %s is a directory", path)
+	}
+	return b.mkdirAll(parentDir(path))
+}
+
+// hasChildren reports whether a directory has any entries. b.mu must be held.
+func (b *MemoryBackend) hasChildren(path string) bool {
+	for filePath := range b.files {
+		if strings.HasPrefix(filePath, path+"/") {
+			return true
+		}
+	}
+	for dirPath := range b.dirs {
+		if strings.HasPrefix(dirPath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parentDir returns the parent of a slash-separated path, or "" at the top level
+func parentDir(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// Stat returns information about a file or directory
+func (b *MemoryBackend) Stat(path string) (FileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if created, ok := b.dirs[path]; ok {
+		return FileInfo{
+			Path:     path,
+			IsDir:    true,
+			Modified: created.Format(time.RFC3339),
+			Mode:     fs.ModeDir | 0755,
+			ModTime:  created,
+		}, nil
+	}
+
+	entry, ok := b.files[path]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("failed to stat file: %w", notExist(path))
+	}
+	return FileInfo{
+		Path:     path,
+		Size:     int64(len(entry.data)),
+		Modified: entry.modified.Format(time.RFC3339),
+		ModTime:  entry.modified,
+	}, nil
+}
+
+// List returns all files and directories whose path starts with prefix
+func (b *MemoryBackend) List(prefix string) ([]FileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var items []FileInfo
+	for path, created := range b.dirs {
+		if strings.HasPrefix(path, prefix) {
+			items = append(items, FileInfo{
+				Path:     path,
+				IsDir:    true,
+				Modified: created.Format(time.RFC3339),
+				Mode:     fs.ModeDir | 0755,
+				ModTime:  created,
+			})
+		}
+	}
+	for path, entry := range b.files {
+		if strings.HasPrefix(path, prefix) {
+			items = append(items, FileInfo{
+				Path:     path,
+				Size:     int64(len(entry.data)),
+				Modified: entry.modified.Format(time.RFC3339),
+				ModTime:  entry.modified,
+			})
+		}
+	}
+	return items, nil
+}
+
+// OpenFile opens a random-access handle using the os.O_* flags
+func (b *MemoryBackend) OpenFile(path string, flag int) (BackendFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.files[path]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, fmt.Errorf("failed to open file: %w", &fs.PathError{Op: "open", Path: path, Err: fs.ErrExist})
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, fmt.Errorf("failed to open file: %w", notExist(path))
+	case !ok:
+		if err := b.prepareFile(path); err != nil {
+			return nil, err
+		}
+		entry = &memEntry{modified: time.Now()}
+		b.files[path] = entry
+	case flag&os.O_TRUNC != 0:
+		entry.data = nil
+		entry.modified = time.Now()
+	}
+
+	return &memFile{
+		name:  path,
+		entry: entry,
+		mu:    &b.mu,
+		flag:  flag,
+	}, nil
+}
+
+// notExist returns an error wrapping fs.ErrNotExist for path
+func notExist(path string) error {
+	return &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+}
+
+// memoryWriter collects a memory file and stores it in the backend on close
+type memoryWriter struct {
+	backend *MemoryBackend
+	path    string
+	buf     bytes.Buffer
+	closed  bool
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.backend.WriteFile(w.path, w.buf.Bytes())
+}
+
+func (w *memoryWriter) Abort() error {
+	w.closed = true
+	w.buf.Reset()
+	return nil
+}
+
+// memFile is a random-access handle over an in-memory file. When flush is
+// set, the content is handed to it on close if the handle modified it.
+type memFile struct {
+	name   string
+	entry  *memEntry
+	mu     *sync.RWMutex
+	flag   int
+	offset int64
+	dirty  bool
+	flush  func(data []byte) error
+}
+
+// newBufferedFile returns a handle over a private copy of data
+func newBufferedFile(name string, data []byte, flag int, flush func([]byte) error) *memFile {
+	return &memFile{
+		name:  name,
+		entry: &memEntry{data: data, modified: time.Now()},
+		mu:    &sync.RWMutex{},
+		flag:  flag,
+		flush: flush,
+	}
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off >= int64(len(f.entry.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.entry.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = f.size()
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry := f.entry
+	entry.own()
+	size := int64(len(entry.data))
+	end := off + int64(len(p))
+	if end > size {
+		if end <= int64(cap(entry.data)) {
+			entry.data = entry.data[:end]
+		} else {
+			grown := make([]byte, end, 2*end)
+			copy(grown, entry.data)
+			entry.data = grown
+		}
+		// Zero any gap left by writing past the old end of the file
+		if off > size {
+			clear(entry.data[size:off])
+		}
+	}
+	copy(entry.data[off:], p)
+	entry.modified = time.Now()
+	f.dirty = true
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size()
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("negative size: %d", size)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry := f.entry
+	entry.own()
+	if size <= int64(len(entry.data)) {
+		entry.data = entry.data[:size]
+	} else {
+		entry.data = append(entry.data, make([]byte, size-int64(len(entry.data)))...)
+	}
+	entry.modified = time.Now()
+	f.dirty = true
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return &memFileInfo{
+		name:    filepath.Base(f.name),
+		size:    int64(len(f.entry.data)),
+		modTime: f.entry.modified,
+	}, nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.flush == nil || !f.dirty {
+		return nil
+	}
+
+	f.mu.RLock()
+	data := f.entry.data
+	f.mu.RUnlock()
+	return f.flush(data)
+}
+
+func (f *memFile) size() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return int64(len(f.entry.data))
+}
+
+// memFileInfo describes a memory file
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,288 @@
+package virtualdisk
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// MirrorBackend keeps every file in a primary backend and a copy in a
+// secondary one. Reads are served from the primary and fall back to the
+// secondary for files that only exist there.
+type MirrorBackend struct {
+	primary   Backend
+	secondary Backend
+}
+
+// NewMirrorBackend creates a backend that mirrors primary into secondary
+func NewMirrorBackend(primary, secondary Backend) *MirrorBackend {
+	return &MirrorBackend{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+// Primary returns the backend reads are served from
+func (b *MirrorBackend) Primary() Backend {
+	return b.primary
+}
+
+// Secondary returns the backend holding the mirror copy
+func (b *MirrorBackend) Secondary() Backend {
+	return b.secondary
+}
+
+// ReadFile reads from the primary, falling back to the secondary for files
+// that are missing or corrupted in the primary
+func (b *MirrorBackend) ReadFile(path string) ([]byte, error) {
+	data, err := b.primary.ReadFile(path)
+	if err != nil && isNotExist(err) {
+		return b.secondary.ReadFile(path)
+	}
+	if errors.Is(err, ErrChecksumMismatch) {
+		if data, mirrorErr := b.secondary.ReadFile(path); mirrorErr == nil {
+			return data, nil
+		}
+	}
+	return data, err
+}
+
+// WriteFile writes to both backends
+func (b *MirrorBackend) WriteFile(path string, data []byte) error {
+	if err := b.primary.WriteFile(path, data); err != nil {
+		return err
+	}
+	if err := b.secondary.WriteFile(path, data); err != nil {
+		return err
+	}
+	// Some secondaries drop attributes on rewrite, so store them again
+	return copyAttrs(b.primary, path, b.secondary, path)
+}
+
+// Open streams from the primary, falling back to the secondary
+func (b *MirrorBackend) Open(path string) (io.ReadCloser, error) {
+	reader, err := b.primary.Open(path)
+	if err != nil && isNotExist(err) {
+		return b.secondary.Open(path)
+	}
+	return reader, err
+}
+
+// Create streams into the primary and copies the result to the secondary on close
+func (b *MirrorBackend) Create(path string) (FileWriter, error) {
+	w, err := b.primary.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorWriter{FileWriter: w, backend: b, path: path}, nil
+}
+
+// Delete removes the file from both backends
+func (b *MirrorBackend) Delete(path string) error {
+	if err := b.primary.Delete(path); err != nil {
+		return err
+	}
+	return b.secondary.Delete(path)
+}
+
+// Rename moves the file in both backends. Files that were moved to the
+// secondary only are renamed there.
+func (b *MirrorBackend) Rename(oldPath, newPath string) error {
+	primaryErr := renameWithin(b.primary, oldPath, newPath)
+	if primaryErr != nil && !isNotExist(primaryErr) {
+		return primaryErr
+	}
+	err := renameWithin(b.secondary, oldPath, newPath)
+	if err != nil && (!isNotExist(err) || primaryErr != nil) {
+		return err
+	}
+	return nil
+}
+
+// Copy copies the file in both backends. Files that were moved to the
+// secondary only are copied there.
+func (b *MirrorBackend) Copy(srcPath, dstPath string) error {
+	primaryErr := copyBetween(b.primary, srcPath, b.primary, dstPath)
+	if primaryErr != nil && !isNotExist(primaryErr) {
+		return primaryErr
+	}
+	err := copyBetween(b.secondary, srcPath, b.secondary, dstPath)
+	if err != nil && (!isNotExist(err) || primaryErr != nil) {
+		return err
+	}
+	return nil
+}
+
+// Attrs returns the attributes of the primary copy, or of the secondary
+// copy for files that only exist there
+func (b *MirrorBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	if _, err := b.primary.Stat(path); err != nil && isNotExist(err) {
+		return attrsOf(b.secondary, path)
+	}
+	return attrsOf(b.primary, path)
+}
+
+// SetAttrs stores attributes with both copies
+func (b *MirrorBackend) SetAttrs(path string, attrs map[string]string) error {
+	primaryErr := setAttrs(b.primary, path, attrs)
+	if primaryErr != nil && !isNotExist(primaryErr) {
+		return primaryErr
+	}
+	err := setAttrs(b.secondary, path, attrs)
+	if err != nil && (!isNotExist(err) || primaryErr != nil) {
+		return err
+	}
+	return nil
+}
+
+// Mkdir creates the directory in both backends
+func (b *MirrorBackend) Mkdir(path string) error {
+	if err := b.primary.Mkdir(path); err != nil {
+		return err
+	}
+	return b.secondary.Mkdir(path)
+}
+
+// Stat reports the primary copy, falling back to the secondary
+func (b *MirrorBackend) Stat(path string) (FileInfo, error) {
+	info, err := b.primary.Stat(path)
+	if err != nil && isNotExist(err) {
+		return b.secondary.Stat(path)
+	}
+	return info, err
+}
+
+// List merges both listings, preferring the primary's entries
+func (b *MirrorBackend) List(prefix string) ([]FileInfo, error) {
+	primary, err := b.primary.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := b.secondary.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]FileInfo, len(primary)+len(secondary))
+	for _, info := range secondary {
+		items[info.Path] = info
+	}
+	for _, info := range primary {
+		items[info.Path] = info
+	}
+
+	result := make([]FileInfo, 0, len(items))
+	for _, info := range items {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+// OpenFile opens a handle on the primary, pulling the file down from the
+// secondary first if only the mirror has it. Modified files are copied to the
+// secondary when the handle is closed.
+func (b *MirrorBackend) OpenFile(path string, flag int) (BackendFile, error) {
+	if flag&os.O_TRUNC == 0 {
+		if _, err := b.primary.Stat(path); err != nil && isNotExist(err) {
+			if err := b.fetch(path); err != nil && (!isNotExist(err) || flag&os.O_CREATE == 0) {
+				return nil, err
+			}
+		}
+	}
+
+	var file BackendFile
+	var err error
+	if opener, ok := b.primary.(FileOpener); ok {
+		file, err = opener.OpenFile(path, flag)
+	} else {
+		file, err = openBuffered(b.primary, path, flag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorFile{BackendFile: file, backend: b, path: path, dirty: flag&os.O_TRUNC != 0}, nil
+}
+
+// fetch copies a file from the secondary into the primary
+func (b *MirrorBackend) fetch(path string) error {
+	info, err := b.secondary.Stat(path)
+	if err != nil {
+		return err
+	}
+	reader, err := b.secondary.Open(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := copyTo(b.primary, path, reader, info.Size); err != nil {
+		return err
+	}
+	return copyAttrs(b.secondary, path, b.primary, path)
+}
+
+// push copies a file from the primary to the secondary
+func (b *MirrorBackend) push(path string) error {
+	info, err := b.primary.Stat(path)
+	if err != nil {
+		return err
+	}
+	reader, err := b.primary.Open(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := copyTo(b.secondary, path, reader, info.Size); err != nil {
+		return err
+	}
+	return copyAttrs(b.primary, path, b.secondary, path)
+}
+
+// mirrorWriter copies the committed primary file to the secondary
+type mirrorWriter struct {
+	FileWriter
+	backend *MirrorBackend
+	path    string
+}
+
+func (w *mirrorWriter) Close() error {
+	if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+	return w.backend.push(w.path)
+}
+
+// mirrorFile tracks modifications so the file is copied to the secondary on close
+type mirrorFile struct {
+	BackendFile
+	backend *MirrorBackend
+	path    string
+	dirty   bool
+}
+
+func (f *mirrorFile) Write(p []byte) (int, error) {
+	f.dirty = true
+	return f.BackendFile.Write(p)
+}
+
+func (f *mirrorFile) WriteAt(p []byte, off int64) (int, error) {
+	f.dirty = true
+	return f.BackendFile.WriteAt(p, off)
+}
+
+func (f *mirrorFile) Truncate(size int64) error {
+	f.dirty = true
+	return f.BackendFile.Truncate(size)
+}
+
+func (f *mirrorFile) Close() error {
+	if err := f.BackendFile.Close(); err != nil {
+		return err
+	}
+	if !f.dirty {
+		return nil
+	}
+	return f.backend.push(f.path)
+}
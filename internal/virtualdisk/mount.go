@@ -0,0 +1,222 @@
+package virtualdisk
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/vikasavn/virtual_disk_go/internal/s3store"
+)
+
+// Mount types accepted in a MountSpec
+const (
+	MountLocal  = "local"  // A directory on the local filesystem
+	MountMemory = "memory" // An in-memory store
+	MountS3     = "s3"     // An S3 bucket, optionally under a key prefix
+	MountCustom = "custom" // A backend registered with RegisterBackend
+)
+
+// MountSpec describes the storage to mount at a virtual prefix
+type MountSpec struct {
+	Type     string `json:"type"`
+	Path     string `json:"path,omitempty"`     // Local directory for MountLocal
+	Bucket   string `json:"bucket,omitempty"`   // Bucket for MountS3
+	Prefix   string `json:"prefix,omitempty"`   // Key prefix inside the bucket for MountS3
+	Endpoint string `json:"endpoint,omitempty"` // S3 endpoint for MountS3
+	Region   string `json:"region,omitempty"`   // S3 region for MountS3
+}
+
+// MountInfo describes an entry of the mount table
+type MountInfo struct {
+	Prefix      string      `json:"prefix"`
+	StorageType StorageType `json:"storage_type"`
+	Spec        MountSpec   `json:"spec"`
+}
+
+// mount binds a backend to a virtual path prefix
+type mount struct {
+	prefix      string
+	storageType StorageType
+	backend     Backend
+	spec        MountSpec
+}
+
+// Mount serves every virtual path under prefix from the storage described by
+// spec, replacing anything previously mounted there. The most specific prefix
+// wins when mounts are nested.
+func (vd *VirtualDisk) Mount(prefix string, spec MountSpec) error {
+	var backend Backend
+	switch spec.Type {
+	case MountLocal:
+		info, err := os.Stat(spec.Path)
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %w", spec.Path, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("failed to mount %s: not a directory", spec.Path)
+		}
+		backend = NewLocalBackend(spec.Path)
+	case MountMemory:
+		backend = NewMemoryBackend()
+	case MountS3:
+		if spec.Bucket == "" {
+			return fmt.Errorf("bucket is required for S3 mounts")
+		}
+		store, err := s3store.NewS3Store(spec.Endpoint, spec.Region, spec.Bucket, spec.Prefix)
+		if err != nil {
+			return fmt.Errorf("failed to initialize S3 store: %w", err)
+		}
+		backend = NewS3Backend(store)
+	default:
+		return fmt.Errorf("unknown mount type: %s", spec.Type)
+	}
+
+	return vd.addMount(prefix, backend, spec)
+}
+
+// RegisterBackend serves every virtual path under prefix from backend,
+// replacing anything previously mounted there
+func (vd *VirtualDisk) RegisterBackend(prefix string, backend Backend) error {
+	return vd.addMount(prefix, backend, MountSpec{Type: MountCustom})
+}
+
+// Unmount removes the mount at prefix. Built-in storage cannot be unmounted.
+func (vd *VirtualDisk) Unmount(prefix string) error {
+	prefix, err := normalizeMountPrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	unlock := vd.locks.lock(treeLock(prefix, true))
+	defer unlock()
+
+	vd.mountsMu.Lock()
+	found := false
+	mounts := make([]*mount, 0, len(vd.mounts))
+	for _, m := range vd.mounts {
+		if m.prefix == prefix && m.storageType == StorageMount {
+			found = true
+			continue
+		}
+		mounts = append(mounts, m)
+	}
+	vd.mounts = mounts
+	vd.mountsMu.Unlock()
+
+	if !found {
+		return fmt.Errorf("nothing mounted at %s", prefix)
+	}
+	vd.invalidatePrefix(prefix)
+	vd.recountPrefix(prefix)
+	return nil
+}
+
+// Mounts returns the mount table, including the built-in storage types
+func (vd *VirtualDisk) Mounts() []MountInfo {
+	mounts := vd.mountList()
+	infos := make([]MountInfo, 0, len(mounts))
+	for _, m := range mounts {
+		infos = append(infos, MountInfo{
+			Prefix:      m.prefix,
+			StorageType: m.storageType,
+			Spec:        m.spec,
+		})
+	}
+	return infos
+}
+
+// addMount inserts a mount, replacing one at the same prefix
+func (vd *VirtualDisk) addMount(prefix string, backend Backend, spec MountSpec) error {
+	prefix, err := normalizeMountPrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	unlock := vd.locks.lock(treeLock(prefix, true))
+	defer unlock()
+
+	vd.mountsMu.Lock()
+	mounts := make([]*mount, 0, len(vd.mounts)+1)
+	for _, m := range vd.mounts {
+		if m.prefix != prefix || m.storageType != StorageMount {
+			mounts = append(mounts, m)
+		}
+	}
+	mounts = append(mounts, &mount{
+		prefix:      prefix,
+		storageType: StorageMount,
+		backend:     backend,
+		spec:        spec,
+	})
+	sortMounts(mounts)
+	vd.mounts = mounts
+	vd.mountsMu.Unlock()
+
+	vd.invalidatePrefix(prefix)
+	vd.recountPrefix(prefix)
+	return nil
+}
+
+// recountPrefix recounts the usage of paths whose backend changed. The
+// paths must be locked.
+func (vd *VirtualDisk) recountPrefix(prefix string) {
+	if err := vd.rescanUsage(prefix); err != nil {
+		fmt.Printf("failed to update usage: %v\n", err)
+	}
+}
+
+// invalidatePrefix drops cached data for paths whose backend changed
+func (vd *VirtualDisk) invalidatePrefix(prefix string) {
+	if vd.cache != nil {
+		vd.cache.RemovePrefix(prefix)
+	}
+}
+
+// normalizeMountPrefix turns "datasets", "/datasets" or "datasets/" into "datasets/"
+func normalizeMountPrefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", fmt.Errorf("mount prefix is required")
+	}
+	return prefix + "/", nil
+}
+
+// sortMounts orders mounts so the longest prefix is matched first and
+// mounted backends win over built-in ones with the same prefix
+func sortMounts(mounts []*mount) {
+	sort.SliceStable(mounts, func(i, j int) bool {
+		if len(mounts[i].prefix) != len(mounts[j].prefix) {
+			return len(mounts[i].prefix) > len(mounts[j].prefix)
+		}
+		return mounts[i].storageType == StorageMount && mounts[j].storageType != StorageMount
+	})
+}
+
+// mountFor returns the mount serving a virtual path
+func (vd *VirtualDisk) mountFor(path string) *mount {
+	vd.mountsMu.RLock()
+	defer vd.mountsMu.RUnlock()
+
+	// The persistent mount has an empty prefix, so there is always a match
+	for _, m := range vd.mounts {
+		if strings.HasPrefix(path, m.prefix) {
+			return m
+		}
+	}
+	return nil
+}
+
+// resolve returns the backend serving a virtual path and the path relative to it
+func (vd *VirtualDisk) resolve(path string) (Backend, string) {
+	m := vd.mountFor(path)
+	return m.backend, strings.TrimPrefix(path, m.prefix)
+}
+
+// mountList returns a snapshot of the mount table
+func (vd *VirtualDisk) mountList() []*mount {
+	vd.mountsMu.RLock()
+	defer vd.mountsMu.RUnlock()
+
+	return append([]*mount(nil), vd.mounts...)
+}
@@ -0,0 +1,530 @@
+package virtualdisk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// ErrQuotaExceeded is returned when a write would take the files covered by a
+// quota past its limits
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the size and number of the files of a storage type, below a
+// path prefix, or both. Limits of 0 are not enforced.
+type Quota struct {
+	// StorageType selects the files of one storage type; empty selects all
+	StorageType StorageType `json:"storage_type,omitempty"`
+	// Prefix selects the files whose virtual path starts with it, such as
+	// "temp/uploads/"; empty selects all
+	Prefix string `json:"prefix,omitempty"`
+	// MaxBytes and MaxFiles are hard limits; writes that would go past them
+	// fail with ErrQuotaExceeded
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	MaxFiles int64 `json:"max_files,omitempty"`
+	// SoftBytes and SoftFiles are soft limits; an EventQuotaWarning is
+	// published when usage goes past them
+	SoftBytes int64 `json:"soft_bytes,omitempty"`
+	SoftFiles int64 `json:"soft_files,omitempty"`
+}
+
+// QuotaUsage is a quota along with the usage of the files it covers
+type QuotaUsage struct {
+	Quota
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage is the storage taken by the files of a storage type
+type Usage struct {
+	Files       int64 `json:"files"`
+	Bytes       int64 `json:"bytes"`        // total size of the files
+	StoredBytes int64 `json:"stored_bytes"` // size in storage, after compression
+	// Capacity is how many bytes the files may take up: the quota on the
+	// storage type, or else the size of the filesystem holding them. It is 0
+	// when unknown.
+	Capacity int64 `json:"capacity"`
+	// Available is how many more bytes may be stored, 0 when Capacity is unknown
+	Available int64 `json:"available"`
+}
+
+// ParseQuotas parses a JSON list of quotas
+func ParseQuotas(data []byte) ([]Quota, error) {
+	var quotas []Quota
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, fmt.Errorf("failed to parse quotas: %w", err)
+	}
+	return quotas, nil
+}
+
+// validateQuotas checks that every quota names a known storage type and has
+// sensible limits
+func validateQuotas(quotas []Quota) error {
+	for i, q := range quotas {
+		switch q.StorageType {
+		case "", StoragePersistent, StorageTemp, StorageMemory, StorageMount:
+		default:
+			return fmt.Errorf("quota %d: unknown storage type: %s", i+1, q.StorageType)
+		}
+		if q.MaxBytes < 0 || q.MaxFiles < 0 || q.SoftBytes < 0 || q.SoftFiles < 0 {
+			return fmt.Errorf("quota %d: limits must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+// covers reports whether the quota applies to a file
+func (q Quota) covers(path string, storageType StorageType) bool {
+	return (q.StorageType == "" || q.StorageType == storageType) && strings.HasPrefix(path, q.Prefix)
+}
+
+// scope describes the files a quota covers
+func (q Quota) scope() string {
+	scope := "files"
+	if q.StorageType != "" {
+		scope = string(q.StorageType) + " files"
+	}
+	if q.Prefix != "" {
+		scope += " under " + q.Prefix
+	}
+	return scope
+}
+
+// usageEntry is a file as accounted for in usage
+type usageEntry struct {
+	storageType StorageType
+	size        int64
+	stored      int64 // size in storage, after compression
+}
+
+// usageCounts adds up the usage of a set of files
+type usageCounts struct {
+	files  int64
+	bytes  int64
+	stored int64
+}
+
+// add adds a file to the counts, or takes it away if sign is -1
+func (c *usageCounts) add(entry usageEntry, sign int64) {
+	c.files += sign
+	c.bytes += sign * entry.size
+	c.stored += sign * entry.stored
+}
+
+// quotaState is a quota along with the usage it covers
+type quotaState struct {
+	Quota
+	usageCounts
+	warned bool // usage is past a soft limit
+}
+
+// overSoftLimit reports whether usage is past a soft limit
+func (q *quotaState) overSoftLimit() bool {
+	return (q.SoftBytes > 0 && q.bytes > q.SoftBytes) || (q.SoftFiles > 0 && q.files > q.SoftFiles)
+}
+
+// usage returns the quota along with its usage
+func (q *quotaState) usage() QuotaUsage {
+	return QuotaUsage{Quota: q.Quota, Files: q.files, Bytes: q.bytes}
+}
+
+// usageTracker keeps count of the storage taken by every file, so usage and
+// quotas can be checked without walking the storage. It is filled by a scan
+// when the virtual disk is opened and kept up to date from file events.
+type usageTracker struct {
+	files    map[string]usageEntry
+	types    map[StorageType]*usageCounts
+	quotas   []*quotaState
+	reserved map[*quotaReservation]bool
+	mu       sync.Mutex
+}
+
+// newUsageTracker creates an empty tracker enforcing quotas
+func newUsageTracker(quotas []Quota) *usageTracker {
+	t := &usageTracker{
+		files:    make(map[string]usageEntry),
+		types:    make(map[StorageType]*usageCounts),
+		reserved: make(map[*quotaReservation]bool),
+	}
+	for _, q := range quotas {
+		t.quotas = append(t.quotas, &quotaState{Quota: q})
+	}
+	return t
+}
+
+// account adds a file to the counts it belongs to, or takes it away if sign
+// is -1. t.mu must be held.
+func (t *usageTracker) account(path string, entry usageEntry, sign int64) {
+	counts, ok := t.types[entry.storageType]
+	if !ok {
+		counts = &usageCounts{}
+		t.types[entry.storageType] = counts
+	}
+	counts.add(entry, sign)
+	for _, q := range t.quotas {
+		if q.covers(path, entry.storageType) {
+			q.add(entry, sign)
+		}
+	}
+}
+
+// crossed returns the quotas whose soft limits usage just went past. t.mu
+// must be held.
+func (t *usageTracker) crossed() []QuotaUsage {
+	var crossed []QuotaUsage
+	for _, q := range t.quotas {
+		over := q.overSoftLimit()
+		if over && !q.warned {
+			crossed = append(crossed, q.usage())
+		}
+		q.warned = over
+	}
+	return crossed
+}
+
+// update records the current size of a file, or that it is gone if entry is
+// nil, and returns the quotas whose soft limits usage just went past
+func (t *usageTracker) update(path string, entry *usageEntry) []QuotaUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if old, ok := t.files[path]; ok {
+		t.account(path, old, -1)
+		delete(t.files, path)
+	}
+	if entry != nil {
+		t.files[path] = *entry
+		t.account(path, *entry, 1)
+	}
+	return t.crossed()
+}
+
+// forget records that path and everything below it are gone. A path ending
+// in "/" is a prefix.
+func (t *usageTracker) forget(path string) []QuotaUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for filePath, entry := range t.files {
+		if within(filePath, path) {
+			t.account(filePath, entry, -1)
+			delete(t.files, filePath)
+		}
+	}
+	return t.crossed()
+}
+
+// within reports whether a file is path or below it. A path ending in "/" is
+// a prefix.
+func within(filePath, path string) bool {
+	if path == "" || strings.HasSuffix(path, "/") {
+		return strings.HasPrefix(filePath, path)
+	}
+	return filePath == path || strings.HasPrefix(filePath, path+"/")
+}
+
+// tree returns the file at path, or the files below it, keyed by the rest of
+// their path after path
+func (t *usageTracker) tree(path string) map[string]usageEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	files := make(map[string]usageEntry)
+	for filePath, entry := range t.files {
+		if filePath == path {
+			files[""] = entry
+		} else if rest, ok := strings.CutPrefix(filePath, path+"/"); ok {
+			files["/"+rest] = entry
+		}
+	}
+	return files
+}
+
+// quotaReservation is usage that a write in progress has been allowed to
+// take. It is held against the quotas until the write is accounted for, so
+// concurrent writes can't together go past a hard limit.
+type quotaReservation struct {
+	changes map[string]*usageEntry
+}
+
+// pending adds up, for a quota, the usage that reservations other than
+// except are about to add. Reservations are measured against the files as
+// accounted for, so a write that has been accounted for no longer counts.
+// Usage they are about to free does not count until it is. t.mu must be held.
+func (t *usageTracker) pending(q *quotaState, except *quotaReservation) usageCounts {
+	var pending usageCounts
+	for r := range t.reserved {
+		if r == except {
+			continue
+		}
+		delta := t.delta(q, r.changes)
+		if delta.bytes > 0 {
+			pending.bytes += delta.bytes
+		}
+		if delta.files > 0 {
+			pending.files += delta.files
+		}
+	}
+	return pending
+}
+
+// delta returns how changing the given files would change the usage of a
+// quota. t.mu must be held.
+func (t *usageTracker) delta(q *quotaState, changes map[string]*usageEntry) usageCounts {
+	var delta usageCounts
+	for path, entry := range changes {
+		if old, ok := t.files[path]; ok && q.covers(path, old.storageType) {
+			delta.add(old, -1)
+		}
+		if entry != nil && q.covers(path, entry.storageType) {
+			delta.add(*entry, 1)
+		}
+	}
+	return delta
+}
+
+// reserve returns ErrQuotaExceeded if changing the given files would take
+// any quota past its hard limits, counting the usage reserved by other
+// writes, and otherwise reserves the change until it is released. A nil
+// entry removes the file. Changes that don't add to a quota's usage are
+// always allowed, so files can be deleted or shrunk when usage is already
+// over a limit. If r is not nil, its changes are replaced.
+func (t *usageTracker) reserve(r *quotaReservation, changes map[string]*usageEntry) (*quotaReservation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, q := range t.quotas {
+		if q.MaxBytes == 0 && q.MaxFiles == 0 {
+			continue
+		}
+		delta := t.delta(q, changes)
+		pending := t.pending(q, r)
+		if q.MaxBytes > 0 && delta.bytes > 0 && q.bytes+pending.bytes+delta.bytes > q.MaxBytes {
+			return nil, fmt.Errorf("%w: %s are limited to %d bytes", ErrQuotaExceeded, q.scope(), q.MaxBytes)
+		}
+		if q.MaxFiles > 0 && delta.files > 0 && q.files+pending.files+delta.files > q.MaxFiles {
+			return nil, fmt.Errorf("%w: %s are limited to %d files", ErrQuotaExceeded, q.scope(), q.MaxFiles)
+		}
+	}
+
+	if r == nil {
+		r = &quotaReservation{}
+	}
+	r.changes = changes
+	t.reserved[r] = true
+	return r, nil
+}
+
+// release drops a reservation once its write has been accounted for or has
+// failed
+func (t *usageTracker) release(r *quotaReservation) {
+	if r == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.reserved, r)
+}
+
+// reserveQuota returns ErrQuotaExceeded if writing size bytes to path would
+// take a quota past its limits, and otherwise reserves the size until
+// releaseQuota is called. A write that grows passes its earlier reservation
+// r, which is replaced. The reservation is nil when no quotas are set.
+func (vd *VirtualDisk) reserveQuota(r *quotaReservation, path string, size int64) (*quotaReservation, error) {
+	if len(vd.usage.quotas) == 0 {
+		return nil, nil
+	}
+	return vd.usage.reserve(r, map[string]*usageEntry{
+		path: {storageType: vd.getStorageType(path), size: size, stored: size},
+	})
+}
+
+// reserveQuotaCopy returns ErrQuotaExceeded if copying the file or directory
+// at srcPath to dstPath would take a quota past its limits, and otherwise
+// reserves the copy until releaseQuota is called. With move the source is
+// removed as well. Buffered writes must have been written back.
+func (vd *VirtualDisk) reserveQuotaCopy(srcPath, dstPath string, move bool) (*quotaReservation, error) {
+	if len(vd.usage.quotas) == 0 {
+		return nil, nil
+	}
+	changes := make(map[string]*usageEntry)
+	for rest, entry := range vd.usage.tree(srcPath) {
+		if move {
+			changes[srcPath+rest] = nil
+		}
+		target := entry
+		target.storageType = vd.getStorageType(dstPath + rest)
+		changes[dstPath+rest] = &target
+	}
+	return vd.usage.reserve(nil, changes)
+}
+
+// releaseQuota drops a reservation made by reserveQuota or reserveQuotaCopy
+func (vd *VirtualDisk) releaseQuota(r *quotaReservation) {
+	vd.usage.release(r)
+}
+
+// accountUsage keeps usage up to date as files change. Like every event
+// handler it runs with the paths of the event locked.
+func (vd *VirtualDisk) accountUsage(event events.Event) error {
+	switch event.Type {
+	case events.EventFileDeleted, events.EventFileExpired:
+		vd.forgetUsage(event.Path)
+		return nil
+	case events.EventFileRenamed:
+		oldPath, _ := event.Metadata["old_path"].(string)
+		vd.forgetUsage(oldPath)
+		if isDir, _ := event.Metadata["is_dir"].(bool); isDir {
+			return vd.rescanUsage(event.Path + "/")
+		}
+	}
+	return vd.refreshUsage(event.Path)
+}
+
+// refreshUsage accounts for the current size of a file. The file must be locked.
+func (vd *VirtualDisk) refreshUsage(path string) error {
+	storageType := vd.getStorageType(path)
+	if entry, ok := vd.buffered(path); ok {
+		size := int64(len(entry.Data))
+		vd.publishQuotaWarnings(vd.usage.update(path, &usageEntry{storageType: storageType, size: size, stored: size}))
+		return nil
+	}
+
+	backend, relPath := vd.resolve(path)
+	info, err := backend.Stat(relPath)
+	if isNotExist(err) {
+		vd.forgetUsage(path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to account for %s: %w", path, err)
+	}
+	if info.IsDir {
+		return nil
+	}
+	vd.publishQuotaWarnings(vd.usage.update(path, usageOf(storageType, info)))
+	return nil
+}
+
+// rescanUsage recounts the files below prefix from the backends. The files
+// below prefix must be locked.
+func (vd *VirtualDisk) rescanUsage(prefix string) error {
+	items, err := vd.listItems(prefix)
+	if err != nil {
+		return fmt.Errorf("failed to account for %s: %w", prefix, err)
+	}
+
+	var crossed []QuotaUsage
+	vd.usage.forget(prefix)
+	for path, info := range items {
+		if !info.IsDir {
+			crossed = vd.usage.update(path, usageOf(vd.getStorageType(path), info))
+		}
+	}
+	vd.publishQuotaWarnings(crossed)
+	return nil
+}
+
+// forgetUsage stops accounting for a file or everything below a directory
+func (vd *VirtualDisk) forgetUsage(path string) {
+	vd.publishQuotaWarnings(vd.usage.forget(path))
+}
+
+// usageOf returns the usage of a file listed by a backend
+func usageOf(storageType StorageType, info FileInfo) *usageEntry {
+	stored := info.Size
+	if info.Compression != "" {
+		stored = info.StoredSize
+	}
+	return &usageEntry{storageType: storageType, size: info.Size, stored: stored}
+}
+
+// publishQuotaWarnings publishes an EventQuotaWarning for every quota whose
+// soft limits usage went past
+func (vd *VirtualDisk) publishQuotaWarnings(crossed []QuotaUsage) {
+	for _, q := range crossed {
+		vd.eventBus.Publish(events.Event{
+			Type:      events.EventQuotaWarning,
+			Path:      q.Prefix,
+			Timestamp: time.Now(),
+			Metadata: map[string]interface{}{
+				"storage_type": string(q.StorageType),
+				"files":        q.Files,
+				"bytes":        q.Bytes,
+				"soft_files":   q.SoftFiles,
+				"soft_bytes":   q.SoftBytes,
+				"max_files":    q.MaxFiles,
+				"max_bytes":    q.MaxBytes,
+			},
+		})
+	}
+}
+
+// Quotas returns the configured quotas along with the usage they cover
+func (vd *VirtualDisk) Quotas() []QuotaUsage {
+	vd.usage.mu.Lock()
+	defer vd.usage.mu.Unlock()
+
+	quotas := make([]QuotaUsage, 0, len(vd.usage.quotas))
+	for _, q := range vd.usage.quotas {
+		quotas = append(quotas, q.usage())
+	}
+	return quotas
+}
+
+// Usage returns the storage taken by the files of a storage type and how
+// much more they may take, going by quotas on the whole storage type and the
+// free space of the filesystem holding them
+func (vd *VirtualDisk) Usage(storageType StorageType) (Usage, error) {
+	// Memory and mounted storage have no filesystem of their own to measure
+	var usage Usage
+	var dir string
+	measured := false
+	switch storageType {
+	case StoragePersistent:
+		dir = vd.dataPartition
+	case StorageTemp:
+		dir = vd.tempDir
+	}
+	if dir != "" {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			return Usage{}, fmt.Errorf("failed to get free space: %w", err)
+		}
+		usage.Capacity = int64(st.Blocks) * int64(st.Bsize)
+		usage.Available = int64(st.Bavail) * int64(st.Bsize)
+		measured = true
+	}
+
+	vd.usage.mu.Lock()
+	defer vd.usage.mu.Unlock()
+
+	if counts, ok := vd.usage.types[storageType]; ok {
+		usage.Files = counts.files
+		usage.Bytes = counts.bytes
+		usage.StoredBytes = counts.stored
+	}
+	for _, q := range vd.usage.quotas {
+		if q.MaxBytes == 0 || q.Prefix != "" || (q.StorageType != "" && q.StorageType != storageType) {
+			continue
+		}
+		available := q.MaxBytes - q.bytes
+		if available < 0 {
+			available = 0
+		}
+		if !measured || q.MaxBytes < usage.Capacity {
+			usage.Capacity = q.MaxBytes
+		}
+		if !measured || available < usage.Available {
+			usage.Available = available
+		}
+		measured = true
+	}
+	return usage, nil
+}
@@ -0,0 +1,176 @@
+package virtualdisk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// Rename moves a file or directory to a new path. Moves within one backend
+// are done in place and are atomic where the backend supports it; moves
+// between backends, such as from mem/ to persistent storage, copy the data
+// and then delete the original.
+func (vd *VirtualDisk) Rename(oldPath, newPath string) error {
+	return vd.RenameWith(oldPath, newPath, WriteOptions{})
+}
+
+// RenameWith moves a file or directory to a new path with options. Leases
+// held on the files moved and on those replaced apply to it.
+func (vd *VirtualDisk) RenameWith(oldPath, newPath string, opts WriteOptions) error {
+	if oldPath == "" || newPath == "" {
+		return fmt.Errorf("cannot rename the root directory")
+	}
+	if oldPath == newPath {
+		return nil
+	}
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		return fmt.Errorf("cannot move %s into itself", oldPath)
+	}
+
+	unlock := vd.locks.lock(treeLock(oldPath, true), treeLock(newPath, true))
+	defer unlock()
+
+	if err := vd.checkLeases([]string{opts.LockToken}, oldPath, newPath); err != nil {
+		return err
+	}
+
+	// Write back buffered data so the backends hold everything being moved
+	for _, path := range []string{oldPath, newPath} {
+		if err := vd.flushTree(path); err != nil {
+			return err
+		}
+	}
+
+	src := vd.mountFor(oldPath)
+	dst := vd.mountFor(newPath)
+	srcBackend, srcRel := vd.resolve(oldPath)
+	dstBackend, dstRel := vd.resolve(newPath)
+
+	isDir, err := statTree(srcBackend, srcRel)
+	if err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	reservation, err := vd.reserveQuotaCopy(oldPath, newPath, true)
+	if err != nil {
+		return err
+	}
+	defer vd.releaseQuota(reservation)
+
+	// Remember which files move so stale copies of them can be dropped
+	var moved []string
+	if isDir {
+		infos, err := srcBackend.List(srcRel + "/")
+		if err != nil {
+			return fmt.Errorf("failed to list directory: %w", err)
+		}
+		for _, info := range infos {
+			if !info.IsDir {
+				moved = append(moved, strings.TrimPrefix(info.Path, srcRel))
+			}
+		}
+	} else {
+		moved = append(moved, "")
+	}
+
+	if src == dst {
+		err = renameWithin(srcBackend, srcRel, dstRel)
+	} else {
+		err = moveTree(srcBackend, srcRel, dstBackend, dstRel)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Neither path may be replayed from the journal over the moved files
+	var checkpoints []string
+	for _, rest := range moved {
+		if src.storageType == StoragePersistent {
+			checkpoints = append(checkpoints, oldPath+rest)
+		}
+		if dst.storageType == StoragePersistent {
+			checkpoints = append(checkpoints, newPath+rest)
+		}
+	}
+	if err := vd.logCheckpoint(checkpoints...); err != nil {
+		return err
+	}
+
+	if vd.cache != nil {
+		for _, path := range []string{oldPath, newPath} {
+			vd.cache.Remove(path)
+			vd.cache.RemovePrefix(path + "/")
+		}
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileRenamed,
+		Path:      newPath,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"old_path": oldPath,
+			"new_path": newPath,
+			"is_dir":   isDir,
+		},
+	})
+
+	return nil
+}
+
+// flushTree writes back buffered writes to path or anywhere below it. The
+// tree must be locked exclusively.
+func (vd *VirtualDisk) flushTree(path string) error {
+	for bufferedPath := range vd.bufferedWithin(path) {
+		if err := vd.flushPath(bufferedPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statTree reports whether path is a directory in backend. Backends without
+// real directories have one wherever files exist below the path.
+func statTree(backend Backend, path string) (bool, error) {
+	info, err := backend.Stat(path)
+	if err == nil {
+		return info.IsDir, nil
+	}
+	if !isNotExist(err) {
+		return false, err
+	}
+
+	infos, listErr := backend.List(path + "/")
+	if listErr != nil {
+		return false, listErr
+	}
+	if len(infos) == 0 {
+		return false, err
+	}
+	return true, nil
+}
+
+// renameWithin moves a file or directory inside one backend
+func renameWithin(backend Backend, oldPath, newPath string) error {
+	if renamer, ok := backend.(Renamer); ok {
+		return renamer.Rename(oldPath, newPath)
+	}
+	return moveTree(backend, oldPath, backend, newPath)
+}
+
+// moveTree copies a file or directory between backends and then deletes the
+// original. The original is left intact if any copy fails.
+func moveTree(src Backend, srcPath string, dst Backend, dstPath string) error {
+	infos, err := copyTree(src, srcPath, dst, dstPath)
+	if err != nil {
+		return err
+	}
+
+	// Delete deepest entries first so directories are empty when removed
+	for i := len(infos) - 1; i >= 0; i-- {
+		if err := src.Delete(infos[i].Path); err != nil {
+			return err
+		}
+	}
+	return src.Delete(srcPath)
+}
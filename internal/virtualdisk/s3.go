@@ -0,0 +1,164 @@
+package virtualdisk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/s3store"
+)
+
+// S3Backend stores files as objects in an S3 bucket
+type S3Backend struct {
+	store *s3store.S3Store
+}
+
+// NewS3Backend creates a backend on top of an S3 store
+func NewS3Backend(store *s3store.S3Store) *S3Backend {
+	return &S3Backend{store: store}
+}
+
+// Store returns the underlying S3 store
+func (b *S3Backend) Store() *s3store.S3Store {
+	return b.store
+}
+
+// ReadFile downloads a whole object
+func (b *S3Backend) ReadFile(path string) ([]byte, error) {
+	return b.store.ReadFile(path)
+}
+
+// WriteFile uploads a whole object
+func (b *S3Backend) WriteFile(path string, data []byte) error {
+	return b.store.WriteFile(path, data)
+}
+
+// Open streams an object
+func (b *S3Backend) Open(path string) (io.ReadCloser, error) {
+	return b.store.ReadStream(path)
+}
+
+// Create spools the stream to a temporary file, since S3 needs the object
+// size up front, and uploads it on close
+func (b *S3Backend) Create(path string) (FileWriter, error) {
+	spool, err := os.CreateTemp("", "virtualdisk_s3_")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	return &s3Writer{backend: b, path: path, file: spool}, nil
+}
+
+// Upload streams size bytes from r into an object
+func (b *S3Backend) Upload(path string, r io.Reader, size int64) error {
+	return b.store.WriteStream(path, r, size)
+}
+
+// Copy copies an object inside the bucket without downloading it
+func (b *S3Backend) Copy(srcPath, dstPath string) error {
+	return b.store.CopyTo(srcPath, b.store, dstPath)
+}
+
+// Attrs returns the user-defined metadata of an object
+func (b *S3Backend) Attrs(path string) (map[string]string, time.Time, error) {
+	info, err := b.store.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	attrs := make(map[string]string, len(info.Metadata))
+	for name, value := range info.Metadata {
+		attrs[name] = value
+	}
+	return attrs, time.Time{}, nil
+}
+
+// SetAttrs replaces the user-defined metadata of an object. S3 drops the
+// metadata whenever an object is rewritten.
+func (b *S3Backend) SetAttrs(path string, attrs map[string]string) error {
+	return b.store.SetMetadata(path, attrs)
+}
+
+// Delete removes an object
+func (b *S3Backend) Delete(path string) error {
+	return b.store.DeleteFile(path)
+}
+
+// Mkdir is a no-op; S3 has no directories
+func (b *S3Backend) Mkdir(path string) error {
+	return nil
+}
+
+// Stat returns information about an object
+func (b *S3Backend) Stat(path string) (FileInfo, error) {
+	info, err := b.store.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Path:     path,
+		Size:     info.Size,
+		Modified: info.Modified.Format(time.RFC3339),
+		ModTime:  info.Modified,
+	}, nil
+}
+
+// List returns all objects whose path starts with prefix
+func (b *S3Backend) List(prefix string) ([]FileInfo, error) {
+	objects, err := b.store.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]FileInfo, 0, len(objects))
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Path, prefix) {
+			continue
+		}
+		items = append(items, FileInfo{
+			Path:     obj.Path,
+			Size:     obj.Size,
+			Modified: obj.Modified.Format(time.RFC3339),
+			ModTime:  obj.Modified,
+		})
+	}
+	return items, nil
+}
+
+// s3Writer spools an object to disk and uploads it on close
+type s3Writer struct {
+	backend *S3Backend
+	path    string
+	file    *os.File
+	size    int64
+	closed  bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer os.Remove(w.file.Name())
+	defer w.file.Close()
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	return w.backend.Upload(w.path, w.file, w.size)
+}
+
+func (w *s3Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
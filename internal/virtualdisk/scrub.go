@@ -0,0 +1,161 @@
+package virtualdisk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// defaultScrubInterval is how often files are scrubbed when Config.ScrubInterval is unset
+const defaultScrubInterval = 24 * time.Hour
+
+// ScrubReport summarizes a pass of the integrity scrubber
+type ScrubReport struct {
+	Checked   int      `json:"checked"`   // copies read back and verified
+	Repaired  []string `json:"repaired"`  // files with a corrupted copy restored from a good one
+	Corrupted []string `json:"corrupted"` // files without a good copy left
+}
+
+// runScrubber periodically verifies every persistent file at rest
+func (vd *VirtualDisk) runScrubber(interval time.Duration) {
+	defer vd.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-vd.done:
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := vd.Scrub(); err != nil {
+			// Log error and try again on the next tick
+			fmt.Printf("failed to scrub files: %v\n", err)
+		}
+	}
+}
+
+// replicas returns the backends holding copies of persistent files at rest
+func (vd *VirtualDisk) replicas() []Backend {
+	if vd.mirror != nil {
+		return []Backend{vd.mirror.Primary(), vd.mirror.Secondary()}
+	}
+	return []Backend{vd.disk}
+}
+
+// Scrub reads back every copy of every persistent file on disk and in S3 and
+// verifies its checksum. A corrupted copy is rewritten from a good copy; if
+// there is none, an EventFileCorrupted event is published.
+func (vd *VirtualDisk) Scrub() (*ScrubReport, error) {
+	replicas := vd.replicas()
+	seen := make(map[string]bool)
+	for _, replica := range replicas {
+		infos, err := replica.List("")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %w", err)
+		}
+		for _, info := range infos {
+			if !info.IsDir {
+				seen[info.Path] = true
+			}
+		}
+	}
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	report := &ScrubReport{Repaired: []string{}, Corrupted: []string{}}
+	for _, path := range paths {
+		// Lock per file so other operations are not held up for the whole pass
+		unlock := vd.locks.lock(fileLock(path, false))
+		good, bad, err := verifyCopies(replicas, path)
+		unlock()
+		if err != nil {
+			return report, err
+		}
+		report.Checked += len(good) + len(bad)
+		if len(bad) == 0 {
+			continue
+		}
+
+		unlock = vd.locks.lock(fileLock(path, true))
+		repaired, err := vd.repair(replicas, path)
+		unlock()
+		if err != nil {
+			return report, err
+		}
+		if repaired {
+			report.Repaired = append(report.Repaired, path)
+		} else {
+			report.Corrupted = append(report.Corrupted, path)
+		}
+	}
+	return report, nil
+}
+
+// repair rewrites the corrupted copies of a file from a good copy. It
+// reports false and publishes an event if no good copy is left. The file
+// must be locked exclusively.
+func (vd *VirtualDisk) repair(replicas []Backend, path string) (bool, error) {
+	// Check again, the file may have been rewritten since it was verified
+	good, bad, err := verifyCopies(replicas, path)
+	if err != nil || len(bad) == 0 {
+		return true, err
+	}
+
+	if len(good) == 0 {
+		vd.eventBus.Publish(events.Event{
+			Type:      events.EventFileCorrupted,
+			Path:      path,
+			Timestamp: time.Now(),
+			Metadata: map[string]interface{}{
+				"copies": len(bad),
+			},
+		})
+		return false, nil
+	}
+
+	for _, replica := range bad {
+		if err := copyFile(good[0], path, replica, path); err != nil {
+			return false, fmt.Errorf("failed to repair %s: %w", path, err)
+		}
+	}
+	return true, nil
+}
+
+// verifyCopies reads back the copies of a file and sorts them into good and
+// corrupted ones. Missing copies are left out.
+func verifyCopies(replicas []Backend, path string) (good, bad []Backend, err error) {
+	for _, replica := range replicas {
+		err := verifyFile(replica, path)
+		switch {
+		case err == nil:
+			good = append(good, replica)
+		case errors.Is(err, ErrChecksumMismatch):
+			bad = append(bad, replica)
+		case !isNotExist(err):
+			return nil, nil, fmt.Errorf("failed to verify %s: %w", path, err)
+		}
+	}
+	return good, bad, nil
+}
+
+// verifyFile reads a file to the end, which verifies its checksum
+func verifyFile(backend Backend, path string) error {
+	reader, err := backend.Open(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(io.Discard, reader)
+	return err
+}
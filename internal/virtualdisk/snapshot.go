@@ -0,0 +1,611 @@
+package virtualdisk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// snapshotNamePattern keeps snapshot names usable as file names
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SnapshotInfo describes a snapshot of the persistent files
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	Files     int       `json:"files"`
+	Size      int64     `json:"size"`      // total size of the files in the snapshot
+	Preserved int       `json:"preserved"` // files copied aside since they changed
+}
+
+// snapshot is the index of a snapshot: every persistent file and directory
+// as it was when the snapshot was taken
+type snapshot struct {
+	Name    string                   `json:"name"`
+	Created time.Time                `json:"created"`
+	Files   map[string]snapshotEntry `json:"files"`
+
+	// Files that changed since, whose snapshot content was copied aside
+	preserved map[string]bool
+}
+
+// snapshotEntry describes a file or directory in a snapshot
+type snapshotEntry struct {
+	IsDir   bool        `json:"is_dir,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// info summarizes the snapshot
+func (s *snapshot) info() SnapshotInfo {
+	info := SnapshotInfo{
+		Name:      s.Name,
+		Created:   s.Created,
+		Preserved: len(s.preserved),
+	}
+	for _, entry := range s.Files {
+		if !entry.IsDir {
+			info.Files++
+			info.Size += entry.Size
+		}
+	}
+	return info
+}
+
+// unpreserved returns the files of the snapshot that a change to paths would
+// overwrite and that still share their content with the live file. Changes to
+// a tree also affect everything below it.
+func (s *snapshot) unpreserved(tree bool, paths []string) []string {
+	var result []string
+	for _, path := range paths {
+		if entry, ok := s.Files[path]; ok && !entry.IsDir && !s.preserved[path] {
+			result = append(result, path)
+		}
+		if !tree {
+			continue
+		}
+		for filePath, entry := range s.Files {
+			if !entry.IsDir && !s.preserved[filePath] && strings.HasPrefix(filePath, path+"/") {
+				result = append(result, filePath)
+			}
+		}
+	}
+	return result
+}
+
+// SnapshotBackend keeps point-in-time snapshots of the files in a base
+// backend. Taking a snapshot only records an index of the files; a file's
+// content is copied aside the first time it is overwritten, renamed or
+// deleted afterwards, so unchanged files cost nothing.
+type SnapshotBackend struct {
+	base  Backend
+	data  Backend // preserved copies, under <snapshot name>/<path>
+	dir   string  // snapshot indexes
+	snaps map[string]*snapshot
+	mu    sync.RWMutex
+}
+
+// NewSnapshotBackend creates a backend keeping snapshots of base, with
+// indexes in dir and preserved copies in data, and loads existing snapshots
+func NewSnapshotBackend(base, data Backend, dir string) (*SnapshotBackend, error) {
+	b := &SnapshotBackend{
+		base:  base,
+		data:  data,
+		dir:   dir,
+		snaps: make(map[string]*snapshot),
+	}
+	if err := b.load(); err != nil {
+		return nil, fmt.Errorf("failed to load snapshots: %w", err)
+	}
+	return b, nil
+}
+
+// load reads the snapshot indexes and finds the copies preserved for them.
+// Copies left behind by a snapshot that was being deleted are removed.
+func (b *SnapshotBackend) load() error {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(b.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		snap := &snapshot{}
+		if err := json.Unmarshal(data, snap); err != nil {
+			return fmt.Errorf("failed to parse snapshot %s: %w", name, err)
+		}
+		snap.preserved = make(map[string]bool)
+		b.snaps[name] = snap
+	}
+
+	infos, err := b.data.List("")
+	if err != nil {
+		return err
+	}
+	var orphans []string
+	for _, info := range infos {
+		name, path, _ := strings.Cut(info.Path, "/")
+		snap, ok := b.snaps[name]
+		switch {
+		case !ok:
+			orphans = append(orphans, info.Path)
+		case !info.IsDir && path != "":
+			snap.preserved[path] = true
+		}
+	}
+	return deleteAll(b.data, orphans)
+}
+
+// saveIndex writes a snapshot index atomically
+func (b *SnapshotBackend) saveIndex(snap *snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(b.dir, ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(b.dir, snap.Name+".json")); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// take records the files in the base backend as a new snapshot
+func (b *SnapshotBackend) take(name string) (*snapshot, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.snaps[name]; ok {
+		return nil, fmt.Errorf("snapshot %s: %w", name, fs.ErrExist)
+	}
+	infos, err := b.base.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	snap := &snapshot{
+		Name:      name,
+		Created:   time.Now(),
+		Files:     make(map[string]snapshotEntry, len(infos)),
+		preserved: make(map[string]bool),
+	}
+	for _, info := range infos {
+		snap.Files[info.Path] = snapshotEntry{
+			IsDir:   info.IsDir,
+			Size:    info.Size,
+			Mode:    info.Mode,
+			ModTime: info.ModTime,
+		}
+	}
+	if err := b.saveIndex(snap); err != nil {
+		return nil, err
+	}
+	b.snaps[name] = snap
+	return snap, nil
+}
+
+// lookup returns a snapshot
+func (b *SnapshotBackend) lookup(name string) (*snapshot, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	snap, ok := b.snaps[name]
+	if !ok {
+		return nil, fmt.Errorf("snapshot %s: %w", name, fs.ErrNotExist)
+	}
+	return snap, nil
+}
+
+// drop deletes a snapshot along with its preserved copies
+func (b *SnapshotBackend) drop(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.snaps[name]; !ok {
+		return fmt.Errorf("snapshot %s: %w", name, fs.ErrNotExist)
+	}
+	// Remove the index first; copies left behind by a crash are removed on load
+	if err := os.Remove(filepath.Join(b.dir, name+".json")); err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	delete(b.snaps, name)
+
+	infos, err := b.data.List(name + "/")
+	if err != nil {
+		return fmt.Errorf("failed to list snapshot files: %w", err)
+	}
+	paths := []string{name}
+	for _, info := range infos {
+		paths = append(paths, info.Path)
+	}
+	return deleteAll(b.data, paths)
+}
+
+// deleteAll deletes files and directories from a backend, deepest first
+func deleteAll(backend Backend, paths []string) error {
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		if err := backend.Delete(path); err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// mutate runs fn, which changes paths in the base backend, once the content
+// the snapshots hold for them has been preserved
+func (b *SnapshotBackend) mutate(tree bool, paths []string, fn func() error) error {
+	b.mu.RLock()
+	pending := false
+	for _, snap := range b.snaps {
+		if len(snap.unpreserved(tree, paths)) > 0 {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		defer b.mu.RUnlock()
+		return fn()
+	}
+	b.mu.RUnlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.preserve(tree, paths); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// preserve copies the live content of files about to change into every
+// snapshot that still shares it. b.mu must be held.
+func (b *SnapshotBackend) preserve(tree bool, paths []string) error {
+	names := make([]string, 0, len(b.snaps))
+	for name := range b.snaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The first copy of a file is made from the live file, later ones from that copy
+	copies := make(map[string]string)
+	for _, name := range names {
+		snap := b.snaps[name]
+		for _, path := range snap.unpreserved(tree, paths) {
+			dst := name + "/" + path
+			var err error
+			if src, ok := copies[path]; ok {
+				err = copyBetween(b.data, src, b.data, dst)
+			} else {
+				err = copyFile(b.base, path, b.data, dst)
+			}
+			if isNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to preserve %s for snapshot %s: %w", path, name, err)
+			}
+			snap.preserved[path] = true
+			copies[path] = dst
+		}
+	}
+	return nil
+}
+
+// ReadFile reads a whole file
+func (b *SnapshotBackend) ReadFile(path string) ([]byte, error) {
+	return b.base.ReadFile(path)
+}
+
+// WriteFile writes a whole file, preserving its previous content for snapshots
+func (b *SnapshotBackend) WriteFile(path string, data []byte) error {
+	return b.mutate(false, []string{path}, func() error {
+		return b.base.WriteFile(path, data)
+	})
+}
+
+// Open streams a file
+func (b *SnapshotBackend) Open(path string) (io.ReadCloser, error) {
+	return b.base.Open(path)
+}
+
+// Create streams a file; its previous content is preserved for snapshots
+// when the new one is committed
+func (b *SnapshotBackend) Create(path string) (FileWriter, error) {
+	w, err := b.base.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotWriter{FileWriter: w, backend: b, path: path}, nil
+}
+
+// Delete removes a file, preserving it for snapshots
+func (b *SnapshotBackend) Delete(path string) error {
+	return b.mutate(false, []string{path}, func() error {
+		return b.base.Delete(path)
+	})
+}
+
+// Rename moves a file or directory, preserving whatever it moves or replaces
+func (b *SnapshotBackend) Rename(oldPath, newPath string) error {
+	return b.mutate(true, []string{oldPath, newPath}, func() error {
+		return renameWithin(b.base, oldPath, newPath)
+	})
+}
+
+// Copy copies a file, preserving the file it replaces
+func (b *SnapshotBackend) Copy(srcPath, dstPath string) error {
+	return b.mutate(false, []string{dstPath}, func() error {
+		return copyBetween(b.base, srcPath, b.base, dstPath)
+	})
+}
+
+// Attrs returns the attributes of a live file
+func (b *SnapshotBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	return attrsOf(b.base, path)
+}
+
+// SetAttrs stores attributes of a live file
+func (b *SnapshotBackend) SetAttrs(path string, attrs map[string]string) error {
+	return setAttrs(b.base, path, attrs)
+}
+
+// Mkdir creates a directory
+func (b *SnapshotBackend) Mkdir(path string) error {
+	return b.base.Mkdir(path)
+}
+
+// Stat returns information about a live file or directory
+func (b *SnapshotBackend) Stat(path string) (FileInfo, error) {
+	return b.base.Stat(path)
+}
+
+// List lists live files and directories
+func (b *SnapshotBackend) List(prefix string) ([]FileInfo, error) {
+	return b.base.List(prefix)
+}
+
+// OpenFile opens a handle on the base backend. Writes through it preserve
+// the previous content for snapshots first.
+func (b *SnapshotBackend) OpenFile(path string, flag int) (BackendFile, error) {
+	opener, ok := b.base.(FileOpener)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if ok {
+			return opener.OpenFile(path, flag)
+		}
+		return openBuffered(b.base, path, flag)
+	}
+	if !ok {
+		// Written back through WriteFile on close
+		return openBuffered(b, path, flag)
+	}
+
+	var file BackendFile
+	err := b.mutate(false, []string{path}, func() error {
+		var err error
+		file, err = opener.OpenFile(path, flag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotFile{BackendFile: file, backend: b, path: path}, nil
+}
+
+// snapshotWriter preserves the previous content of a file before committing the new one
+type snapshotWriter struct {
+	FileWriter
+	backend *SnapshotBackend
+	path    string
+}
+
+func (w *snapshotWriter) Close() error {
+	return w.backend.mutate(false, []string{w.path}, w.FileWriter.Close)
+}
+
+// snapshotFile preserves the content of a file before it is first modified
+// through a handle, including handles opened before the snapshot was taken
+type snapshotFile struct {
+	BackendFile
+	backend *SnapshotBackend
+	path    string
+}
+
+func (f *snapshotFile) Write(p []byte) (n int, err error) {
+	err = f.backend.mutate(false, []string{f.path}, func() error {
+		n, err = f.BackendFile.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (f *snapshotFile) WriteAt(p []byte, off int64) (n int, err error) {
+	err = f.backend.mutate(false, []string{f.path}, func() error {
+		n, err = f.BackendFile.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (f *snapshotFile) Truncate(size int64) error {
+	return f.backend.mutate(false, []string{f.path}, func() error {
+		return f.BackendFile.Truncate(size)
+	})
+}
+
+// Snapshot captures a consistent, read-only view of all persistent files as
+// they are now. Buffered writes are written back first. Nothing is copied
+// until files change, so taking a snapshot only costs listing the files.
+func (vd *VirtualDisk) Snapshot(name string) (*SnapshotInfo, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", name)
+	}
+
+	unlock := vd.locks.lock(treeLock("", true))
+	defer unlock()
+
+	if err := vd.flushAll(); err != nil {
+		return nil, err
+	}
+	snap, err := vd.snapshots.take(name)
+	if err != nil {
+		return nil, err
+	}
+	info := snap.info()
+	return &info, nil
+}
+
+// ListSnapshots lists the snapshots, oldest first
+func (vd *VirtualDisk) ListSnapshots() []SnapshotInfo {
+	vd.snapshots.mu.RLock()
+	defer vd.snapshots.mu.RUnlock()
+
+	infos := make([]SnapshotInfo, 0, len(vd.snapshots.snaps))
+	for _, snap := range vd.snapshots.snaps {
+		infos = append(infos, snap.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+	return infos
+}
+
+// OpenSnapshot returns a read-only view of a snapshot as an fs.FS, with the
+// persistent files at its root. It stays valid until the snapshot is deleted.
+func (vd *VirtualDisk) OpenSnapshot(name string) (fs.FS, error) {
+	snap, err := vd.snapshots.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotFS{backend: vd.snapshots, snap: snap}, nil
+}
+
+// DeleteSnapshot deletes a snapshot and the file content only it was keeping
+func (vd *VirtualDisk) DeleteSnapshot(name string) error {
+	return vd.snapshots.drop(name)
+}
+
+// RestoreSnapshot brings the persistent files back to the state of a
+// snapshot: files created since are deleted and files changed since are
+// restored. Other snapshots keep the content this replaces. It fails with
+// ErrLocked if any of the files it would change is leased. The restore is
+// not atomic; if it fails part way it can be repeated.
+func (vd *VirtualDisk) RestoreSnapshot(name string) error {
+	snap, err := vd.snapshots.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	unlock := vd.locks.lock(treeLock("", true))
+	defer unlock()
+
+	if err := vd.flushAll(); err != nil {
+		return err
+	}
+	current, err := vd.persistent.List("")
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	// Work out what changes: what the snapshot does not have is deleted,
+	// and files it no longer shares with the live tree are copied back
+	var removed []string
+	for _, info := range current {
+		if entry, ok := snap.Files[info.Path]; !ok || entry.IsDir != info.IsDir {
+			removed = append(removed, info.Path)
+		}
+	}
+	paths := make([]string, 0, len(snap.Files))
+	for path := range snap.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var restored []string
+	vd.snapshots.mu.RLock()
+	for _, path := range paths {
+		if !snap.Files[path].IsDir && snap.preserved[path] {
+			restored = append(restored, path)
+		}
+	}
+	vd.snapshots.mu.RUnlock()
+	if err := vd.checkLeases(nil, append(removed, restored...)...); err != nil {
+		return err
+	}
+
+	// Deleted deepest first
+	if err := deleteAll(vd.persistent, removed); err != nil {
+		return fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	for _, path := range paths {
+		if snap.Files[path].IsDir {
+			if err := vd.persistent.Mkdir(path); err != nil {
+				return fmt.Errorf("failed to restore snapshot: %w", err)
+			}
+		}
+	}
+	for _, path := range restored {
+		if err := copyFile(vd.snapshots.data, name+"/"+path, vd.persistent, path); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+	}
+
+	// Drop copies of the replaced content
+	for _, path := range append(removed, restored...) {
+		vd.dropBuffered(path)
+		if vd.cache != nil {
+			vd.cache.Remove(path)
+		}
+	}
+
+	for _, path := range removed {
+		vd.eventBus.Publish(events.Event{
+			Type:      events.EventFileDeleted,
+			Path:      path,
+			Timestamp: time.Now(),
+			Metadata: map[string]interface{}{
+				"snapshot": name,
+			},
+		})
+	}
+	for _, path := range restored {
+		vd.eventBus.Publish(events.Event{
+			Type:      events.EventFileModified,
+			Path:      path,
+			Timestamp: time.Now(),
+			Metadata: map[string]interface{}{
+				"snapshot": name,
+			},
+		})
+	}
+	return nil
+}
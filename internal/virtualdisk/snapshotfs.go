@@ -0,0 +1,178 @@
+package virtualdisk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// snapshotFS is a read-only view of a snapshot. Files that changed since the
+// snapshot are read from their preserved copies, the others from the live tree.
+type snapshotFS struct {
+	backend *SnapshotBackend
+	snap    *snapshot
+}
+
+var (
+	_ fs.ReadDirFS  = (*snapshotFS)(nil)
+	_ fs.ReadFileFS = (*snapshotFS)(nil)
+	_ fs.StatFS     = (*snapshotFS)(nil)
+)
+
+// Open opens a file or directory
+func (f *snapshotFS) Open(name string) (fs.File, error) {
+	info, err := f.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		list := func() ([]fs.DirEntry, error) { return f.readDir(info.Path), nil }
+		return &dirFile{name: name, info: info, list: list}, nil
+	}
+
+	b := f.backend
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if err := f.check("open", name); err != nil {
+		return nil, err
+	}
+	if f.snap.preserved[info.Path] {
+		reader, err := b.data.Open(f.snap.Name + "/" + info.Path)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+		}
+		return &readerFile{ReadCloser: reader, info: info}, nil
+	}
+
+	// The live file may change as soon as the lock is released, so read it whole
+	data, err := b.base.ReadFile(info.Path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: unwrapPathError(err)}
+	}
+	return &bufferedFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+// ReadFile reads a whole file
+func (f *snapshotFS) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if stat, _ := file.Stat(); stat.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: errors.New("is a directory")}
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: unwrapPathError(err)}
+	}
+	return data, nil
+}
+
+// Stat describes a file or directory as it was when the snapshot was taken
+func (f *snapshotFS) Stat(name string) (fs.FileInfo, error) {
+	return f.stat("stat", name)
+}
+
+// ReadDir lists a directory, sorted by name
+func (f *snapshotFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := f.stat("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return f.readDir(info.Path), nil
+}
+
+// check fails once the snapshot has been deleted. f.backend.mu must be held.
+func (f *snapshotFS) check(op, name string) error {
+	if f.backend.snaps[f.snap.Name] != f.snap {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// stat looks up a path in the snapshot index. Directories exist wherever
+// files do, even in backends without real ones.
+func (f *snapshotFS) stat(op, name string) (*fsFileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	f.backend.mu.RLock()
+	defer f.backend.mu.RUnlock()
+
+	if err := f.check(op, name); err != nil {
+		return nil, err
+	}
+	if name == "." {
+		return &fsFileInfo{FileInfo: FileInfo{IsDir: true, ModTime: f.snap.Created}}, nil
+	}
+	if entry, ok := f.snap.Files[name]; ok {
+		return entryInfo(name, entry), nil
+	}
+	for path := range f.snap.Files {
+		if strings.HasPrefix(path, name+"/") {
+			return &fsFileInfo{FileInfo: FileInfo{Path: name, IsDir: true}}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// readDir lists the direct children of a directory in the snapshot
+func (f *snapshotFS) readDir(path string) []fs.DirEntry {
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+
+	children := make(map[string]*fsFileInfo)
+	for filePath, entry := range f.snap.Files {
+		rest, ok := strings.CutPrefix(filePath, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		if name, _, nested := strings.Cut(rest, "/"); nested {
+			if _, ok := children[name]; !ok {
+				children[name] = &fsFileInfo{FileInfo: FileInfo{Path: prefix + name, IsDir: true}}
+			}
+			continue
+		}
+		children[rest] = entryInfo(filePath, entry)
+	}
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(child))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// entryInfo describes a snapshot entry
+func entryInfo(path string, entry snapshotEntry) *fsFileInfo {
+	return &fsFileInfo{FileInfo: FileInfo{
+		Path:    path,
+		IsDir:   entry.IsDir,
+		Size:    entry.Size,
+		Mode:    entry.Mode,
+		ModTime: entry.ModTime,
+	}}
+}
+
+// readerFile is an open file streamed from a backend
+type readerFile struct {
+	io.ReadCloser
+	info fs.FileInfo
+}
+
+func (f *readerFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
@@ -0,0 +1,331 @@
+package virtualdisk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	pathpkg "path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// ErrAttrNotFound is returned by GetAttr for attributes that are not set
+var ErrAttrNotFound = errors.New("attribute not found")
+
+// attrNamePattern restricts attribute names to what S3 object metadata keeps intact
+var attrNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// FileStat describes a file or directory in the virtual disk
+type FileStat struct {
+	Path        string            `json:"path"`
+	IsDir       bool              `json:"is_dir"`
+	Size        int64             `json:"size"`
+	StoredSize  int64             `json:"stored_size"` // size in storage, after compression
+	Compression string            `json:"compression,omitempty"`
+	Mode        fs.FileMode       `json:"mode"`
+	ModTime     time.Time         `json:"mod_time"`
+	ChangeTime  time.Time         `json:"change_time"` // last change to the content or attributes
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"` // hex SHA-256 of the content
+	StorageType StorageType       `json:"storage_type"`
+	Tier        Tier              `json:"tier,omitempty"` // persistent files only
+	Attrs       map[string]string `json:"attrs"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"` // when the file is due to be deleted
+}
+
+// digest is the cached checksum and content type of a file
+type digest struct {
+	size        int64
+	modTime     time.Time
+	checksum    string
+	contentType string
+}
+
+// digestCache remembers digests so Stat does not rehash unchanged files
+type digestCache struct {
+	entries map[string]digest
+	mu      sync.Mutex
+}
+
+// Stat returns detailed information about a file or directory
+func (vd *VirtualDisk) Stat(path string) (*FileStat, error) {
+	unlock := vd.locks.lock(fileLock(path, false))
+	defer unlock()
+
+	backend, relPath := vd.resolve(path)
+	stat := &FileStat{
+		Path:        path,
+		StorageType: vd.getStorageType(path),
+	}
+
+	if entry, ok := vd.buffered(path); ok && entry.Dirty {
+		// Not written back yet; the buffer holds the latest content
+		stat.Size = int64(len(entry.Data))
+		stat.StoredSize = stat.Size
+		stat.ModTime = entry.Modified
+		stat.Mode = 0644
+		stat.Tier = TierMemory
+		d, err := computeDigest(path, bytes.NewReader(entry.Data))
+		if err != nil {
+			return nil, err
+		}
+		stat.Checksum = d.checksum
+		stat.ContentType = d.contentType
+	} else {
+		info, err := backend.Stat(relPath)
+		if err != nil {
+			// Directories in backends without real ones exist wherever files do
+			if isDir, dirErr := statTree(backend, relPath); dirErr != nil || !isDir {
+				return nil, fmt.Errorf("failed to stat file: %w", err)
+			}
+			info = FileInfo{IsDir: true}
+		}
+
+		stat.IsDir = info.IsDir
+		stat.Size = info.Size
+		stat.StoredSize = info.Size
+		if info.Compression != "" {
+			stat.StoredSize = info.StoredSize
+			stat.Compression = info.Compression
+		}
+		stat.Mode = info.Mode
+		stat.ModTime = info.ModTime
+		if stat.Mode == 0 {
+			stat.Mode = 0644
+			if info.IsDir {
+				stat.Mode = fs.ModeDir | 0755
+			}
+		}
+
+		if !info.IsDir {
+			d, err := vd.fileDigest(path, backend, relPath, info)
+			if err != nil {
+				return nil, err
+			}
+			stat.Checksum = d.checksum
+			stat.ContentType = d.contentType
+
+			if stat.StorageType == StoragePersistent {
+				if stat.Tier, err = vd.tierOf(path); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	attrs, changed, err := attrsOf(backend, relPath)
+	if err != nil && !isNotExist(err) {
+		return nil, fmt.Errorf("failed to get attributes: %w", err)
+	}
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	stat.Attrs = attrs
+	stat.ChangeTime = stat.ModTime
+	if changed.After(stat.ChangeTime) {
+		stat.ChangeTime = changed
+	}
+	if !stat.IsDir {
+		stat.ExpiresAt = vd.expiresAt(path)
+	}
+
+	return stat, nil
+}
+
+// SetAttr sets a user-defined attribute on a file. Names are lower case
+// letters, digits, '.', '_' and '-', so they survive as S3 object metadata.
+func (vd *VirtualDisk) SetAttr(path, name, value string) error {
+	if !attrNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid attribute name: %q", name)
+	}
+	return vd.updateAttrs(path, func(attrs map[string]string) error {
+		attrs[name] = value
+		return nil
+	})
+}
+
+// RemoveAttr removes a user-defined attribute from a file
+func (vd *VirtualDisk) RemoveAttr(path, name string) error {
+	return vd.updateAttrs(path, func(attrs map[string]string) error {
+		if _, ok := attrs[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrAttrNotFound, name)
+		}
+		delete(attrs, name)
+		return nil
+	})
+}
+
+// GetAttr returns a user-defined attribute of a file
+func (vd *VirtualDisk) GetAttr(path, name string) (string, error) {
+	attrs, err := vd.ListAttrs(path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := attrs[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrAttrNotFound, name)
+	}
+	return value, nil
+}
+
+// ListAttrs returns all user-defined attributes of a file
+func (vd *VirtualDisk) ListAttrs(path string) (map[string]string, error) {
+	unlock := vd.locks.lock(fileLock(path, false))
+	defer unlock()
+
+	backend, relPath := vd.resolve(path)
+	attrs, _, err := attrsOf(backend, relPath)
+	if err != nil && !isNotExist(err) {
+		return nil, fmt.Errorf("failed to get attributes: %w", err)
+	}
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+
+	// Files that are only buffered have no attributes yet; anything else must exist
+	if _, ok := vd.buffered(path); !ok {
+		if _, err := statTree(backend, relPath); err != nil {
+			return nil, fmt.Errorf("failed to get attributes: %w", err)
+		}
+	}
+	return attrs, nil
+}
+
+// updateAttrs applies fn to the attributes of a file and stores the result
+func (vd *VirtualDisk) updateAttrs(path string, fn func(attrs map[string]string) error) error {
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	// Attributes are stored with the file, so it has to reach its backend first
+	if err := vd.flushPath(path); err != nil {
+		return err
+	}
+
+	backend, relPath := vd.resolve(path)
+	attrs, _, err := attrsOf(backend, relPath)
+	if err != nil {
+		return fmt.Errorf("failed to get attributes: %w", err)
+	}
+	if err := fn(attrs); err != nil {
+		return err
+	}
+	if err := setAttrs(backend, relPath, attrs); err != nil {
+		return fmt.Errorf("failed to set attributes: %w", err)
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileModified,
+		Path:      path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"attrs": attrs,
+		},
+	})
+
+	return nil
+}
+
+// fileDigest returns the checksum and content type of a file in a backend,
+// hashing it only if it changed since it was last hashed
+func (vd *VirtualDisk) fileDigest(path string, backend Backend, relPath string, info FileInfo) (digest, error) {
+	vd.digests.mu.Lock()
+	d, ok := vd.digests.entries[path]
+	vd.digests.mu.Unlock()
+	if ok && d.size == info.Size && d.modTime.Equal(info.ModTime) && !info.ModTime.IsZero() {
+		return d, nil
+	}
+
+	reader, err := backend.Open(relPath)
+	if err != nil {
+		return digest{}, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer reader.Close()
+
+	d, err = computeDigest(path, reader)
+	if err != nil {
+		return digest{}, err
+	}
+	d.size = info.Size
+	d.modTime = info.ModTime
+
+	vd.digests.mu.Lock()
+	vd.digests.entries[path] = d
+	vd.digests.mu.Unlock()
+	return d, nil
+}
+
+// forgetDigests drops cached digests of files that changed
+func (vd *VirtualDisk) forgetDigests(event events.Event) error {
+	if _, ok := event.Metadata["attrs"]; ok {
+		return nil // Only the attributes changed
+	}
+
+	paths := []string{event.Path}
+	if oldPath, ok := event.Metadata["old_path"].(string); ok {
+		paths = append(paths, oldPath)
+	}
+
+	vd.digests.mu.Lock()
+	defer vd.digests.mu.Unlock()
+
+	for _, path := range paths {
+		delete(vd.digests.entries, path)
+		if event.Type == events.EventFileRenamed {
+			for cached := range vd.digests.entries {
+				if strings.HasPrefix(cached, path+"/") {
+					delete(vd.digests.entries, cached)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// computeDigest hashes the content of a file and works out its content type
+func computeDigest(path string, r io.Reader) (digest, error) {
+	hash := sha256.New()
+	head := &headBuffer{limit: 512}
+	if _, err := io.Copy(io.MultiWriter(hash, head), r); err != nil {
+		return digest{}, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return digest{
+		checksum:    hex.EncodeToString(hash.Sum(nil)),
+		contentType: detectContentType(path, head.data),
+	}, nil
+}
+
+// detectContentType works out the content type of a file from its extension
+// if it has a known one, otherwise by sniffing the first 512 bytes
+func detectContentType(path string, head []byte) string {
+	if contentType := mime.TypeByExtension(pathpkg.Ext(path)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(head)
+}
+
+// headBuffer keeps the first limit bytes written to it
+type headBuffer struct {
+	data  []byte
+	limit int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if room := h.limit - len(h.data); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		h.data = append(h.data, p[:room]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,163 @@
+package virtualdisk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// FileWriter streams data into a virtual disk file. Close commits the file,
+// Abort discards everything written so far.
+type FileWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Create opens a writer for a file in the virtual disk. Data is streamed to
+// the backend serving the path and becomes visible when the writer is closed.
+// Memory files are necessarily held in memory and are stored on close.
+func (vd *VirtualDisk) Create(path string) (FileWriter, error) {
+	return vd.CreateWith(path, WriteOptions{})
+}
+
+// CreateWith opens a writer for a file in the virtual disk with options; the
+// options take effect when the writer is closed
+func (vd *VirtualDisk) CreateWith(path string, opts WriteOptions) (FileWriter, error) {
+	storageType := vd.getStorageType(path)
+	backend, relPath := vd.resolve(path)
+
+	if err := vd.checkLease(path, opts.LockToken); err != nil {
+		return nil, err
+	}
+	reservation, err := vd.reserveQuota(nil, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	w, err := backend.Create(relPath)
+	if err != nil {
+		vd.releaseQuota(reservation)
+		return nil, err
+	}
+
+	return &fileWriter{
+		FileWriter:  w,
+		vd:          vd,
+		path:        path,
+		storageType: storageType,
+		opts:        opts,
+		reservation: reservation,
+	}, nil
+}
+
+// Open opens a reader for a file in the virtual disk. The caller must close it.
+func (vd *VirtualDisk) Open(path string) (io.ReadCloser, error) {
+	unlock := vd.locks.lock(fileLock(path, false))
+	defer unlock()
+
+	var reader io.ReadCloser
+
+	if vd.cache != nil {
+		if data, ok := vd.cache.Get(path); ok {
+			vd.cache.Release(path)
+			reader = io.NopCloser(bytes.NewReader(data))
+		}
+	}
+
+	if reader == nil {
+		if entry, ok := vd.buffered(path); ok {
+			reader = io.NopCloser(bytes.NewReader(entry.Data))
+		}
+	}
+
+	if reader == nil {
+		backend, relPath := vd.resolve(path)
+		var err error
+		reader, err = backend.Open(relPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileAccessed,
+		Path:      path,
+		Timestamp: time.Now(),
+	})
+
+	return reader, nil
+}
+
+// fileWriter wraps a backend writer and updates the virtual disk state on commit
+type fileWriter struct {
+	FileWriter
+	vd          *VirtualDisk
+	path        string
+	storageType StorageType
+	opts        WriteOptions
+	size        int64
+	reservation *quotaReservation // quota usage held until the file is committed
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	reservation, err := w.vd.reserveQuota(w.reservation, w.path, w.size+int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	w.reservation = reservation
+	n, err := w.FileWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Close commits the file in the backend and drops stale buffered and cached copies
+func (w *fileWriter) Close() error {
+	vd := w.vd
+	unlock := vd.locks.lock(fileLock(w.path, true))
+	defer unlock()
+	defer vd.releaseQuota(w.reservation)
+
+	// The file may have been locked while it was being written
+	if err := vd.checkLease(w.path, w.opts.LockToken); err != nil {
+		w.FileWriter.Abort()
+		return err
+	}
+	if err := w.FileWriter.Close(); err != nil {
+		return err
+	}
+
+	// Drop stale copies; large streamed files are not pulled into the cache
+	vd.dropBuffered(w.path)
+	if vd.cache != nil {
+		vd.cache.Remove(w.path)
+	}
+	if w.storageType == StoragePersistent {
+		if err := vd.logCheckpoint(w.path); err != nil {
+			return err
+		}
+	}
+	if at := w.opts.expiry(); !at.IsZero() {
+		if err := vd.setExpiry(w.path, at); err != nil {
+			return err
+		}
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileCreated,
+		Path:      w.path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"size": w.size,
+		},
+	})
+
+	return nil
+}
+
+// Abort discards the file and the quota usage it held
+func (w *fileWriter) Abort() error {
+	w.vd.releaseQuota(w.reservation)
+	return w.FileWriter.Abort()
+}
@@ -0,0 +1,153 @@
+package virtualdisk
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// TieredBackend serves pinned files from memory in front of a base backend.
+// Pinned files keep their copy in the base backend, so pinning never affects
+// durability; writes go to the base backend and refresh the pinned copy.
+type TieredBackend struct {
+	hot  *MemoryBackend
+	base Backend
+}
+
+// NewTieredBackend creates a backend with an in-memory tier in front of base
+func NewTieredBackend(base Backend) *TieredBackend {
+	return &TieredBackend{
+		hot:  NewMemoryBackend(),
+		base: base,
+	}
+}
+
+// Base returns the backend holding the durable copy of every file
+func (b *TieredBackend) Base() Backend {
+	return b.base
+}
+
+// Pin holds a copy of a file in memory
+func (b *TieredBackend) Pin(path string, data []byte) error {
+	return b.hot.WriteFile(path, data)
+}
+
+// Unpin drops the in-memory copy of a file
+func (b *TieredBackend) Unpin(path string) error {
+	if !b.Pinned(path) {
+		return nil
+	}
+	return b.hot.Delete(path)
+}
+
+// Pinned reports whether a file is held in memory
+func (b *TieredBackend) Pinned(path string) bool {
+	info, err := b.hot.Stat(path)
+	return err == nil && !info.IsDir
+}
+
+// ReadFile reads the pinned copy, falling back to the base backend
+func (b *TieredBackend) ReadFile(path string) ([]byte, error) {
+	data, err := b.hot.ReadFile(path)
+	if err != nil && isNotExist(err) {
+		return b.base.ReadFile(path)
+	}
+	return data, err
+}
+
+// WriteFile writes to the base backend and refreshes the pinned copy
+func (b *TieredBackend) WriteFile(path string, data []byte) error {
+	if err := b.base.WriteFile(path, data); err != nil {
+		return err
+	}
+	if b.Pinned(path) {
+		return b.hot.WriteFile(path, data)
+	}
+	return nil
+}
+
+// Open streams the pinned copy, falling back to the base backend
+func (b *TieredBackend) Open(path string) (io.ReadCloser, error) {
+	reader, err := b.hot.Open(path)
+	if err != nil && isNotExist(err) {
+		return b.base.Open(path)
+	}
+	return reader, err
+}
+
+// Create unpins the file and streams it into the base backend
+func (b *TieredBackend) Create(path string) (FileWriter, error) {
+	if err := b.Unpin(path); err != nil {
+		return nil, err
+	}
+	return b.base.Create(path)
+}
+
+// Delete removes the file from memory and the base backend
+func (b *TieredBackend) Delete(path string) error {
+	if err := b.Unpin(path); err != nil {
+		return err
+	}
+	return b.base.Delete(path)
+}
+
+// Rename moves the file in the base backend, keeping pinned copies pinned
+func (b *TieredBackend) Rename(oldPath, newPath string) error {
+	if err := renameWithin(b.base, oldPath, newPath); err != nil {
+		return err
+	}
+	if err := b.Unpin(newPath); err != nil {
+		return err
+	}
+	if err := b.hot.Rename(oldPath, newPath); err != nil && !isNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Copy copies the file in the base backend; the copy starts out unpinned
+func (b *TieredBackend) Copy(srcPath, dstPath string) error {
+	if err := b.Unpin(dstPath); err != nil {
+		return err
+	}
+	return copyBetween(b.base, srcPath, b.base, dstPath)
+}
+
+// Attrs returns the attributes stored by the base backend
+func (b *TieredBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	return attrsOf(b.base, path)
+}
+
+// SetAttrs stores attributes in the base backend
+func (b *TieredBackend) SetAttrs(path string, attrs map[string]string) error {
+	return setAttrs(b.base, path, attrs)
+}
+
+// Mkdir creates the directory in the base backend
+func (b *TieredBackend) Mkdir(path string) error {
+	return b.base.Mkdir(path)
+}
+
+// Stat reports the base backend's copy
+func (b *TieredBackend) Stat(path string) (FileInfo, error) {
+	return b.base.Stat(path)
+}
+
+// List lists the base backend, which holds every file
+func (b *TieredBackend) List(prefix string) ([]FileInfo, error) {
+	return b.base.List(prefix)
+}
+
+// OpenFile opens a handle on the base backend. Files opened for writing are
+// unpinned, since the pinned copy would go stale.
+func (b *TieredBackend) OpenFile(path string, flag int) (BackendFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := b.Unpin(path); err != nil {
+			return nil, err
+		}
+	}
+	if opener, ok := b.base.(FileOpener); ok {
+		return opener.OpenFile(path, flag)
+	}
+	return openBuffered(b.base, path, flag)
+}
@@ -0,0 +1,472 @@
+package virtualdisk
+
+import (
+	"encoding/json"
+	"fmt"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// Tier is the physical location of a persistent file. The virtual path of a
+// file never changes when it moves between tiers.
+type Tier string
+
+const (
+	TierMemory Tier = "memory" // Pinned in memory, with a durable copy on disk
+	TierDisk   Tier = "disk"   // On the data partition, mirrored to S3 if configured
+	TierS3     Tier = "s3"     // Only in S3, fetched back on demand
+)
+
+// defaultTieringInterval is how often policies are evaluated when Config.TieringInterval is unset
+const defaultTieringInterval = time.Minute
+
+// defaultPromoteWindow is the read-counting window when TieringPolicy.PromoteWindow is unset
+const defaultPromoteWindow = time.Hour
+
+// TieringPolicy moves persistent files between tiers based on how they are
+// used. Policies are evaluated in order for every file they match and the
+// first one that calls for a move wins.
+type TieringPolicy struct {
+	Name string
+	// Pattern selects files: a prefix ending in "/", a glob matched against
+	// the whole path, or a glob without "/" matched against the file name.
+	// An empty pattern matches every file.
+	Pattern string
+	MinSize int64
+	MaxSize int64 // 0 means no limit
+
+	// PromoteTo moves a file to a hotter tier once it has been read
+	// PromoteReads times within PromoteWindow
+	PromoteTo     Tier
+	PromoteReads  int
+	PromoteWindow time.Duration
+
+	// DemoteTo moves a file to a colder tier once it has been neither read
+	// nor written for DemoteAfter
+	DemoteTo    Tier
+	DemoteAfter time.Duration
+}
+
+// accessStats tracks recent use of a file for tiering decisions
+type accessStats struct {
+	lastTouch time.Time
+	reads     []time.Time // most recent reads, oldest first
+}
+
+// tieringPolicyJSON is the declarative form of a TieringPolicy; durations are
+// strings such as "90s", "1h" or "7d"
+type tieringPolicyJSON struct {
+	Name          string `json:"name"`
+	Pattern       string `json:"pattern"`
+	MinSize       int64  `json:"min_size"`
+	MaxSize       int64  `json:"max_size"`
+	PromoteTo     Tier   `json:"promote_to"`
+	PromoteReads  int    `json:"promote_reads"`
+	PromoteWindow string `json:"promote_window"`
+	DemoteTo      Tier   `json:"demote_to"`
+	DemoteAfter   string `json:"demote_after"`
+}
+
+// ParseTieringPolicies parses a JSON list of tiering policies
+func ParseTieringPolicies(data []byte) ([]TieringPolicy, error) {
+	var raw []tieringPolicyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse tiering policies: %w", err)
+	}
+
+	policies := make([]TieringPolicy, 0, len(raw))
+	for _, r := range raw {
+		window, err := parseDuration(r.PromoteWindow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid promote_window in policy %q: %w", r.Name, err)
+		}
+		after, err := parseDuration(r.DemoteAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid demote_after in policy %q: %w", r.Name, err)
+		}
+		policies = append(policies, TieringPolicy{
+			Name:          r.Name,
+			Pattern:       r.Pattern,
+			MinSize:       r.MinSize,
+			MaxSize:       r.MaxSize,
+			PromoteTo:     r.PromoteTo,
+			PromoteReads:  r.PromoteReads,
+			PromoteWindow: window,
+			DemoteTo:      r.DemoteTo,
+			DemoteAfter:   after,
+		})
+	}
+	return policies, nil
+}
+
+// parseDuration extends time.ParseDuration with a "d" suffix for days
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// validateTieringPolicies checks that every policy names tiers that exist
+func validateTieringPolicies(policies []TieringPolicy, haveS3 bool) error {
+	for _, p := range policies {
+		for _, tier := range []Tier{p.PromoteTo, p.DemoteTo} {
+			switch tier {
+			case "", TierMemory, TierDisk:
+			case TierS3:
+				if !haveS3 {
+					return fmt.Errorf("tiering policy %q uses the s3 tier but S3 is not configured", p.Name)
+				}
+			default:
+				return fmt.Errorf("tiering policy %q: unknown tier %q", p.Name, tier)
+			}
+		}
+		if p.PromoteTo != "" && p.PromoteReads <= 0 {
+			return fmt.Errorf("tiering policy %q: promote_reads must be positive", p.Name)
+		}
+		if p.DemoteTo != "" && p.DemoteAfter <= 0 {
+			return fmt.Errorf("tiering policy %q: demote_after must be positive", p.Name)
+		}
+	}
+	return nil
+}
+
+// tierRank orders tiers from hottest to coldest
+func tierRank(tier Tier) int {
+	switch tier {
+	case TierMemory:
+		return 0
+	case TierDisk:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// matches reports whether the policy applies to a file
+func (p TieringPolicy) matches(path string, size int64) bool {
+	if size < p.MinSize || (p.MaxSize > 0 && size > p.MaxSize) {
+		return false
+	}
+	return matchPattern(p.Pattern, path)
+}
+
+// matchPattern reports whether a path matches a pattern: a prefix ending in
+// "/", a glob matched against the whole path, or a glob without "/" matched
+// against the file name. An empty pattern matches every path.
+func matchPattern(pattern, path string) bool {
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasSuffix(pattern, "/"):
+		return strings.HasPrefix(path, pattern)
+	case strings.Contains(pattern, "/"):
+		ok, _ := pathpkg.Match(pattern, path)
+		return ok
+	default:
+		ok, _ := pathpkg.Match(pattern, pathpkg.Base(path))
+		return ok
+	}
+}
+
+// target returns the tier the policy wants a file in, if it calls for a move
+func (p TieringPolicy) target(current Tier, stats *accessStats, now time.Time) (Tier, bool) {
+	if p.PromoteTo != "" && tierRank(p.PromoteTo) < tierRank(current) {
+		window := p.PromoteWindow
+		if window <= 0 {
+			window = defaultPromoteWindow
+		}
+		reads := 0
+		for _, t := range stats.reads {
+			if now.Sub(t) <= window {
+				reads++
+			}
+		}
+		if reads >= p.PromoteReads {
+			return p.PromoteTo, true
+		}
+	}
+	if p.DemoteTo != "" && tierRank(p.DemoteTo) > tierRank(current) {
+		if now.Sub(stats.lastTouch) >= p.DemoteAfter {
+			return p.DemoteTo, true
+		}
+	}
+	return "", false
+}
+
+// startTiering tracks file use and starts the policy engine
+func (vd *VirtualDisk) startTiering(policies []TieringPolicy, interval time.Duration) {
+	vd.policies = policies
+	vd.access = make(map[string]*accessStats)
+	vd.tieringStarted = time.Now()
+	for _, p := range policies {
+		if p.PromoteReads > vd.maxPromoteReads {
+			vd.maxPromoteReads = p.PromoteReads
+		}
+	}
+
+	vd.eventBus.Subscribe(events.EventFileAccessed, vd.recordAccess)
+	vd.eventBus.Subscribe(events.EventFileCreated, vd.recordAccess)
+	vd.eventBus.Subscribe(events.EventFileModified, vd.recordAccess)
+
+	if interval <= 0 {
+		interval = defaultTieringInterval
+	}
+	vd.wg.Add(1)
+	go vd.runTiering(interval)
+}
+
+// recordAccess updates the access statistics of persistent files. It runs
+// as an event handler, with the file locked.
+func (vd *VirtualDisk) recordAccess(event events.Event) error {
+	if vd.getStorageType(event.Path) != StoragePersistent {
+		return nil
+	}
+
+	vd.accessMu.Lock()
+	defer vd.accessMu.Unlock()
+
+	stats, ok := vd.access[event.Path]
+	if !ok {
+		stats = &accessStats{}
+		vd.access[event.Path] = stats
+	}
+	stats.lastTouch = event.Timestamp
+	if event.Type == events.EventFileAccessed && vd.maxPromoteReads > 0 {
+		// Only the most recent reads can decide a promotion
+		stats.reads = append(stats.reads, event.Timestamp)
+		if len(stats.reads) > vd.maxPromoteReads {
+			stats.reads = stats.reads[len(stats.reads)-vd.maxPromoteReads:]
+		}
+	}
+	return nil
+}
+
+// runTiering periodically applies the tiering policies
+func (vd *VirtualDisk) runTiering(interval time.Duration) {
+	defer vd.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-vd.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := vd.ApplyTieringPolicies(); err != nil {
+			// Log error and try again on the next tick
+			fmt.Printf("failed to apply tiering policies: %v\n", err)
+		}
+	}
+}
+
+// ApplyTieringPolicies evaluates the tiering policies against every
+// persistent file and moves the files they select
+func (vd *VirtualDisk) ApplyTieringPolicies() error {
+	if len(vd.policies) == 0 {
+		return nil
+	}
+
+	files, err := vd.tiered.List("")
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	onDisk := make(map[string]bool)
+	if vd.mirror != nil {
+		local, err := vd.disk.List("")
+		if err != nil {
+			return fmt.Errorf("failed to list files: %w", err)
+		}
+		for _, info := range local {
+			onDisk[info.Path] = true
+		}
+	}
+
+	now := time.Now()
+	moves := make(map[string]Tier)
+	seen := make(map[string]bool, len(files))
+
+	vd.accessMu.Lock()
+	for _, info := range files {
+		if info.IsDir || vd.getStorageType(info.Path) != StoragePersistent {
+			continue
+		}
+		seen[info.Path] = true
+
+		current := TierDisk
+		switch {
+		case vd.tiered.Pinned(info.Path):
+			current = TierMemory
+		case vd.mirror != nil && !onDisk[info.Path]:
+			current = TierS3
+		}
+
+		// Use before startup is not known, so files not used since count as
+		// touched at startup, or when last modified if that is later; a file
+		// read all the time is not demoted just because the disk restarted
+		stats := accessStats{lastTouch: vd.tieringStarted}
+		if s, ok := vd.access[info.Path]; ok {
+			stats = *s
+		}
+		if modified, err := time.Parse(time.RFC3339, info.Modified); err == nil && modified.After(stats.lastTouch) {
+			stats.lastTouch = modified
+		}
+
+		for _, p := range vd.policies {
+			if !p.matches(info.Path, info.Size) {
+				continue
+			}
+			if tier, ok := p.target(current, &stats, now); ok {
+				moves[info.Path] = tier
+				break
+			}
+		}
+	}
+
+	// Forget files that no longer exist
+	for path := range vd.access {
+		if !seen[path] {
+			delete(vd.access, path)
+		}
+	}
+	vd.accessMu.Unlock()
+
+	var firstErr error
+	for path, tier := range moves {
+		if err := vd.MoveToTier(path, tier); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Tier reports which tier a persistent file is stored in
+func (vd *VirtualDisk) Tier(path string) (Tier, error) {
+	if vd.getStorageType(path) != StoragePersistent {
+		return "", fmt.Errorf("tiering only applies to persistent files: %s", path)
+	}
+
+	unlock := vd.locks.lock(fileLock(path, false))
+	defer unlock()
+
+	if entry, ok := vd.buffered(path); ok && entry.Dirty {
+		return TierMemory, nil
+	}
+	return vd.tierOf(path)
+}
+
+// MoveToTier moves a persistent file to the given tier. Its virtual path and
+// contents are unchanged.
+func (vd *VirtualDisk) MoveToTier(path string, tier Tier) error {
+	if vd.getStorageType(path) != StoragePersistent {
+		return fmt.Errorf("tiering only applies to persistent files: %s", path)
+	}
+	if tier == TierS3 && vd.mirror == nil {
+		return fmt.Errorf("S3 is not configured")
+	}
+
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	// Make sure the tiers hold the latest contents
+	if err := vd.flushPath(path); err != nil {
+		return err
+	}
+
+	current, err := vd.tierOf(path)
+	if err != nil {
+		return err
+	}
+	if current == tier {
+		return nil
+	}
+
+	switch tier {
+	case TierMemory:
+		if current == TierS3 {
+			if err := vd.mirror.fetch(path); err != nil {
+				return fmt.Errorf("failed to fetch file from S3: %w", err)
+			}
+		}
+		data, err := vd.tiered.Base().ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+		if err := vd.tiered.Pin(path, data); err != nil {
+			return err
+		}
+	case TierDisk:
+		if err := vd.tiered.Unpin(path); err != nil {
+			return err
+		}
+		if current == TierS3 {
+			if err := vd.mirror.fetch(path); err != nil {
+				return fmt.Errorf("failed to fetch file from S3: %w", err)
+			}
+		}
+	case TierS3:
+		if err := vd.tiered.Unpin(path); err != nil {
+			return err
+		}
+		if err := vd.mirror.push(path); err != nil {
+			return fmt.Errorf("failed to upload file to S3: %w", err)
+		}
+		if err := vd.disk.Delete(path); err != nil {
+			return err
+		}
+		if vd.cache != nil {
+			vd.cache.Remove(path)
+		}
+	default:
+		return fmt.Errorf("unknown tier: %s", tier)
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileTiered,
+		Path:      path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"from": current,
+			"to":   tier,
+		},
+	})
+
+	return nil
+}
+
+// tierOf finds the tier holding a persistent file. The file must be locked.
+func (vd *VirtualDisk) tierOf(path string) (Tier, error) {
+	if vd.tiered.Pinned(path) {
+		return TierMemory, nil
+	}
+
+	info, err := vd.disk.Stat(path)
+	if err == nil {
+		if info.IsDir {
+			return "", fmt.Errorf("%s is a directory", path)
+		}
+		return TierDisk, nil
+	}
+	if !isNotExist(err) || vd.mirror == nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if _, err := vd.mirror.Secondary().Stat(path); err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	return TierS3, nil
+}
@@ -0,0 +1,310 @@
+package virtualdisk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+)
+
+// maxTrashExpiryInterval caps how long expired files may linger in the trash
+const maxTrashExpiryInterval = time.Hour
+
+// TrashEntry describes a deleted persistent file kept in the trash
+type TrashEntry struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"` // where the file was deleted from
+	Deleted time.Time `json:"deleted"`
+	Size    int64     `json:"size"`
+}
+
+// trash keeps deleted files until they are restored, purged or expire. Their
+// content is stored in data under the entry ID; the entries are kept in an
+// index file.
+type trash struct {
+	data    Backend
+	index   string
+	entries map[string]*TrashEntry
+	mu      sync.Mutex
+}
+
+// openTrash loads the trash index. Content without an entry, left behind by
+// a crash, is removed.
+func openTrash(data Backend, index string) (*trash, error) {
+	t := &trash{
+		data:    data,
+		index:   index,
+		entries: make(map[string]*TrashEntry),
+	}
+
+	raw, err := os.ReadFile(index)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read trash index: %w", err)
+	default:
+		if err := json.Unmarshal(raw, &t.entries); err != nil {
+			return nil, fmt.Errorf("failed to parse trash index: %w", err)
+		}
+	}
+
+	infos, err := data.List("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash: %w", err)
+	}
+	for _, info := range infos {
+		if _, ok := t.entries[info.Path]; !ok && !info.IsDir {
+			if err := data.Delete(info.Path); err != nil {
+				return nil, fmt.Errorf("failed to clean up trash: %w", err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// save writes the index. t.mu must be held.
+func (t *trash) save() error {
+	data, err := json.Marshal(t.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode trash index: %w", err)
+	}
+
+	// Replace the index atomically so a crash never leaves it half written
+	if err := writeFileAtomic(t.index, data); err != nil {
+		return fmt.Errorf("failed to write trash index: %w", err)
+	}
+	return nil
+}
+
+// put copies a file from backend into the trash
+func (t *trash) put(backend Backend, path string) (*TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := backend.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs sort by deletion time; bump them past entries deleted in the same instant
+	deleted := time.Now().UTC()
+	id := deleted.Format(versionIDFormat)
+	for t.entries[id] != nil {
+		deleted = deleted.Add(time.Nanosecond)
+		id = deleted.Format(versionIDFormat)
+	}
+
+	if err := copyFile(backend, path, t.data, id); err != nil {
+		return nil, fmt.Errorf("failed to move %s to the trash: %w", path, err)
+	}
+	entry := &TrashEntry{
+		ID:      id,
+		Path:    path,
+		Deleted: deleted,
+		Size:    info.Size,
+	}
+	t.entries[id] = entry
+	if err := t.save(); err != nil {
+		delete(t.entries, id)
+		t.data.Delete(id)
+		return nil, err
+	}
+	return entry, nil
+}
+
+// lookup returns an entry
+func (t *trash) lookup(id string) (TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[id]
+	if !ok {
+		return TrashEntry{}, fmt.Errorf("trash entry %s: %w", id, fs.ErrNotExist)
+	}
+	return *entry, nil
+}
+
+// remove deletes an entry and its content
+func (t *trash) remove(id string) error {
+	removed, err := t.purge(func(entry *TrashEntry) bool { return entry.ID == id })
+	if err == nil && removed == 0 {
+		return fmt.Errorf("trash entry %s: %w", id, fs.ErrNotExist)
+	}
+	return err
+}
+
+// purge deletes the entries match selects along with their content and
+// returns how many there were
+func (t *trash) purge(match func(entry *TrashEntry) bool) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ids []string
+	for id, entry := range t.entries {
+		if match(entry) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Drop the entries first; content left behind by a crash is removed on load
+	for _, id := range ids {
+		delete(t.entries, id)
+	}
+	if err := t.save(); err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if err := t.data.Delete(id); err != nil && !isNotExist(err) {
+			return 0, fmt.Errorf("failed to purge %s: %w", id, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// list returns the entries, oldest first
+func (t *trash) list() []TrashEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]TrashEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// trashFile moves a persistent file into the trash and deletes it, or just
+// deletes it if the trash is disabled. Buffered writes must have been written
+// back. The file must be locked exclusively.
+func (vd *VirtualDisk) trashFile(path string) (*TrashEntry, error) {
+	if vd.trash == nil || vd.getStorageType(path) != StoragePersistent {
+		return nil, vd.removeThrough(path)
+	}
+
+	entry, err := vd.trash.put(vd.persistent, path)
+	if err != nil && !isNotExist(err) {
+		return nil, err
+	}
+	if err := vd.persistent.Delete(path); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// runTrashExpiry periodically purges files deleted longer ago than the retention
+func (vd *VirtualDisk) runTrashExpiry(retention time.Duration) {
+	defer vd.wg.Done()
+
+	interval := retention / 2
+	if interval > maxTrashExpiryInterval {
+		interval = maxTrashExpiryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-vd.done:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := vd.trash.purge(func(entry *TrashEntry) bool {
+			return time.Since(entry.Deleted) > retention
+		})
+		if err != nil {
+			fmt.Printf("failed to expire trash: %v\n", err)
+		}
+	}
+}
+
+// ListTrash lists the deleted files in the trash, oldest first
+func (vd *VirtualDisk) ListTrash() ([]TrashEntry, error) {
+	if vd.trash == nil {
+		return nil, fmt.Errorf("trash is not enabled")
+	}
+	return vd.trash.list(), nil
+}
+
+// Restore puts a file from the trash back where it was deleted from. It
+// fails if another file has taken its place since.
+func (vd *VirtualDisk) Restore(id string) error {
+	return vd.RestoreWith(id, WriteOptions{})
+}
+
+// RestoreWith puts a file from the trash back where it was deleted from with
+// options
+func (vd *VirtualDisk) RestoreWith(id string, opts WriteOptions) error {
+	if vd.trash == nil {
+		return fmt.Errorf("trash is not enabled")
+	}
+	entry, err := vd.trash.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	unlock := vd.locks.lock(fileLock(entry.Path, true))
+	defer unlock()
+
+	if err := vd.checkLease(entry.Path, opts.LockToken); err != nil {
+		return err
+	}
+	_, buffered := vd.buffered(entry.Path)
+	if _, err := vd.persistent.Stat(entry.Path); buffered || err == nil {
+		return fmt.Errorf("failed to restore %s: %w", entry.Path, fs.ErrExist)
+	} else if !isNotExist(err) {
+		return fmt.Errorf("failed to restore %s: %w", entry.Path, err)
+	}
+	reservation, err := vd.reserveQuota(nil, entry.Path, entry.Size)
+	if err != nil {
+		return err
+	}
+	defer vd.releaseQuota(reservation)
+
+	if err := copyFile(vd.trash.data, id, vd.persistent, entry.Path); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", entry.Path, err)
+	}
+	if err := vd.logCheckpoint(entry.Path); err != nil {
+		return err
+	}
+	if err := vd.trash.remove(id); err != nil {
+		return err
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileCreated,
+		Path:      entry.Path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"size":  entry.Size,
+			"trash": id,
+		},
+	})
+	return nil
+}
+
+// Purge permanently deletes a file from the trash
+func (vd *VirtualDisk) Purge(id string) error {
+	if vd.trash == nil {
+		return fmt.Errorf("trash is not enabled")
+	}
+	return vd.trash.remove(id)
+}
+
+// EmptyTrash permanently deletes every file in the trash and returns how
+// many there were
+func (vd *VirtualDisk) EmptyTrash() (int, error) {
+	if vd.trash == nil {
+		return 0, fmt.Errorf("trash is not enabled")
+	}
+	return vd.trash.purge(func(entry *TrashEntry) bool { return true })
+}
@@ -0,0 +1,563 @@
+package virtualdisk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+	"github.com/vikasavn/virtual_disk_go/internal/journal"
+)
+
+// ErrTxDone is returned when a transaction is used after it was committed or
+// rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// txOpKind identifies an operation staged in a transaction
+type txOpKind int
+
+const (
+	txWrite txOpKind = iota
+	txDelete
+	txRename
+)
+
+// txOp is an operation staged in a transaction
+type txOp struct {
+	kind    txOpKind
+	path    string
+	newPath string // where a renamed file moves to
+	data    []byte
+}
+
+// paths returns the paths an operation changes
+func (op txOp) paths() []string {
+	if op.kind == txRename {
+		return []string{op.path, op.newPath}
+	}
+	return []string{op.path}
+}
+
+// txFile is a file as a transaction sees it
+type txFile struct {
+	data   []byte
+	exists bool
+}
+
+// Tx stages writes, deletes and renames of files that become visible together
+// when it is committed, or not at all. Readers never observe some of them
+// applied and others not. Persistent files are also protected against
+// crashes: a commit that was interrupted is completed when the disk is opened
+// again. Leases held on the files apply to it; see UseLease. A Tx is not safe
+// for concurrent use.
+type Tx struct {
+	vd     *VirtualDisk
+	ops    []txOp
+	tokens []string // tokens of the leases the transaction may change files under
+	done   bool
+}
+
+// Begin starts a transaction
+func (vd *VirtualDisk) Begin() *Tx {
+	return &Tx{vd: vd}
+}
+
+// stage adds an operation to the transaction
+func (tx *Tx) stage(op txOp) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// WriteFile stages writing data to a file
+func (tx *Tx) WriteFile(path string, data []byte) error {
+	return tx.stage(txOp{kind: txWrite, path: path, data: data})
+}
+
+// DeleteFile stages deleting a file. Persistent files are moved into the
+// trash if it is enabled.
+func (tx *Tx) DeleteFile(path string) error {
+	return tx.stage(txOp{kind: txDelete, path: path})
+}
+
+// UseLease lets the transaction change the file an exclusive lease is held
+// on, given the token of the lease; see VirtualDisk.Lock
+func (tx *Tx) UseLease(token string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.tokens = append(tx.tokens, token)
+	return nil
+}
+
+// Rename stages moving a file to a new path, replacing any file there.
+// Directories cannot be renamed in a transaction.
+func (tx *Tx) Rename(oldPath, newPath string) error {
+	if oldPath == newPath && !tx.done {
+		return nil
+	}
+	return tx.stage(txOp{kind: txRename, path: oldPath, newPath: newPath})
+}
+
+// Commit applies the staged operations in order. They are checked against
+// each other and the files on disk first, so a delete or rename of a file
+// that does not exist, or one that would exceed a quota or change a leased
+// file without its token, fails the commit before anything is changed; if applying them fails, those already applied
+// are undone.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return tx.vd.commit(tx.ops, tx.tokens)
+}
+
+// Rollback discards the staged operations
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	return nil
+}
+
+// commit applies the operations of a transaction, which may change files
+// under the leases with tokens
+func (vd *VirtualDisk) commit(ops []txOp, tokens []string) error {
+	if err := vd.settleTx(); err != nil {
+		return err
+	}
+
+	var locks []pathLock
+	var paths []string
+	for _, op := range ops {
+		for _, path := range op.paths() {
+			locks = append(locks, fileLock(path, true))
+			paths = append(paths, path)
+		}
+	}
+	unlock := vd.locks.lock(locks...)
+	defer unlock()
+
+	if err := vd.checkLeases(tokens, paths...); err != nil {
+		return err
+	}
+
+	// Work out what each file ends up as, checking every operation against
+	// the ones before it
+	before := make(map[string]txFile)
+	after := make(map[string]txFile)
+	lookup := func(path string) (txFile, error) {
+		if file, ok := after[path]; ok {
+			return file, nil
+		}
+		file, err := vd.readForTx(path)
+		if err != nil {
+			return txFile{}, err
+		}
+		before[path] = file
+		after[path] = file
+		return file, nil
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case txWrite:
+			if _, err := lookup(op.path); err != nil {
+				return fmt.Errorf("failed to write %s: %w", op.path, err)
+			}
+			after[op.path] = txFile{data: op.data, exists: true}
+		case txDelete:
+			file, err := lookup(op.path)
+			if err == nil && !file.exists {
+				err = fs.ErrNotExist
+			}
+			if err != nil {
+				return fmt.Errorf("failed to delete %s: %w", op.path, err)
+			}
+			after[op.path] = txFile{}
+		case txRename:
+			file, err := lookup(op.path)
+			if err == nil && !file.exists {
+				err = fs.ErrNotExist
+			}
+			if err == nil {
+				_, err = lookup(op.newPath)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to rename %s: %w", op.path, err)
+			}
+			after[op.newPath] = file
+			after[op.path] = txFile{}
+		}
+	}
+
+	if len(vd.usage.quotas) > 0 {
+		changes := make(map[string]*usageEntry)
+		for path, file := range after {
+			changes[path] = nil
+			if file.exists {
+				size := int64(len(file.data))
+				changes[path] = &usageEntry{storageType: vd.getStorageType(path), size: size, stored: size}
+			}
+		}
+		reservation, err := vd.usage.reserve(nil, changes)
+		if err != nil {
+			return err
+		}
+		defer vd.usage.release(reservation)
+	}
+
+	// Log the outcome for persistent files before changing any of them, so
+	// a crash part way through can be recovered from
+	var records []journal.Record
+	var persistent []string
+	for path, file := range after {
+		if vd.getStorageType(path) != StoragePersistent {
+			continue
+		}
+		persistent = append(persistent, path)
+		if file.exists {
+			records = append(records, journal.Record{Op: journal.OpWrite, Path: path, Data: file.data})
+		} else if before[path].exists {
+			records = append(records, journal.Record{Op: journal.OpDelete, Path: path})
+		}
+	}
+	if len(records) > 0 {
+		records = append(records, journal.Record{Op: journal.OpCommit})
+	}
+
+	published, err := vd.applyTx(ops, records, before, persistent)
+	if err != nil {
+		return err
+	}
+	for _, event := range published {
+		vd.eventBus.Publish(event)
+	}
+	return nil
+}
+
+// applyTx logs the records of a transaction, applies its operations in order
+// and returns the events to publish. If one fails, the files as they were
+// before are put back; if that fails too, the log is kept and the commit is
+// completed before the next one, or on the next start.
+func (vd *VirtualDisk) applyTx(ops []txOp, records []journal.Record, before map[string]txFile, persistent []string) ([]events.Event, error) {
+	// Listings must not see some of the operations applied and others not.
+	// The log is shared, so one transaction is logged and applied at a time.
+	vd.txMu.Lock()
+	defer vd.txMu.Unlock()
+
+	if vd.txKept {
+		return nil, fmt.Errorf("failed to commit transaction: an earlier transaction is being completed")
+	}
+	if len(records) > 0 {
+		sealed, err := vd.sealRecords(records)
+		if err != nil {
+			return nil, err
+		}
+		if err := vd.txLog.Append(sealed...); err != nil {
+			return nil, err
+		}
+	}
+
+	var published []events.Event
+	for i, op := range ops {
+		event, err := vd.applyTxOp(op)
+		if err != nil {
+			touched := make(map[string]bool)
+			for _, op := range ops[:i+1] {
+				for _, path := range op.paths() {
+					touched[path] = true
+				}
+			}
+			if undoErr := vd.undoTx(before, touched); undoErr != nil {
+				vd.txKept = true
+				return nil, fmt.Errorf("failed to commit transaction: %w; failed to undo it: %w", err, undoErr)
+			}
+			if err := vd.txLog.Truncate(); err != nil {
+				fmt.Printf("failed to clear transaction log: %v\n", err)
+			}
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		published = append(published, event)
+	}
+
+	// Every backend write, delete and rename above is synced before it
+	// returns, so the log can be dropped. Older journal records must not be
+	// replayed over the committed files.
+	if err := vd.logCheckpoint(persistent...); err != nil {
+		return nil, err
+	}
+	if err := vd.txLog.Truncate(); err != nil {
+		return nil, err
+	}
+	return published, nil
+}
+
+// readForTx returns the current content of a file, which must not be a
+// directory. The file must be locked.
+func (vd *VirtualDisk) readForTx(path string) (txFile, error) {
+	if path == "" {
+		return txFile{}, fmt.Errorf("the root directory is not a file")
+	}
+	if entry, ok := vd.buffered(path); ok {
+		return txFile{data: entry.Data, exists: true}, nil
+	}
+
+	backend, relPath := vd.resolve(path)
+	info, err := backend.Stat(relPath)
+	if isNotExist(err) {
+		return txFile{}, nil
+	}
+	if err != nil {
+		return txFile{}, err
+	}
+	if info.IsDir {
+		return txFile{}, fmt.Errorf("%s is a directory", path)
+	}
+	data, err := backend.ReadFile(relPath)
+	if err != nil {
+		return txFile{}, err
+	}
+	return txFile{data: data, exists: true}, nil
+}
+
+// applyTxOp applies one operation of a transaction and returns the event to
+// publish once all of them are applied. Its paths must be locked exclusively.
+func (vd *VirtualDisk) applyTxOp(op txOp) (events.Event, error) {
+	now := time.Now()
+	switch op.kind {
+	case txWrite:
+		vd.dropBuffered(op.path)
+		if err := vd.writeThrough(op.path, op.data); err != nil {
+			return events.Event{}, err
+		}
+		if vd.cache != nil {
+			vd.cache.Put(op.path, op.data, int64(len(op.data)))
+			vd.cache.Release(op.path)
+		}
+		return events.Event{
+			Type:      events.EventFileCreated,
+			Path:      op.path,
+			Timestamp: now,
+			Metadata: map[string]interface{}{
+				"data": op.data,
+				"size": len(op.data),
+			},
+		}, nil
+
+	case txDelete:
+		// The trash needs the latest content
+		if vd.trash != nil && vd.getStorageType(op.path) == StoragePersistent {
+			if _, err := vd.writeBack(op.path); err != nil {
+				return events.Event{}, err
+			}
+		}
+		vd.dropBuffered(op.path)
+		if vd.cache != nil {
+			vd.cache.Remove(op.path)
+		}
+		entry, err := vd.trashFile(op.path)
+		if err != nil {
+			return events.Event{}, err
+		}
+		var metadata map[string]interface{}
+		if entry != nil {
+			metadata = map[string]interface{}{
+				"trash": entry.ID,
+			}
+		}
+		return events.Event{
+			Type:      events.EventFileDeleted,
+			Path:      op.path,
+			Timestamp: now,
+			Metadata:  metadata,
+		}, nil
+
+	default:
+		for _, path := range op.paths() {
+			if _, err := vd.writeBack(path); err != nil {
+				return events.Event{}, err
+			}
+			if vd.cache != nil {
+				vd.cache.Remove(path)
+			}
+		}
+		srcBackend, srcRel := vd.resolve(op.path)
+		dstBackend, dstRel := vd.resolve(op.newPath)
+		var err error
+		if vd.mountFor(op.path) == vd.mountFor(op.newPath) {
+			err = renameWithin(srcBackend, srcRel, dstRel)
+		} else {
+			err = moveTree(srcBackend, srcRel, dstBackend, dstRel)
+		}
+		if err != nil {
+			return events.Event{}, err
+		}
+		return events.Event{
+			Type:      events.EventFileRenamed,
+			Path:      op.newPath,
+			Timestamp: now,
+			Metadata: map[string]interface{}{
+				"old_path": op.path,
+				"new_path": op.newPath,
+				"is_dir":   false,
+			},
+		}, nil
+	}
+}
+
+// undoTx puts back the files a failed commit may have changed. They must be
+// locked exclusively.
+func (vd *VirtualDisk) undoTx(before map[string]txFile, touched map[string]bool) error {
+	var firstErr error
+	for path := range touched {
+		vd.dropBuffered(path)
+		if vd.cache != nil {
+			vd.cache.Remove(path)
+		}
+		var err error
+		if file := before[path]; file.exists {
+			err = vd.writeThrough(path, file.data)
+		} else if err = vd.removeThrough(path); isNotExist(err) {
+			err = nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+	}
+	return firstErr
+}
+
+// openTxLog opens the transaction log and completes a commit that a crash
+// interrupted. A commit whose records were not all logged had not started to
+// change anything and is dropped.
+func (vd *VirtualDisk) openTxLog() error {
+	if err := os.MkdirAll(vd.metaPath(), 0755); err != nil {
+		return fmt.Errorf("failed to create transaction log directory: %w", err)
+	}
+
+	j, err := journal.Open(vd.metaPath("tx.log"))
+	if err != nil {
+		return err
+	}
+
+	committed, err := committedTx(j)
+	if err == nil {
+		err = vd.redoTx(committed)
+	}
+	if err == nil {
+		err = j.Truncate()
+	}
+	if err != nil {
+		j.Close()
+		return fmt.Errorf("failed to recover transaction: %w", err)
+	}
+
+	vd.txLog = j
+	return nil
+}
+
+// committedTx returns the records of the commits in a transaction log that
+// were logged in full
+func committedTx(j *journal.Journal) ([]journal.Record, error) {
+	var pending, committed []journal.Record
+	err := j.Replay(func(rec journal.Record) error {
+		if rec.Op == journal.OpCommit {
+			committed = append(committed, pending...)
+			pending = nil
+		} else {
+			pending = append(pending, rec)
+		}
+		return nil
+	})
+	return committed, err
+}
+
+// redoTx writes and deletes persistent files as logged by a commit. The files
+// must be locked.
+func (vd *VirtualDisk) redoTx(records []journal.Record) error {
+	for _, rec := range records {
+		var err error
+		switch rec.Op {
+		case journal.OpWrite:
+			var data []byte
+			if data, err = vd.openData(rec.Data); err == nil {
+				err = vd.persistent.WriteFile(rec.Path, data)
+			}
+		case journal.OpDelete:
+			if _, err = vd.trashFile(rec.Path); isNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleTx completes a commit that was kept in the log because undoing it
+// failed, so a later commit can't drop it from the log
+func (vd *VirtualDisk) settleTx() error {
+	vd.txMu.RLock()
+	kept := vd.txKept
+	vd.txMu.RUnlock()
+	if !kept {
+		return nil
+	}
+
+	records, err := committedTx(vd.txLog)
+	if err != nil {
+		return fmt.Errorf("failed to complete earlier transaction: %w", err)
+	}
+	var locks []pathLock
+	var paths []string
+	for _, rec := range records {
+		locks = append(locks, fileLock(rec.Path, true))
+		paths = append(paths, rec.Path)
+	}
+	unlock := vd.locks.lock(locks...)
+	defer unlock()
+
+	settled, err := func() (bool, error) {
+		vd.txMu.Lock()
+		defer vd.txMu.Unlock()
+		if !vd.txKept {
+			return false, nil
+		}
+		for _, path := range paths {
+			vd.dropBuffered(path)
+			if vd.cache != nil {
+				vd.cache.Remove(path)
+			}
+		}
+		if err := vd.redoTx(records); err != nil {
+			return false, fmt.Errorf("failed to complete earlier transaction: %w", err)
+		}
+		if err := vd.logCheckpoint(paths...); err != nil {
+			return false, err
+		}
+		if err := vd.txLog.Truncate(); err != nil {
+			return false, err
+		}
+		vd.txKept = false
+		return true, nil
+	}()
+	if !settled {
+		return err
+	}
+
+	for _, rec := range records {
+		event := events.Event{Type: events.EventFileModified, Path: rec.Path, Timestamp: time.Now()}
+		if rec.Op == journal.OpDelete {
+			event.Type = events.EventFileDeleted
+		}
+		vd.eventBus.Publish(event)
+	}
+	return nil
+}
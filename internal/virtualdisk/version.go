@@ -0,0 +1,739 @@
+package virtualdisk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vikasavn/virtual_disk_go/internal/events"
+	"github.com/vikasavn/virtual_disk_go/internal/s3store"
+)
+
+// VersionInfo describes a previous version of a persistent file
+type VersionInfo struct {
+	ID       string    `json:"id"`
+	Size     int64     `json:"size"`
+	Replaced time.Time `json:"replaced"` // when a newer version replaced it
+}
+
+// versionStore keeps the previous versions of files
+type versionStore interface {
+	// save keeps the current content of a file in base as a new version
+	save(base Backend, path string) error
+	// versions lists the versions of a file, newest first. Sizes may be
+	// those of the stored data.
+	versions(path string) ([]VersionInfo, error)
+	// all lists the versions of every file that has any, like versions
+	all() (map[string][]VersionInfo, error)
+	// size returns the size of the content of a version
+	size(path, id string) (int64, error)
+	// open streams a version of a file
+	open(path, id string) (io.ReadCloser, error)
+	// remove deletes a version of a file
+	remove(path, id string) error
+}
+
+// VersionBackend keeps previous versions of the files in a base backend.
+// Whenever a file is overwritten, through a write, a copy, a rename or a
+// handle, or deleted, its previous content is kept as a version. The newest
+// versions are kept up to a count and an age.
+type VersionBackend struct {
+	base   Backend
+	store  versionStore
+	keep   int
+	maxAge time.Duration // 0 keeps versions regardless of age
+	locks  *lockManager  // serializes changes to the versions of each file
+}
+
+// NewVersionBackend creates a backend keeping up to keep previous versions of
+// each file in base, none older than maxAge
+func NewVersionBackend(base Backend, store versionStore, keep int, maxAge time.Duration) *VersionBackend {
+	return &VersionBackend{
+		base:   base,
+		store:  store,
+		keep:   keep,
+		maxAge: maxAge,
+		locks:  newLockManager(),
+	}
+}
+
+// record runs fn, which overwrites path in the base backend, once the
+// current content of path has been kept as a version. Only changes to the
+// same file wait for each other.
+func (b *VersionBackend) record(path string, fn func() error) error {
+	unlock := b.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	info, err := b.base.Stat(path)
+	switch {
+	case err == nil && !info.IsDir:
+		if err := b.store.save(b.base, path); err != nil && !isNotExist(err) {
+			return fmt.Errorf("failed to keep previous version of %s: %w", path, err)
+		}
+	case err != nil && !isNotExist(err) && !errors.Is(err, syscall.ENOTDIR):
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+	_, err = b.prune(path)
+	return err
+}
+
+// prune deletes the versions of a file beyond the count and age limits and
+// returns the ones that are left. path must be locked.
+func (b *VersionBackend) prune(path string) ([]VersionInfo, error) {
+	versions, err := b.store.versions(path)
+	if err != nil {
+		return nil, err
+	}
+	return b.pruneVersions(path, versions)
+}
+
+// pruneVersions deletes the versions beyond the limits from a list of the
+// versions of a file, newest first. path must be locked.
+func (b *VersionBackend) pruneVersions(path string, versions []VersionInfo) ([]VersionInfo, error) {
+	kept := make([]VersionInfo, 0, len(versions))
+	for i, version := range versions {
+		if i < b.keep && (b.maxAge <= 0 || time.Since(version.Replaced) <= b.maxAge) {
+			kept = append(kept, version)
+			continue
+		}
+		if err := b.store.remove(path, version.ID); err != nil && !isNotExist(err) {
+			return nil, fmt.Errorf("failed to delete version %s of %s: %w", version.ID, path, err)
+		}
+	}
+	return kept, nil
+}
+
+// history lists the versions of a file within the limits, newest first
+func (b *VersionBackend) history(path string) ([]VersionInfo, error) {
+	unlock := b.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	versions, err := b.prune(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, version := range versions {
+		if versions[i].Size, err = b.store.size(path, version.ID); err != nil {
+			return nil, fmt.Errorf("failed to stat version %s of %s: %w", version.ID, path, err)
+		}
+	}
+	return versions, nil
+}
+
+// openVersion streams a version of a file
+func (b *VersionBackend) openVersion(path, id string) (io.ReadCloser, VersionInfo, error) {
+	versions, err := b.history(path)
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+	for _, version := range versions {
+		if version.ID != id {
+			continue
+		}
+		reader, err := b.store.open(path, id)
+		if err != nil {
+			return nil, VersionInfo{}, err
+		}
+		return reader, version, nil
+	}
+	return nil, VersionInfo{}, fmt.Errorf("version %s of %s: %w", id, path, fs.ErrNotExist)
+}
+
+// expire deletes versions of every file that are past the age limit. Each
+// file is locked only while its versions are pruned; a version kept after
+// the listing is newer than those listed and is left alone.
+func (b *VersionBackend) expire() error {
+	all, err := b.store.all()
+	if err != nil {
+		return fmt.Errorf("failed to list versions: %w", err)
+	}
+	for path, versions := range all {
+		unlock := b.locks.lock(fileLock(path, true))
+		_, err := b.pruneVersions(path, versions)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile reads a whole file
+func (b *VersionBackend) ReadFile(path string) ([]byte, error) {
+	return b.base.ReadFile(path)
+}
+
+// WriteFile writes a whole file, keeping the previous content as a version
+func (b *VersionBackend) WriteFile(path string, data []byte) error {
+	return b.record(path, func() error {
+		return b.base.WriteFile(path, data)
+	})
+}
+
+// Open streams a file
+func (b *VersionBackend) Open(path string) (io.ReadCloser, error) {
+	return b.base.Open(path)
+}
+
+// Create streams a file; the previous content is kept as a version when the
+// new one is committed
+func (b *VersionBackend) Create(path string) (FileWriter, error) {
+	w, err := b.base.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &versionWriter{FileWriter: w, backend: b, path: path}, nil
+}
+
+// Delete removes a file, keeping its content as a version
+func (b *VersionBackend) Delete(path string) error {
+	return b.record(path, func() error {
+		return b.base.Delete(path)
+	})
+}
+
+// Rename moves a file or directory, keeping the file it replaces as a
+// version. Versions stay with the path they were made at.
+func (b *VersionBackend) Rename(oldPath, newPath string) error {
+	return b.record(newPath, func() error {
+		return renameWithin(b.base, oldPath, newPath)
+	})
+}
+
+// Copy copies a file, keeping the file it replaces as a version
+func (b *VersionBackend) Copy(srcPath, dstPath string) error {
+	return b.record(dstPath, func() error {
+		return copyBetween(b.base, srcPath, b.base, dstPath)
+	})
+}
+
+// Attrs returns the attributes of a file
+func (b *VersionBackend) Attrs(path string) (map[string]string, time.Time, error) {
+	return attrsOf(b.base, path)
+}
+
+// SetAttrs stores attributes of a file
+func (b *VersionBackend) SetAttrs(path string, attrs map[string]string) error {
+	return setAttrs(b.base, path, attrs)
+}
+
+// Mkdir creates a directory
+func (b *VersionBackend) Mkdir(path string) error {
+	return b.base.Mkdir(path)
+}
+
+// Stat returns information about a file or directory
+func (b *VersionBackend) Stat(path string) (FileInfo, error) {
+	return b.base.Stat(path)
+}
+
+// List lists files and directories
+func (b *VersionBackend) List(prefix string) ([]FileInfo, error) {
+	return b.base.List(prefix)
+}
+
+// OpenFile opens a handle on the base backend. The content of the file is
+// kept as a version before the handle first modifies it.
+func (b *VersionBackend) OpenFile(path string, flag int) (BackendFile, error) {
+	opener, ok := b.base.(FileOpener)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if ok {
+			return opener.OpenFile(path, flag)
+		}
+		return openBuffered(b.base, path, flag)
+	}
+	if !ok {
+		// Written back through WriteFile on close
+		return openBuffered(b, path, flag)
+	}
+
+	if flag&os.O_TRUNC == 0 {
+		file, err := opener.OpenFile(path, flag)
+		if err != nil {
+			return nil, err
+		}
+		return &versionFile{BackendFile: file, backend: b, path: path}, nil
+	}
+
+	// Truncating on open replaces the content straight away
+	var file BackendFile
+	err := b.record(path, func() error {
+		var err error
+		file, err = opener.OpenFile(path, flag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &versionFile{BackendFile: file, backend: b, path: path, saved: true}, nil
+}
+
+// versionWriter keeps the previous content of a file before committing the new one
+type versionWriter struct {
+	FileWriter
+	backend *VersionBackend
+	path    string
+}
+
+func (w *versionWriter) Close() error {
+	return w.backend.record(w.path, w.FileWriter.Close)
+}
+
+// versionFile keeps the content of a file as a version before the handle
+// first modifies it; later modifications through the handle belong to the
+// same new version
+type versionFile struct {
+	BackendFile
+	backend *VersionBackend
+	path    string
+	saved   bool
+}
+
+// modify runs fn, keeping the content of the file as a version the first time
+func (f *versionFile) modify(fn func() error) error {
+	if f.saved {
+		return fn()
+	}
+	if err := f.backend.record(f.path, fn); err != nil {
+		return err
+	}
+	f.saved = true
+	return nil
+}
+
+func (f *versionFile) Write(p []byte) (n int, err error) {
+	err = f.modify(func() error {
+		n, err = f.BackendFile.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (f *versionFile) WriteAt(p []byte, off int64) (n int, err error) {
+	err = f.modify(func() error {
+		n, err = f.BackendFile.WriteAt(p, off)
+		return err
+	})
+	return n, err
+}
+
+func (f *versionFile) Truncate(size int64) error {
+	return f.modify(func() error {
+		return f.BackendFile.Truncate(size)
+	})
+}
+
+// runVersionExpiry periodically deletes versions past the age limit
+func (vd *VirtualDisk) runVersionExpiry(interval time.Duration) {
+	defer vd.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-vd.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := vd.versions.expire(); err != nil {
+			fmt.Printf("failed to expire versions: %v\n", err)
+		}
+	}
+}
+
+// versionStore picks where previous versions are kept: in the S3 bucket if
+// it has versioning enabled, otherwise as copies under the data partition.
+// atRest decodes them like the current files.
+func (vd *VirtualDisk) versionStore(atRest func(Backend) Backend) (versionStore, error) {
+	if vd.s3store != nil {
+		enabled, err := vd.s3store.VersioningEnabled()
+		if err != nil {
+			return nil, err
+		}
+		if enabled {
+			return &s3Versions{
+				store: vd.s3store,
+				data:  atRest(&s3VersionReader{store: vd.s3store}),
+			}, nil
+		}
+	}
+	return &localVersions{data: atRest(NewLocalBackend(vd.metaPath("versions")))}, nil
+}
+
+// ErrNoVersionHistory is returned for files whose previous versions are not
+// kept
+var ErrNoVersionHistory = errors.New("no version history")
+
+// versionsFor checks that a path has version history
+func (vd *VirtualDisk) versionsFor(path string) error {
+	if vd.versions == nil {
+		return fmt.Errorf("%w: version history is not enabled", ErrNoVersionHistory)
+	}
+	if vd.getStorageType(path) != StoragePersistent {
+		return fmt.Errorf("%w: version history only covers persistent files", ErrNoVersionHistory)
+	}
+	return nil
+}
+
+// ListVersions lists the previous versions of a persistent file, newest
+// first. Buffered writes are written back first, so the content they
+// replace is listed.
+func (vd *VirtualDisk) ListVersions(path string) ([]VersionInfo, error) {
+	if err := vd.versionsFor(path); err != nil {
+		return nil, err
+	}
+
+	unlock := vd.locks.lock(fileLock(path, true))
+	err := vd.flushPath(path)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	return vd.versions.history(path)
+}
+
+// ReadVersion reads a previous version of a persistent file
+func (vd *VirtualDisk) ReadVersion(path, id string) ([]byte, error) {
+	if err := vd.versionsFor(path); err != nil {
+		return nil, err
+	}
+
+	reader, _, err := vd.versions.openVersion(path, id)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version %s of %s: %w", id, path, err)
+	}
+	return data, nil
+}
+
+// RestoreVersion makes a previous version of a persistent file its current
+// content. The content it replaces is kept as a version in turn, so a
+// restore can be undone.
+func (vd *VirtualDisk) RestoreVersion(path, id string) error {
+	return vd.RestoreVersionWith(path, id, WriteOptions{})
+}
+
+// RestoreVersionWith makes a previous version of a persistent file its
+// current content with options
+func (vd *VirtualDisk) RestoreVersionWith(path, id string, opts WriteOptions) error {
+	if err := vd.versionsFor(path); err != nil {
+		return err
+	}
+
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	if err := vd.checkLease(path, opts.LockToken); err != nil {
+		return err
+	}
+	if err := vd.flushPath(path); err != nil {
+		return err
+	}
+	reader, version, err := vd.versions.openVersion(path, id)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	reservation, err := vd.reserveQuota(nil, path, version.Size)
+	if err != nil {
+		return err
+	}
+	defer vd.releaseQuota(reservation)
+	if err := copyTo(vd.persistent, path, reader, version.Size); err != nil {
+		return fmt.Errorf("failed to restore version %s of %s: %w", id, path, err)
+	}
+	if vd.cache != nil {
+		vd.cache.Remove(path)
+	}
+	if err := vd.logCheckpoint(path); err != nil {
+		return err
+	}
+
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileModified,
+		Path:      path,
+		Timestamp: time.Now(),
+		Metadata: map[string]interface{}{
+			"size":    version.Size,
+			"version": id,
+		},
+	})
+	return nil
+}
+
+// versionIDFormat names local versions after the time they were replaced,
+// so they sort from oldest to newest
+const versionIDFormat = "20060102T150405.000000000Z"
+
+// localVersions keeps versions as copies in a backend. The versions of a
+// file are stored in a directory named after its path, with every path
+// element prefixed by "_" so a file's versions never clash with the
+// directory of the versions of the files below it.
+type localVersions struct {
+	data Backend
+}
+
+// versionDir returns the directory holding the versions of a file
+func versionDir(path string) string {
+	return "_" + strings.ReplaceAll(path, "/", "/_")
+}
+
+// versionPath returns the path a version directory was made for
+func versionPath(dir string) string {
+	return strings.TrimPrefix(strings.ReplaceAll(dir, "/_", "/"), "_")
+}
+
+func (s *localVersions) save(base Backend, path string) error {
+	existing, err := s.versions(path)
+	if err != nil {
+		return err
+	}
+	replaced := time.Now().UTC()
+	// IDs must be unique and newer than any existing version
+	if len(existing) > 0 && !replaced.After(existing[0].Replaced) {
+		replaced = existing[0].Replaced.Add(time.Nanosecond)
+	}
+	return copyFile(base, path, s.data, versionDir(path)+"/"+replaced.Format(versionIDFormat))
+}
+
+func (s *localVersions) versions(path string) ([]VersionInfo, error) {
+	dir := versionDir(path) + "/"
+	infos, err := s.data.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var versions []VersionInfo
+	for _, info := range infos {
+		id := strings.TrimPrefix(info.Path, dir)
+		if version, ok := localVersion(id, info); ok {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Replaced.After(versions[j].Replaced) })
+	return versions, nil
+}
+
+func (s *localVersions) all() (map[string][]VersionInfo, error) {
+	infos, err := s.data.List("")
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string][]VersionInfo)
+	for _, info := range infos {
+		i := strings.LastIndex(info.Path, "/")
+		if i < 0 {
+			continue
+		}
+		if version, ok := localVersion(info.Path[i+1:], info); ok {
+			path := versionPath(info.Path[:i])
+			all[path] = append(all[path], version)
+		}
+	}
+	for _, versions := range all {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Replaced.After(versions[j].Replaced) })
+	}
+	return all, nil
+}
+
+// localVersion describes a stored version, if id names one
+func localVersion(id string, info FileInfo) (VersionInfo, bool) {
+	if info.IsDir || strings.Contains(id, "/") {
+		return VersionInfo{}, false
+	}
+	replaced, err := time.Parse(versionIDFormat, id)
+	if err != nil {
+		return VersionInfo{}, false
+	}
+	return VersionInfo{ID: id, Size: info.Size, Replaced: replaced}, true
+}
+
+func (s *localVersions) size(path, id string) (int64, error) {
+	info, err := s.data.Stat(versionDir(path) + "/" + id)
+	return info.Size, err
+}
+
+func (s *localVersions) open(path, id string) (io.ReadCloser, error) {
+	return s.data.Open(versionDir(path) + "/" + id)
+}
+
+func (s *localVersions) remove(path, id string) error {
+	dir := versionDir(path)
+	if err := s.data.Delete(dir + "/" + id); err != nil {
+		return err
+	}
+	// Drop directories left empty, as long as no other versions live below them
+	for ; dir != ""; dir = parentDir(dir) {
+		infos, err := s.data.List(dir + "/")
+		if err != nil || len(infos) > 0 {
+			return err
+		}
+		if err := s.data.Delete(dir); err != nil && !isNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Versions uses the versions an S3 bucket with versioning enabled keeps by
+// itself. Versions are read through data, a view of the bucket addressed as
+// <version ID>/<path>, so they are decoded like the current files.
+type s3Versions struct {
+	store *s3store.S3Store
+	data  Backend
+}
+
+// save does nothing; the bucket keeps the previous version when the mirror
+// copy is overwritten
+func (s *s3Versions) save(base Backend, path string) error {
+	return nil
+}
+
+func (s *s3Versions) versions(path string) ([]VersionInfo, error) {
+	all, err := s.list(path)
+	if err != nil {
+		return nil, err
+	}
+	return all[path], nil
+}
+
+func (s *s3Versions) all() (map[string][]VersionInfo, error) {
+	return s.list("")
+}
+
+// list lists the previous versions of the objects under prefix. A version
+// was replaced when the next newer version, or delete marker, was written.
+func (s *s3Versions) list(prefix string) (map[string][]VersionInfo, error) {
+	objects, err := s.store.ListVersions(prefix)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string][]s3store.ObjectVersion)
+	for _, object := range objects {
+		byPath[object.Path] = append(byPath[object.Path], object)
+	}
+
+	all := make(map[string][]VersionInfo)
+	for path, objects := range byPath {
+		sort.SliceStable(objects, func(i, j int) bool {
+			if objects[i].IsLatest != objects[j].IsLatest {
+				return objects[i].IsLatest
+			}
+			return objects[i].Modified.After(objects[j].Modified)
+		})
+		for i, object := range objects {
+			if i == 0 || object.DeleteMarker {
+				continue
+			}
+			all[path] = append(all[path], VersionInfo{
+				ID:       object.VersionID,
+				Size:     object.Size,
+				Replaced: objects[i-1].Modified,
+			})
+		}
+	}
+	return all, nil
+}
+
+func (s *s3Versions) size(path, id string) (int64, error) {
+	info, err := s.data.Stat(id + "/" + path)
+	return info.Size, err
+}
+
+func (s *s3Versions) open(path, id string) (io.ReadCloser, error) {
+	return s.data.Open(id + "/" + path)
+}
+
+func (s *s3Versions) remove(path, id string) error {
+	return s.store.DeleteVersion(path, id)
+}
+
+// errVersionReadOnly is returned when something tries to change a previous version
+var errVersionReadOnly = errors.New("previous versions cannot be changed")
+
+// s3VersionReader reads previous versions of S3 objects, addressed as
+// <version ID>/<path>
+type s3VersionReader struct {
+	store *s3store.S3Store
+}
+
+// split separates the version ID from the path of an object
+func (r *s3VersionReader) split(versionPath string) (string, string, error) {
+	id, path, ok := strings.Cut(versionPath, "/")
+	if !ok || id == "" {
+		return "", "", &fs.PathError{Op: "open", Path: versionPath, Err: fs.ErrNotExist}
+	}
+	return id, path, nil
+}
+
+func (r *s3VersionReader) ReadFile(versionPath string) ([]byte, error) {
+	reader, err := r.Open(versionPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (r *s3VersionReader) Open(versionPath string) (io.ReadCloser, error) {
+	id, path, err := r.split(versionPath)
+	if err != nil {
+		return nil, err
+	}
+	return r.store.ReadVersion(path, id)
+}
+
+func (r *s3VersionReader) Stat(versionPath string) (FileInfo, error) {
+	id, path, err := r.split(versionPath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := r.store.StatVersion(path, id)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{
+		Path:     versionPath,
+		Size:     info.Size,
+		Modified: info.Modified.Format(time.RFC3339),
+		ModTime:  info.Modified,
+	}, nil
+}
+
+// List lists nothing; versions are listed through the store
+func (r *s3VersionReader) List(prefix string) ([]FileInfo, error) {
+	return nil, nil
+}
+
+func (r *s3VersionReader) WriteFile(path string, data []byte) error {
+	return errVersionReadOnly
+}
+
+func (r *s3VersionReader) Create(path string) (FileWriter, error) {
+	return nil, errVersionReadOnly
+}
+
+func (r *s3VersionReader) Delete(path string) error {
+	return errVersionReadOnly
+}
+
+func (r *s3VersionReader) Mkdir(path string) error {
+	return errVersionReadOnly
+}
@@ -2,6 +2,7 @@ package virtualdisk
 
 import (
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -10,7 +11,9 @@ import (
 	"time"
 
 	"github.com/vikasavn/virtual_disk_go/internal/cache"
+	"github.com/vikasavn/virtual_disk_go/internal/envelope"
 	"github.com/vikasavn/virtual_disk_go/internal/events"
+	"github.com/vikasavn/virtual_disk_go/internal/journal"
 	"github.com/vikasavn/virtual_disk_go/internal/mmap"
 	"github.com/vikasavn/virtual_disk_go/internal/s3store"
 )
@@ -22,6 +25,7 @@ const (
 	StoragePersistent StorageType = "persistent" // Stored on disk
 	StorageTemp       StorageType = "temp"       // Stored in temp directory, deleted on close
 	StorageMemory     StorageType = "memory"     // Stored in memory only
+	StorageMount      StorageType = "mount"      // Stored in a registered backend
 )
 
 // Config represents the configuration for VirtualDisk
@@ -33,7 +37,65 @@ type Config struct {
 	EnableTemp    bool
 	EnableMemory  bool
 	CacheSize     int64
-	TempTTL       time.Duration
+	// TempTTL deletes temp files that have not been written for this long,
+	// unless they were given an expiry of their own
+	TempTTL time.Duration
+	// FlushInterval is how long a persistent write may stay buffered before it
+	// is written back. Write-back buffering is enabled when BufferSize > 0.
+	FlushInterval time.Duration
+	// EnableJournal records persistent writes, deletes and directory creation
+	// in a write-ahead journal under DataPartition so buffered writes survive a
+	// crash. It only applies when write-back buffering is enabled.
+	EnableJournal bool
+	// TieringPolicies move persistent files between memory, disk and S3
+	// based on how they are used; see TieringPolicy
+	TieringPolicies []TieringPolicy
+	// TieringInterval is how often the tiering policies are evaluated
+	TieringInterval time.Duration
+	// Dedup stores persistent files on disk as manifests of content-addressed
+	// chunks under DataPartition, so identical data is stored only once. It
+	// cannot be combined with EncryptionKeyFile.
+	Dedup bool
+	// ChunkSize is the (average) size of deduplicated chunks, 1 MiB by default
+	ChunkSize int
+	// ContentDefinedChunking cuts chunks where the content matches a rolling
+	// hash instead of at fixed offsets, so an insertion only changes the
+	// chunks around it
+	ContentDefinedChunking bool
+	// CompressionRules compress persistent files, on disk and in S3, with
+	// the codec of the first rule that matches; see CompressionRule
+	CompressionRules []CompressionRule
+	// EncryptionKeyFile enables AES-GCM encryption at rest of persistent,
+	// temp and S3 files with master keys from this file; see envelope.Keyring
+	EncryptionKeyFile string
+	// Checksums records a SHA-256 checksum with every persistent, temp and
+	// S3 file as it is stored and verifies it whenever the file is read back
+	Checksums bool
+	// ScrubInterval is how often the scrubber reads back every persistent
+	// file on disk and in S3, repairing corrupted copies from good ones. It
+	// only runs when Checksums is enabled.
+	ScrubInterval time.Duration
+	// Versions is how many previous versions of each persistent file are
+	// kept when it is overwritten; 0 disables version history. When the S3
+	// bucket has versioning enabled, its own versions are used instead of
+	// copies under DataPartition.
+	Versions int
+	// VersionMaxAge deletes versions once they have been replaced for this
+	// long; 0 keeps them until Versions newer ones exist
+	VersionMaxAge time.Duration
+	// EnableTrash moves deleted persistent files into a trash under
+	// DataPartition, from which they can be restored until they are purged
+	EnableTrash bool
+	// TrashRetention purges files that have been in the trash this long; 0
+	// keeps them until they are purged
+	TrashRetention time.Duration
+	// Quotas limit the size and number of files by storage type and path
+	// prefix; see Quota
+	Quotas []Quota
+
+	// mirror stands in for S3 as the backend persistent files are mirrored
+	// to, so benchmarks can measure a slow mirror without a bucket
+	mirror Backend
 }
 
 // VirtualDisk represents the virtual disk system
@@ -42,7 +104,11 @@ type VirtualDisk struct {
 	tempDir       string
 	bufferSize    int64
 	buffer        map[string]*BufferEntry
-	mu            sync.RWMutex
+	mu            sync.RWMutex // guards the buffer and closed; files are guarded by locks
+	locks         *lockManager
+	leases        *leaseTable
+	journalMu     sync.RWMutex // held exclusively while the journal is truncated or checkpointed
+	txMu          sync.RWMutex // held exclusively while a transaction is applied
 	s3store       *s3store.S3Store
 	mmapFiles     map[string]*mmap.MappedFile
 	enableTemp    bool
@@ -50,6 +116,39 @@ type VirtualDisk struct {
 	eventBus      *events.EventBus
 	cache         *cache.Cache
 	tempTTL       time.Duration
+	bufferedBytes int64
+	flushInterval time.Duration
+	flushCh       chan struct{}
+	done          chan struct{}
+	wg            sync.WaitGroup
+	journal       *journal.Journal
+	txLog         *journal.Journal
+	txKept        bool // txLog holds a commit that could not be undone; guarded by txMu
+	closed        bool
+	persistent    Backend
+	temp          Backend
+	memory        *MemoryBackend
+	mounts        []*mount
+	mountsMu      sync.RWMutex
+	digests       digestCache
+	usage         *usageTracker
+	expiry        *expiryIndex
+
+	// Storage tiers of persistent files
+	disk            Backend
+	dedup           *DedupBackend
+	keys            *envelope.Keyring
+	encrypted       []*EncryptBackend
+	mirror          *MirrorBackend
+	tiered          *TieredBackend
+	versions        *VersionBackend
+	snapshots       *SnapshotBackend
+	trash           *trash
+	policies        []TieringPolicy
+	access          map[string]*accessStats
+	accessMu        sync.Mutex
+	tieringStarted  time.Time // access stats only cover use since then
+	maxPromoteReads int
 }
 
 // BufferEntry represents a file in the memory buffer
@@ -57,10 +156,16 @@ type BufferEntry struct {
 	Data     []byte
 	Modified time.Time
 	Type     StorageType
+	Dirty    bool // persistent data not yet written back
 }
 
 // NewVirtualDisk creates a new virtual disk instance
 func NewVirtualDisk(config Config) (*VirtualDisk, error) {
+	// Files are encrypted with their own random key before they reach the
+	// chunk store, so no two of them would ever share a chunk
+	if config.Dedup && config.EncryptionKeyFile != "" {
+		return nil, fmt.Errorf("deduplication cannot be combined with encryption")
+	}
 	if err := os.MkdirAll(config.DataPartition, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create data partition: %w", err)
 	}
@@ -74,21 +179,38 @@ func NewVirtualDisk(config Config) (*VirtualDisk, error) {
 		enableMemory:  config.EnableMemory,
 		eventBus:      events.NewEventBus(),
 		tempTTL:       config.TempTTL,
+		flushInterval: config.FlushInterval,
+		flushCh:       make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		digests:       digestCache{entries: make(map[string]digest)},
+		locks:         newLockManager(),
+		leases:        newLeaseTable(),
+	}
+
+	if err := validateQuotas(config.Quotas); err != nil {
+		return nil, err
+	}
+	vd.usage = newUsageTracker(config.Quotas)
+
+	// Keep cached checksums in step with file changes
+	vd.eventBus.Subscribe(events.EventFileCreated, vd.forgetDigests)
+	vd.eventBus.Subscribe(events.EventFileModified, vd.forgetDigests)
+	vd.eventBus.Subscribe(events.EventFileRenamed, vd.forgetDigests)
+
+	// Keep usage up to date as files change
+	for _, eventType := range []events.EventType{events.EventFileCreated, events.EventFileModified, events.EventFileDeleted, events.EventFileRenamed, events.EventFileExpired} {
+		vd.eventBus.Subscribe(eventType, vd.accountUsage)
+	}
+
+	// Keep expiry times with their files
+	for _, eventType := range []events.EventType{events.EventFileCreated, events.EventFileModified, events.EventFileDeleted, events.EventFileRenamed} {
+		vd.eventBus.Subscribe(eventType, vd.trackExpiry)
 	}
 
-	// Initialize cache
+	// Initialize cache; everything cached is also stored or buffered, so
+	// evicted entries are simply dropped
 	if config.CacheSize > 0 {
-		vd.cache = cache.NewCache(config.CacheSize, func(key string, value []byte) {
-			// When items are evicted from cache, write them to disk if needed
-			if strings.HasPrefix(key, "temp/") || strings.HasPrefix(key, "mem/") {
-				return // Don't persist temporary or memory-only files
-			}
-			fullPath := filepath.Join(vd.dataPartition, key)
-			if err := ioutil.WriteFile(fullPath, value, 0644); err != nil {
-				// Log error but don't fail
-				fmt.Printf("failed to write cached file to disk: %v\n", err)
-			}
-		})
+		vd.cache = cache.NewCache(config.CacheSize, nil)
 	}
 
 	// Create temporary directory if enabled
@@ -98,11 +220,6 @@ func NewVirtualDisk(config Config) (*VirtualDisk, error) {
 			return nil, fmt.Errorf("failed to create temp directory: %w", err)
 		}
 		vd.tempDir = tempDir
-
-		// Start temp file cleanup goroutine
-		if config.TempTTL > 0 {
-			go vd.cleanupTempFiles()
-		}
 	}
 
 	if config.UseS3 && config.S3Config != nil {
@@ -118,33 +235,203 @@ func NewVirtualDisk(config Config) (*VirtualDisk, error) {
 		vd.s3store = s3store
 	}
 
-	return vd, nil
-}
+	if err := validateTieringPolicies(config.TieringPolicies, vd.s3store != nil); err != nil {
+		return nil, err
+	}
 
-// cleanupTempFiles periodically removes expired temporary files
-func (vd *VirtualDisk) cleanupTempFiles() {
-	ticker := time.NewTicker(vd.tempTTL / 2)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		vd.mu.Lock()
-		now := time.Now()
-		for path, entry := range vd.buffer {
-			if entry.Type == StorageTemp && now.Sub(entry.Modified) > vd.tempTTL {
-				delete(vd.buffer, path)
-				// Also remove from disk
-				fullPath := vd.getFilePath(path, StorageTemp)
-				os.Remove(fullPath) // Ignore errors
-			}
+	// Set up the built-in backends; persistent files are mirrored to S3 if
+	// configured, and hot files can be pinned in memory in front of both.
+	// Version history and snapshots sit on top, keeping content before
+	// anything changes it.
+	// Files at rest are compressed, then encrypted, then checksummed, if
+	// configured.
+	if err := validateCompressionRules(config.CompressionRules); err != nil {
+		return nil, err
+	}
+	if config.EncryptionKeyFile != "" {
+		keys, err := envelope.LoadKeyring(config.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
 		}
-		vd.mu.Unlock()
+		vd.keys = keys
+	}
+	encrypted := func(backend Backend) Backend {
+		if config.Checksums {
+			backend = NewChecksumBackend(backend)
+		}
+		if vd.keys == nil {
+			return backend
+		}
+		b := NewEncryptBackend(backend, vd.keys)
+		vd.encrypted = append(vd.encrypted, b)
+		return b
+	}
+	if len(config.CompressionRules) > 0 {
+		// Compressed files are staged next to the data; anything staged
+		// before a crash is of no use
+		os.RemoveAll(vd.metaPath("staging"))
+		if err := os.MkdirAll(vd.metaPath("staging"), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+	}
+	atRest := func(backend Backend) Backend {
+		backend = encrypted(backend)
+		if len(config.CompressionRules) == 0 {
+			return backend
+		}
+		b := NewCompressBackend(backend, config.CompressionRules)
+		b.staging = vd.metaPath("staging")
+		b.keys = vd.keys
+		return b
+	}
+
+	vd.disk = NewLocalBackend(vd.dataPartition)
+	if config.Dedup {
+		if err := vd.openDedup(config.ChunkSize, config.ContentDefinedChunking); err != nil {
+			return nil, err
+		}
+		vd.disk = vd.dedup
+	}
+	vd.disk = atRest(vd.disk)
+	var base Backend = vd.disk
+	secondary := config.mirror
+	if vd.s3store != nil {
+		secondary = NewS3Backend(vd.s3store)
+	}
+	if secondary != nil {
+		vd.mirror = NewMirrorBackend(vd.disk, atRest(secondary))
+		base = vd.mirror
+	}
+	vd.tiered = NewTieredBackend(base)
+	base = vd.tiered
+	if config.Versions > 0 {
+		store, err := vd.versionStore(atRest)
+		if err != nil {
+			return nil, err
+		}
+		vd.versions = NewVersionBackend(vd.tiered, store, config.Versions, config.VersionMaxAge)
+		base = vd.versions
+	}
+	snapshots, err := NewSnapshotBackend(base, atRest(NewLocalBackend(vd.metaPath("snapshots", "data"))), vd.metaPath("snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	vd.snapshots = snapshots
+	vd.persistent = vd.snapshots
+	if config.EnableTrash {
+		trash, err := openTrash(atRest(NewLocalBackend(vd.metaPath("trash", "data"))), vd.metaPath("trash", "index.json"))
+		if err != nil {
+			return nil, err
+		}
+		vd.trash = trash
+	}
+	vd.mounts = append(vd.mounts, &mount{
+		prefix:      "",
+		storageType: StoragePersistent,
+		backend:     vd.persistent,
+		spec:        MountSpec{Type: MountLocal, Path: vd.dataPartition},
+	})
+	if vd.enableTemp {
+		vd.temp = encrypted(NewLocalBackend(vd.tempDir))
+		vd.mounts = append(vd.mounts, &mount{
+			prefix:      PathPrefix(StorageTemp),
+			storageType: StorageTemp,
+			backend:     vd.temp,
+			spec:        MountSpec{Type: MountLocal, Path: vd.tempDir},
+		})
+	}
+	if vd.enableMemory {
+		vd.memory = NewMemoryBackend()
+		vd.mounts = append(vd.mounts, &mount{
+			prefix:      PathPrefix(StorageMemory),
+			storageType: StorageMemory,
+			backend:     vd.memory,
+			spec:        MountSpec{Type: MountMemory},
+		})
+	}
+	sortMounts(vd.mounts)
+
+	// Expiry times of persistent files are kept across restarts; temp and
+	// memory files don't survive one
+	expiry, err := openExpiryIndex(vd.metaPath("expiry.json"), vd.metaPath("expiry.log"), func(path string) bool {
+		return vd.getStorageType(path) == StoragePersistent
+	})
+	if err != nil {
+		return nil, err
+	}
+	vd.expiry = expiry
+
+	// Recover operations that were acknowledged but not written back
+	if config.EnableJournal && vd.writeBackEnabled() {
+		if err := vd.openJournal(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Finish a transaction that was being committed; it is newer than
+	// anything in the journal
+	if err := vd.openTxLog(); err != nil {
+		return nil, err
+	}
+
+	// Count what is stored; from here on usage is kept up to date incrementally
+	if err := vd.rescanUsage(""); err != nil {
+		return nil, err
+	}
+
+	// Start the write-back flusher
+	if vd.writeBackEnabled() {
+		if vd.flushInterval <= 0 {
+			vd.flushInterval = defaultFlushInterval
+		}
+		vd.wg.Add(1)
+		go vd.runFlusher()
+	}
+
+	// Start deleting files as they expire
+	vd.wg.Add(1)
+	go vd.runExpiry()
+
+	// Start verifying files at rest
+	if config.Checksums {
+		interval := config.ScrubInterval
+		if interval <= 0 {
+			interval = defaultScrubInterval
+		}
+		vd.wg.Add(1)
+		go vd.runScrubber(interval)
+	}
+
+	// Start deleting old versions
+	if vd.versions != nil && config.VersionMaxAge > 0 {
+		vd.wg.Add(1)
+		go vd.runVersionExpiry(config.VersionMaxAge / 2)
+	}
+
+	// Start purging old files from the trash
+	if vd.trash != nil && config.TrashRetention > 0 {
+		vd.wg.Add(1)
+		go vd.runTrashExpiry(config.TrashRetention)
 	}
+
+	// Start moving files between tiers
+	if len(config.TieringPolicies) > 0 {
+		vd.startTiering(config.TieringPolicies, config.TieringInterval)
+	}
+
+	return vd, nil
 }
 
 // WriteFile writes data to a file in the virtual disk
 func (vd *VirtualDisk) WriteFile(path string, data []byte) error {
-	vd.mu.Lock()
-	defer vd.mu.Unlock()
+	return vd.WriteFileWith(path, data, WriteOptions{})
+}
+
+// WriteFileWith writes data to a file in the virtual disk with options. A
+// file overwritten without an expiry keeps the one it had.
+func (vd *VirtualDisk) WriteFileWith(path string, data []byte, opts WriteOptions) error {
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
 
 	storageType := vd.getStorageType(path)
 
@@ -154,49 +441,45 @@ func (vd *VirtualDisk) WriteFile(path string, data []byte) error {
 		"size": len(data),
 	}
 
-	// For memory storage, just store in buffer
-	if storageType == StorageMemory {
-		vd.buffer[path] = &BufferEntry{
-			Data:     data,
-			Modified: time.Now(),
-			Type:     StorageMemory,
-		}
-		// Cache the data
-		if vd.cache != nil {
-			vd.cache.Put(path, data, int64(len(data)))
-		}
-		// Publish event
-		vd.eventBus.Publish(events.Event{
-			Type:      events.EventFileCreated,
-			Path:      path,
-			Timestamp: time.Now(),
-			Metadata:  metadata,
-		})
-		return nil
+	if err := vd.checkLease(path, opts.LockToken); err != nil {
+		return err
 	}
-
-	// Get the actual file path
-	fullPath := vd.getFilePath(path, storageType)
-	dir := filepath.Dir(fullPath)
-
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	reservation, err := vd.reserveQuota(nil, path, int64(len(data)))
+	if err != nil {
+		return err
 	}
+	defer vd.releaseQuota(reservation)
 
-	// Write file
-	if err := ioutil.WriteFile(fullPath, data, 0644); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+	if storageType == StoragePersistent && vd.writeBackEnabled() {
+		// Record the write before acknowledging it, then stage it; the
+		// flusher writes it back to disk and S3
+		vd.journalMu.RLock()
+		err := vd.logOp(journal.Record{Op: journal.OpWrite, Path: path, Data: data})
+		if err == nil {
+			vd.bufferWrite(path, data)
+		}
+		vd.journalMu.RUnlock()
+		if err != nil {
+			return err
+		}
+	} else {
+		// Drop any older buffered copy so it can't shadow this write
+		vd.dropBuffered(path)
+		if err := vd.writeThrough(path, data); err != nil {
+			return err
+		}
 	}
 
-	// Cache the data
+	// Cache the data; cached values are never changed in place, so no
+	// reference is held on to and the entry can be evicted
 	if vd.cache != nil {
 		vd.cache.Put(path, data, int64(len(data)))
+		vd.cache.Release(path)
 	}
 
-	// Write to S3 if configured and not temporary
-	if vd.s3store != nil && storageType == StoragePersistent {
-		if err := vd.s3store.WriteFile(path, data); err != nil {
-			return fmt.Errorf("failed to write to S3: %w", err)
+	if at := opts.expiry(); !at.IsZero() {
+		if err := vd.setExpiry(path, at); err != nil {
+			return err
 		}
 	}
 
@@ -213,12 +496,13 @@ func (vd *VirtualDisk) WriteFile(path string, data []byte) error {
 
 // ReadFile reads data from a file in the virtual disk
 func (vd *VirtualDisk) ReadFile(path string) ([]byte, error) {
-	vd.mu.RLock()
-	defer vd.mu.RUnlock()
+	unlock := vd.locks.lock(fileLock(path, false))
+	defer unlock()
 
 	// Try cache first
 	if vd.cache != nil {
 		if data, ok := vd.cache.Get(path); ok {
+			vd.cache.Release(path)
 			// Publish access event
 			vd.eventBus.Publish(events.Event{
 				Type:      events.EventFileAccessed,
@@ -230,10 +514,11 @@ func (vd *VirtualDisk) ReadFile(path string) ([]byte, error) {
 	}
 
 	// Check memory buffer
-	if entry, ok := vd.buffer[path]; ok {
+	if entry, ok := vd.buffered(path); ok {
 		// Cache the data for future use
 		if vd.cache != nil {
 			vd.cache.Put(path, entry.Data, int64(len(entry.Data)))
+			vd.cache.Release(path)
 		}
 		// Publish access event
 		vd.eventBus.Publish(events.Event{
@@ -244,25 +529,17 @@ func (vd *VirtualDisk) ReadFile(path string) ([]byte, error) {
 		return entry.Data, nil
 	}
 
-	storageType := vd.getStorageType(path)
-	fullPath := vd.getFilePath(path, storageType)
-
-	data, err := ioutil.ReadFile(fullPath)
+	// Read from the backend; persistent files fall back to S3 if configured
+	backend, relPath := vd.resolve(path)
+	data, err := backend.ReadFile(relPath)
 	if err != nil {
-		// Try S3 if configured and not temporary
-		if vd.s3store != nil && storageType == StoragePersistent {
-			data, err = vd.s3store.ReadFile(path)
-			if err != nil {
-				return nil, fmt.Errorf("failed to read file: %w", err)
-			}
-		} else {
-			return nil, fmt.Errorf("failed to read file: %w", err)
-		}
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
 	// Cache the data for future use
 	if vd.cache != nil {
 		vd.cache.Put(path, data, int64(len(data)))
+		vd.cache.Release(path)
 	}
 
 	// Publish access event
@@ -280,216 +557,268 @@ func (vd *VirtualDisk) Subscribe(eventType events.EventType, handler events.Hand
 	vd.eventBus.Subscribe(eventType, handler)
 }
 
-// getStorageType determines the storage type based on the path prefix
-func (vd *VirtualDisk) getStorageType(path string) StorageType {
-	if strings.HasPrefix(path, "temp/") && vd.enableTemp {
-		return StorageTemp
-	}
-	if strings.HasPrefix(path, "mem/") && vd.enableMemory {
-		return StorageMemory
-	}
-	return StoragePersistent
+// StorageType returns the storage type a virtual path resolves to
+func (vd *VirtualDisk) StorageType(path string) StorageType {
+	return vd.getStorageType(path)
 }
 
-// getFilePath returns the actual file path based on storage type
-func (vd *VirtualDisk) getFilePath(path string, storageType StorageType) string {
+// PathPrefix returns the virtual path prefix that selects the given storage type
+func PathPrefix(storageType StorageType) string {
 	switch storageType {
 	case StorageTemp:
-		return filepath.Join(vd.tempDir, strings.TrimPrefix(path, "temp/"))
+		return "temp/"
 	case StorageMemory:
-		return path
+		return "mem/"
 	default:
-		return filepath.Join(vd.dataPartition, path)
+		return ""
 	}
 }
 
-// DeleteFile deletes a file from the virtual disk
+// getStorageType determines the storage type based on the path prefix
+func (vd *VirtualDisk) getStorageType(path string) StorageType {
+	return vd.mountFor(path).storageType
+}
+
+// DeleteFile deletes a file from the virtual disk. Persistent files are
+// moved into the trash if it is enabled.
 func (vd *VirtualDisk) DeleteFile(path string) error {
-	vd.mu.Lock()
-	defer vd.mu.Unlock()
+	return vd.DeleteFileWith(path, WriteOptions{})
+}
+
+// DeleteFileWith deletes a file from the virtual disk with options
+func (vd *VirtualDisk) DeleteFileWith(path string, opts WriteOptions) error {
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
+	if err := vd.checkLease(path, opts.LockToken); err != nil {
+		return err
+	}
 
 	storageType := vd.getStorageType(path)
-	fullPath := vd.getFilePath(path, storageType)
+
+	if storageType == StoragePersistent {
+		// The trash needs the latest content
+		if vd.trash != nil {
+			if err := vd.flushPath(path); err != nil {
+				return err
+			}
+		}
+		vd.journalMu.RLock()
+		defer vd.journalMu.RUnlock()
+		if err := vd.logOp(journal.Record{Op: journal.OpDelete, Path: path}); err != nil {
+			return err
+		}
+	}
 
 	// Remove from buffer if present
-	if _, ok := vd.buffer[path]; ok {
-		delete(vd.buffer, path)
+	vd.dropBuffered(path)
+	if vd.cache != nil {
+		vd.cache.Remove(path)
 	}
 
-	// Remove from disk
-	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete file: %w", err)
+	entry, err := vd.trashFile(path)
+	if err != nil {
+		return err
 	}
 
-	// Delete from S3 if configured
-	if vd.s3store != nil {
-		if err := vd.s3store.DeleteFile(path); err != nil {
-			return fmt.Errorf("failed to delete from S3: %w", err)
+	var metadata map[string]interface{}
+	if entry != nil {
+		metadata = map[string]interface{}{
+			"trash": entry.ID,
 		}
 	}
+	vd.eventBus.Publish(events.Event{
+		Type:      events.EventFileDeleted,
+		Path:      path,
+		Timestamp: time.Now(),
+		Metadata:  metadata,
+	})
 
 	return nil
 }
 
 // ListFiles lists all files in the virtual disk with an optional prefix
 func (vd *VirtualDisk) ListFiles(prefix string) ([]string, error) {
-	vd.mu.RLock()
-	defer vd.mu.RUnlock()
+	vd.txMu.RLock()
+	defer vd.txMu.RUnlock()
 
-	files := make(map[string]struct{})
+	items, err := vd.listItems(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
 
-	// Add files from buffer
-	for path := range vd.buffer {
-		if strings.HasPrefix(path, prefix) {
-			files[path] = struct{}{}
+	// Convert map to slice
+	result := make([]string, 0, len(items))
+	for path, info := range items {
+		if !info.IsDir {
+			result = append(result, path)
 		}
 	}
 
-	// Add files from disk
-	err := filepath.Walk(vd.dataPartition, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			relPath, err := filepath.Rel(vd.dataPartition, path)
-			if err != nil {
-				return err
-			}
-			if strings.HasPrefix(relPath, prefix) {
-				files[relPath] = struct{}{}
-			}
-		}
-		return nil
-	})
+	return result, nil
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to list files: %w", err)
-	}
+// ListFilesAndDirs lists all files and directories in the virtual disk with an optional prefix
+func (vd *VirtualDisk) ListFilesAndDirs(prefix string) ([]FileInfo, error) {
+	vd.txMu.RLock()
+	defer vd.txMu.RUnlock()
 
-	// Add files from S3 if configured
-	if vd.s3store != nil {
-		s3Files, err := vd.s3store.ListFiles(prefix)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list S3 files: %w", err)
-		}
-		for _, path := range s3Files {
-			files[path] = struct{}{}
-		}
+	items, err := vd.listItems(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list items: %w", err)
 	}
 
 	// Convert map to slice
-	result := make([]string, 0, len(files))
-	for path := range files {
-		result = append(result, path)
+	result := make([]FileInfo, 0, len(items))
+	for _, info := range items {
+		result = append(result, info)
 	}
 
 	return result, nil
 }
 
-// ListFilesAndDirs lists all files and directories in the virtual disk with an optional prefix
-func (vd *VirtualDisk) ListFilesAndDirs(prefix string) ([]FileInfo, error) {
-	vd.mu.RLock()
-	defer vd.mu.RUnlock()
-
+// listItems merges the listings of all backends and the write-back buffer,
+// keyed by virtual path. Paths are not locked, so files changing while they
+// are listed may be listed either way.
+func (vd *VirtualDisk) listItems(prefix string) (map[string]FileInfo, error) {
 	items := make(map[string]FileInfo)
 
-	// Add files from disk and directories
-	err := filepath.Walk(vd.dataPartition, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	for _, m := range vd.mountList() {
+		// Work out which part of the backend the prefix covers, if any
+		var backendPrefix string
+		switch {
+		case strings.HasPrefix(prefix, m.prefix):
+			backendPrefix = strings.TrimPrefix(prefix, m.prefix)
+		case strings.HasPrefix(m.prefix, prefix):
+			backendPrefix = ""
+		default:
+			continue
 		}
 
-		relPath, err := filepath.Rel(vd.dataPartition, path)
+		infos, err := m.backend.List(backendPrefix)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		// Skip the root directory
-		if relPath == "." {
-			return nil
-		}
-
-		if strings.HasPrefix(relPath, prefix) {
-			items[relPath] = FileInfo{
-				Path:     relPath,
-				IsDir:    info.IsDir(),
-				Size:     info.Size(),
-				Modified: info.ModTime().Format(time.RFC3339),
+		for _, info := range infos {
+			virtualPath := m.prefix + info.Path
+			// Skip entries shadowed by a more specific mount
+			if !strings.HasPrefix(virtualPath, prefix) || vd.mountFor(virtualPath) != m {
+				continue
 			}
+			info.Path = virtualPath
+			if !info.IsDir {
+				info.ExpiresAt = vd.expiresAt(virtualPath)
+			}
+			items[virtualPath] = info
 		}
-		return nil
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to list items: %w", err)
 	}
 
 	// Add files from buffer
+	vd.mu.RLock()
+	defer vd.mu.RUnlock()
 	for path, entry := range vd.buffer {
 		if strings.HasPrefix(path, prefix) {
 			items[path] = FileInfo{
-				Path:     path,
-				IsDir:    false,
-				Size:     int64(len(entry.Data)),
-				Modified: entry.Modified.Format(time.RFC3339),
+				Path:      path,
+				IsDir:     false,
+				Size:      int64(len(entry.Data)),
+				Modified:  entry.Modified.Format(time.RFC3339),
+				ModTime:   entry.Modified,
+				ExpiresAt: vd.expiresAt(path),
 			}
 		}
 	}
 
-	// Convert map to slice
-	result := make([]FileInfo, 0, len(items))
-	for _, info := range items {
-		result = append(result, info)
-	}
-
-	return result, nil
+	return items, nil
 }
 
 // FileInfo represents information about a file or directory
 type FileInfo struct {
-	Path      string `json:"path"`
-	IsDir     bool   `json:"is_dir"`
-	Size      int64  `json:"size,omitempty"`
-	Modified  string `json:"modified"`
+	Path     string `json:"path"`
+	IsDir    bool   `json:"is_dir"`
+	Size     int64  `json:"size,omitempty"`
+	Modified string `json:"modified"`
+	// ExpiresAt is when the file is due to be deleted, if it expires
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Mode and ModTime are filled in by backends that know them
+	Mode    fs.FileMode `json:"-"`
+	ModTime time.Time   `json:"-"`
+	// StoredSize and Compression are set for files in compressed storage;
+	// Size is then the uncompressed size
+	StoredSize  int64  `json:"-"`
+	Compression string `json:"-"`
 }
 
 // Flush writes all buffered data to disk and S3
 func (vd *VirtualDisk) Flush() error {
-	for path := range vd.buffer {
-		delete(vd.buffer, path)
-	}
-	return nil
+	return vd.flushBuffered(0)
 }
 
 // CreateDirectory creates a directory and all parent directories in the virtual disk
 func (vd *VirtualDisk) CreateDirectory(path string) error {
-	vd.mu.Lock()
-	defer vd.mu.Unlock()
-
 	// Clean and validate the path
 	path = filepath.Clean(path)
 	if path == "." || path == "/" {
 		return nil // root directory always exists
 	}
 
+	unlock := vd.locks.lock(fileLock(path, true))
+	defer unlock()
+
 	storageType := vd.getStorageType(path)
-	fullPath := vd.getFilePath(path, storageType)
 
-	// Create the full path in the data partition
-	if err := os.MkdirAll(fullPath, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	if storageType == StoragePersistent {
+		vd.journalMu.RLock()
+		defer vd.journalMu.RUnlock()
+		if err := vd.logOp(journal.Record{Op: journal.OpMkdir, Path: path}); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	// Create the directory in the backend serving the path
+	backend, relPath := vd.resolve(path)
+	return backend.Mkdir(relPath)
 }
 
 // Close flushes all data, closes memory mapped files, and closes the virtual disk
 func (vd *VirtualDisk) Close() error {
+	vd.mu.Lock()
+	if vd.closed {
+		vd.mu.Unlock()
+		return nil
+	}
+	vd.closed = true
+	vd.mu.Unlock()
+
+	// Stop background goroutines before the final flush
+	close(vd.done)
+	vd.wg.Wait()
+
+	// Wait for running operations, then write back pending data and clear
+	// the memory buffer
+	unlock := vd.locks.lock(treeLock("", true))
+	defer unlock()
+	if err := vd.flushAll(); err != nil {
+		return err
+	}
+
 	vd.mu.Lock()
 	defer vd.mu.Unlock()
 
-	// Clear memory buffer
 	vd.buffer = make(map[string]*BufferEntry)
+	vd.bufferedBytes = 0
+
+	if vd.journal != nil {
+		if err := vd.journal.Close(); err != nil {
+			return fmt.Errorf("failed to close journal: %w", err)
+		}
+	}
+	if err := vd.txLog.Close(); err != nil {
+		return fmt.Errorf("failed to close transaction log: %w", err)
+	}
+	if err := vd.expiry.close(); err != nil {
+		return fmt.Errorf("failed to close expiry index: %w", err)
+	}
 
 	// Close memory mapped files
 	for _, file := range vd.mmapFiles {
@@ -506,7 +835,7 @@ func (vd *VirtualDisk) Close() error {
 		}
 	}
 
-	return vd.Flush()
+	return nil
 }
 
 // S3Config represents the S3 configuration